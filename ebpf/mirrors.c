@@ -37,14 +37,22 @@ int cg_connect4(struct bpf_sock_addr *ctx) {
   // Manage pod cidr subnet mask (todo: Add services)
   int svc_mask = (-1) << (32 - conf->svc_cidr);
 
+  // This field contains the port number passed to the connect() syscall
+  __u16 dst_port = bpf_ntohl(ctx->user_port) >> 16;
+
+  // External hosts from the egress rules are redirected to the proxy, which
+  // originates TLS to the provider
+  struct Egress egress;
+  __builtin_memset(&egress, 0, sizeof(egress));
+  egress.dst_addr = dst_addr;
+  egress.dst_port = dst_port;
+  __u8 *intercept = bpf_map_lookup_elem(&map_egress, &egress);
+
   // If this packet is not part of the podCIDR range then return
-  if ((bpf_htonl(ctx->user_ip4) & pod_mask) != conf->pod_cidr) {
+  if (!intercept && (bpf_htonl(ctx->user_ip4) & pod_mask) != conf->pod_cidr) {
     return 1;
   }
 
-  // This field contains the port number passed to the connect() syscall
-  __u16 dst_port = bpf_ntohl(ctx->user_port) >> 16;
-
   // This prevents the proxy from proxying itself
   // We need to compare the pid doing the connect() vs us
 
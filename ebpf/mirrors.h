@@ -7,6 +7,7 @@
 #include <bpf/bpf_tracing.h>
 
 #define MAX_CONNECTIONS 20000
+#define MAX_EGRESS 1024
 #define AF_INET 2 /* IP protocol family.  */
 #define BPF_SOCK_OPS_ACTIVE_ESTABLISHED_CB 4
 
@@ -27,6 +28,14 @@ struct Config {
   __u8 tunnel;
 };
 
+// An external address (resolved from an egress rule's host) that is intercepted even though it's outside the
+// pod CIDR, both fields are in host byte order
+struct Egress {
+  __u32 dst_addr;
+  __u16 dst_port;
+  __u16 pad;
+};
+
 struct Socket {
   __u32 src_addr;
   __u32 dst_addr;
@@ -41,6 +50,13 @@ struct {
   __type(value, struct Config);
 } map_config SEC(".maps");
 
+struct {
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __uint(max_entries, MAX_EGRESS);
+  __type(key, struct Egress);
+  __type(value, __u8);
+} map_egress SEC(".maps");
+
 struct {
   __uint(type, BPF_MAP_TYPE_HASH);
   __uint(max_entries, MAX_CONNECTIONS);
@@ -0,0 +1,169 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Formats of the access log
+const (
+	FormatJSON   = "json"
+	FormatCommon = "common" // Common log format, followed by the duration, peer and decision
+)
+
+// Where the access log is written, anything else is a file path
+const (
+	OutputNone   = ""
+	OutputStdout = "stdout"
+)
+
+// Policy decisions recorded for each request
+const (
+	DecisionAllowed         = "allowed"
+	DecisionBlockedRequest  = "blocked_request"
+	DecisionBlockedResponse = "blocked_response"
+	DecisionMaskedResponse  = "masked_response" // Banned words were masked in a streamed response
+)
+
+// Config sets where and how requests are logged
+type Config struct {
+	Output     string  // stdout or a file path, empty disables the access log
+	Format     string  // json or common
+	Sample     float64 // Fraction of allowed requests that are logged, blocked requests are always logged
+	MaxSize    int64   // Size in MB at which the file is rotated, 0 never rotates
+	MaxBackups int     // Rotated files that are kept
+}
+
+// Entry is a request and its response
+type Entry struct {
+	Time          time.Time     `json:"time"`
+	Protocol      string        `json:"protocol"`
+	Client        string        `json:"client"`
+	Destination   string        `json:"destination"`
+	Peer          string        `json:"peer,omitempty"` // Identity of the gateway that carried the request, if any
+	Method        string        `json:"method"`
+	Host          string        `json:"host"`
+	Path          string        `json:"path"`
+	Status        int           `json:"status"`
+	RequestBytes  int64         `json:"requestBytes"`
+	ResponseBytes int64         `json:"responseBytes"`
+	Upstream      time.Duration `json:"-"` // Until the response headers arrived
+	Duration      time.Duration `json:"-"` // Until the response was sent to the application
+	Decision      string        `json:"decision"`
+	GRPCStatus    string        `json:"grpcStatus,omitempty"`
+}
+
+// MarshalJSON writes the durations in milliseconds
+func (e *Entry) MarshalJSON() ([]byte, error) {
+	type entry Entry
+	return json.Marshal(&struct {
+		*entry
+		Upstream float64 `json:"upstreamMs"`
+		Duration float64 `json:"durationMs"`
+	}{
+		entry:    (*entry)(e),
+		Upstream: milliseconds(e.Upstream),
+		Duration: milliseconds(e.Duration),
+	})
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// Logger writes entries to the access log, a nil Logger logs nothing
+type Logger struct {
+	cfg Config
+	mu  sync.Mutex
+	w   io.Writer
+}
+
+func ValidateFormat(format string) error {
+	switch format {
+	case FormatJSON, FormatCommon:
+		return nil
+	}
+	return fmt.Errorf("unknown access log format [%s], expected json or common", format)
+}
+
+// New opens the access log, it returns nil when the access log is disabled
+func New(cfg Config) (*Logger, error) {
+	if cfg.Output == OutputNone {
+		return nil, nil
+	}
+	err := ValidateFormat(cfg.Format)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Sample < 0 || cfg.Sample > 1 {
+		return nil, fmt.Errorf("access log sample [%v] should be between 0 and 1", cfg.Sample)
+	}
+	l := &Logger{cfg: cfg, w: os.Stdout}
+	if cfg.Output != OutputStdout {
+		l.w, err = openRotating(cfg.Output, cfg.MaxSize<<20, cfg.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+	}
+	slog.Info("access log", "output", cfg.Output, "format", cfg.Format, "sample", cfg.Sample)
+	return l, nil
+}
+
+// Enabled is true when there is an access log, so callers can skip building entries
+func (l *Logger) Enabled() bool {
+	return l != nil
+}
+
+// Log writes an entry, allowed requests are sampled
+func (l *Logger) Log(e *Entry) {
+	if l == nil {
+		return
+	}
+	if e.Decision == DecisionAllowed && l.cfg.Sample < 1 && rand.Float64() >= l.cfg.Sample {
+		return
+	}
+	var line []byte
+	if l.cfg.Format == FormatCommon {
+		line = common(e)
+	} else {
+		var err error
+		line, err = json.Marshal(e)
+		if err != nil {
+			slog.Error("access log", "err", err)
+			return
+		}
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err := l.w.Write(line)
+	if err != nil {
+		slog.Error("writing access log", "err", err)
+	}
+}
+
+// common formats an entry as host ident authuser [date] "request" status bytes, the peer identity is used as
+// the authenticated user and the duration and decision are added to the end
+func common(e *Entry) []byte {
+	peer := e.Peer
+	if peer == "" {
+		peer = "-"
+	}
+	return fmt.Appendf(nil, "%s - %s [%s] \"%s %s %s\" %d %s %.3f %s", e.Client, peer, e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method, e.Path, e.Protocol, e.Status, commonBytes(e.ResponseBytes), milliseconds(e.Duration), e.Decision)
+}
+
+func commonBytes(n int64) string {
+	if n == 0 {
+		return "-"
+	}
+	return strconv.FormatInt(n, 10)
+}
@@ -0,0 +1,120 @@
+package accesslog
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testEntry(decision string) *Entry {
+	return &Entry{
+		Time:          time.Date(2024, time.March, 5, 14, 7, 9, 0, time.UTC),
+		Protocol:      "HTTP/1.1",
+		Client:        "10.244.1.5",
+		Destination:   "10.244.2.7:8080",
+		Peer:          "spiffe://cluster.local/ns/default/sa/client",
+		Method:        "POST",
+		Host:          "model:8080",
+		Path:          "/v1/chat/completions",
+		Status:        200,
+		RequestBytes:  512,
+		ResponseBytes: 2048,
+		Upstream:      1500 * time.Microsecond,
+		Duration:      12345 * time.Microsecond,
+		Decision:      decision,
+	}
+}
+
+func TestFormat(t *testing.T) {
+	noPeer := testEntry(DecisionBlockedRequest)
+	noPeer.Peer = ""
+	noPeer.Status = 403
+	noPeer.ResponseBytes = 0
+	noPeer.GRPCStatus = "7"
+
+	tests := []struct {
+		name     string
+		format   string
+		entry    *Entry
+		expected string
+	}{
+		{"JSON", FormatJSON, testEntry(DecisionAllowed),
+			`{"time":"2024-03-05T14:07:09Z","protocol":"HTTP/1.1","client":"10.244.1.5","destination":"10.244.2.7:8080",` +
+				`"peer":"spiffe://cluster.local/ns/default/sa/client","method":"POST","host":"model:8080","path":"/v1/chat/completions",` +
+				`"status":200,"requestBytes":512,"responseBytes":2048,"decision":"allowed","upstreamMs":1.5,"durationMs":12.345}`},
+		{"JSON without a peer", FormatJSON, noPeer,
+			`{"time":"2024-03-05T14:07:09Z","protocol":"HTTP/1.1","client":"10.244.1.5","destination":"10.244.2.7:8080",` +
+				`"method":"POST","host":"model:8080","path":"/v1/chat/completions","status":403,"requestBytes":512,` +
+				`"responseBytes":0,"decision":"blocked_request","grpcStatus":"7","upstreamMs":1.5,"durationMs":12.345}`},
+		{"Common", FormatCommon, testEntry(DecisionAllowed),
+			`10.244.1.5 - spiffe://cluster.local/ns/default/sa/client [05/Mar/2024:14:07:09 +0000] "POST /v1/chat/completions HTTP/1.1" 200 2048 12.345 allowed`},
+		{"Common without a peer", FormatCommon, noPeer,
+			`10.244.1.5 - - [05/Mar/2024:14:07:09 +0000] "POST /v1/chat/completions HTTP/1.1" 403 - 12.345 blocked_request`},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		l := &Logger{cfg: Config{Output: OutputStdout, Format: test.format, Sample: 1}, w: &buf}
+		l.Log(test.entry)
+		if got := buf.String(); got != test.expected+"\n" {
+			t.Errorf("%s: expected\n%s\ngot\n%s", test.name, test.expected, got)
+		}
+	}
+}
+
+func TestSample(t *testing.T) {
+	tests := []struct {
+		name     string
+		sample   float64
+		decision string
+		expected int // Lines logged out of 100
+	}{
+		{"Allowed, sampled out", 0, DecisionAllowed, 0},
+		{"Allowed, all kept", 1, DecisionAllowed, 100},
+		{"Blocked request, sampled out", 0, DecisionBlockedRequest, 100},
+		{"Blocked response, sampled out", 0, DecisionBlockedResponse, 100},
+		{"Masked response, sampled out", 0, DecisionMaskedResponse, 100},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		l := &Logger{cfg: Config{Output: OutputStdout, Format: FormatJSON, Sample: test.sample}, w: &buf}
+		for x := 0; x < 100; x++ {
+			l.Log(testEntry(test.decision))
+		}
+		if got := strings.Count(buf.String(), "\n"); got != test.expected {
+			t.Errorf("%s: expected %d lines, got %d", test.name, test.expected, got)
+		}
+	}
+
+	// A nil logger (access log disabled) logs nothing
+	var l *Logger
+	if l.Enabled() {
+		t.Error("expected a nil logger to be disabled")
+	}
+	l.Log(testEntry(DecisionBlockedRequest))
+}
+
+func TestNew(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	tests := []struct {
+		name    string
+		cfg     Config
+		err     bool
+		enabled bool
+	}{
+		{"Disabled", Config{}, false, false},
+		{"Stdout", Config{Output: OutputStdout, Format: FormatCommon, Sample: 0.5}, false, true},
+		{"File", Config{Output: path, Format: FormatJSON, Sample: 1}, false, true},
+		{"Unknown format", Config{Output: OutputStdout, Format: "combined", Sample: 1}, true, false},
+		{"Negative sample", Config{Output: OutputStdout, Format: FormatJSON, Sample: -0.1}, true, false},
+		{"Sample over 1", Config{Output: OutputStdout, Format: FormatJSON, Sample: 1.5}, true, false},
+		{"Missing directory", Config{Output: filepath.Join(path, "missing", "access.log"), Format: FormatJSON, Sample: 1}, true, false},
+	}
+	for _, test := range tests {
+		l, err := New(test.cfg)
+		if (err != nil) != test.err || l.Enabled() != test.enabled {
+			t.Errorf("%s: expected error %v enabled %v, got %v %v", test.name, test.err, test.enabled, err, l.Enabled())
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package accesslog
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// rotatingFile is a file that is renamed to <path>.1 once it reaches maxSize, older files move along to
+// <path>.2 and so on, with anything past maxBackups removed
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	f    *os.File
+	size int64
+}
+
+func openRotating(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	err := r.open()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("opening access log: %v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("opening access log: %v", err)
+	}
+	r.f = f
+	r.size = info.Size()
+	return nil
+}
+
+// Write is called with the logger's lock held
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	if r.maxSize != 0 && r.size != 0 && r.size+int64(len(p)) > r.maxSize {
+		err := r.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate moves the file along and opens a new one. If the file can't be moved it is reopened so entries keep
+// being written to it, and rotating is tried again once another maxSize has been written
+func (r *rotatingFile) rotate() error {
+	r.f.Close()
+	os.Remove(fmt.Sprintf("%s.%d", r.path, r.maxBackups))
+	for x := r.maxBackups - 1; x > 0; x-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.path, x), fmt.Sprintf("%s.%d", r.path, x+1))
+	}
+	var err error
+	if r.maxBackups > 0 {
+		err = os.Rename(r.path, r.path+".1")
+	} else {
+		err = os.Remove(r.path)
+	}
+	if err != nil {
+		slog.Warn("rotating access log", "err", err)
+		err = r.open()
+		r.size = 0
+		return err
+	}
+	return r.open()
+}
@@ -0,0 +1,131 @@
+package accesslog
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readLog(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	r, err := openRotating(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		_, err := r.Write([]byte(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each line takes the file past 10 bytes, so every line is in its own file and the oldest has gone
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{path, "fourth\n"},
+		{path + ".1", "third\n"},
+		{path + ".2", "second\n"},
+	}
+	for _, test := range tests {
+		if got := readLog(t, test.path); got != test.expected {
+			t.Errorf("%s: expected %q, got %q", filepath.Base(test.path), test.expected, got)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected only 2 backups to be kept, got %v", err)
+	}
+}
+
+func TestRotatingFileExisting(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	err := os.WriteFile(path, []byte("existing\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The size of an existing file counts towards rotating it
+	r, err := openRotating(path, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = r.Write([]byte("new\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readLog(t, path+".1"); got != "existing\n" {
+		t.Errorf("expected the existing file to be rotated, got %q", got)
+	}
+	if got := readLog(t, path); got != "new\n" {
+		t.Errorf("expected the new entry in a new file, got %q", got)
+	}
+}
+
+func TestRotatingFileNoBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	r, err := openRotating(path, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"first\n", "second\n"} {
+		_, err := r.Write([]byte(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := readLog(t, path); got != "second\n" {
+		t.Errorf("expected the file to be started again, got %q", got)
+	}
+	if _, err := os.Stat(path + ".1"); !os.IsNotExist(err) {
+		t.Errorf("expected no backups, got %v", err)
+	}
+}
+
+func TestRotatingFileRenameFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	r, err := openRotating(path, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A directory in the way of the backup can't be removed or replaced
+	err = os.MkdirAll(filepath.Join(path+".1", "blocked"), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"first\n", "second\n", "third\n"} {
+		_, err := r.Write([]byte(line))
+		if err != nil {
+			t.Fatalf("expected writing to carry on when rotating fails, got %v", err)
+		}
+	}
+	if got := readLog(t, path); got != "first\nsecond\nthird\n" {
+		t.Errorf("expected every entry in the original file, got %q", got)
+	}
+
+	// Rotating is tried again once the way is clear
+	err = os.RemoveAll(path + ".1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = r.Write([]byte("fourth\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readLog(t, path+".1"); got != "first\nsecond\nthird\n" {
+		t.Errorf("expected the original file to be rotated, got %q", got)
+	}
+	if got := readLog(t, path); got != "fourth\n" {
+		t.Errorf("expected the new entry in a new file, got %q", got)
+	}
+}
@@ -0,0 +1,72 @@
+package connection
+
+import (
+	"fmt"
+	"gateway/pkg/policy"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Responses sent by the receiving gateway once it has read the original destination
+const (
+	destinationAccepted = 'Y' // Kickstarts the comms
+	destinationRefused  = 'N' // Followed by the reason and then the connection is closed
+)
+
+// authorize evaluates the pod's authorization policy for a peer wanting to reach a target
+func (c *Config) authorize(peer *Identity, remote net.Addr, target string) bool {
+	if c.Policies == nil {
+		return true
+	}
+	_, p, _ := net.SplitHostPort(target)
+	port, _ := strconv.Atoi(p)
+
+	verdict, rule := c.Policies.Load().Authorization.Evaluate(peer.policyPeer(), port)
+	switch verdict {
+	case policy.Deny:
+		slog.Warn("connection denied", "remote", remote, "peer", peer.String(), "target", target, "rule", rule)
+		return false
+	case policy.Audit:
+		slog.Info("connection audited", "remote", remote, "peer", peer.String(), "target", target, "rule", rule)
+	}
+	return true
+}
+
+func (i *Identity) policyPeer() *policy.Peer {
+	if i == nil {
+		return nil
+	}
+	return &policy.Peer{Namespace: i.Namespace, ServiceAccount: i.ServiceAccount, Pod: i.Pod}
+}
+
+// refuseDestination tells the sending gateway why its connection won't be made
+func refuseDestination(conn net.Conn, reason string) {
+	_, err := conn.Write(append([]byte{destinationRefused}, reason...))
+	if err != nil {
+		slog.Error("refusing destination", "remote", conn.RemoteAddr(), "err", err)
+	}
+}
+
+// readDestinationResponse waits until the receiving gateway has accepted (or refused) the original destination,
+// only the response is read so that any data the target sends straight away is left for the data transfer
+func readDestinationResponse(conn net.Conn) error {
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+
+	response := make([]byte, 1)
+	_, err := io.ReadFull(conn, response)
+	if err != nil {
+		return fmt.Errorf("reading response from remote gateway: %v", err)
+	}
+	if response[0] == destinationAccepted {
+		return nil
+	}
+	reason, _ := io.ReadAll(io.LimitReader(conn, 256))
+	if response[0] == destinationRefused {
+		return fmt.Errorf("remote gateway refused connection: %s", reason)
+	}
+	return fmt.Errorf("unexpected response from remote gateway [%q]", response[0])
+}
@@ -0,0 +1,135 @@
+package connection
+
+import (
+	"crypto/x509"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+
+	"gateway/pkg/policy"
+)
+
+func TestAuthorize(t *testing.T) {
+	var store policy.Store
+	err := store.Update([]byte(`{"authorization":{"default":"deny","rules":[
+		{"name":"metrics","ports":[9090],"action":"deny"},
+		{"name":"shop","namespaces":["shop"],"serviceAccounts":["frontend"],"action":"allow"},
+		{"name":"probes","unauthenticated":true,"ports":[8081],"action":"audit"}]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{Policies: &store}
+	frontend := &Identity{TrustDomain: "cluster.local", Namespace: "shop", ServiceAccount: "frontend"}
+	other := &Identity{TrustDomain: "cluster.local", Namespace: "shop", ServiceAccount: "backend"}
+	remote := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 40000}
+
+	tests := []struct {
+		name    string
+		peer    *Identity
+		target  string
+		allowed bool
+	}{
+		{"allowed identity", frontend, "10.0.0.2:8080", true},
+		{"deny rule before allow", frontend, "10.0.0.2:9090", false},
+		{"other service account", other, "10.0.0.2:8080", false},
+		{"audited unauthenticated peer", nil, "10.0.0.2:8081", true},
+		{"unauthenticated peer", nil, "10.0.0.2:8080", false},
+	}
+	for _, test := range tests {
+		if allowed := c.authorize(test.peer, remote, test.target); allowed != test.allowed {
+			t.Errorf("%s: expected allowed %v, got %v", test.name, test.allowed, allowed)
+		}
+	}
+
+	// Without a policy store, or a policy, everything is allowed
+	if !(&Config{}).authorize(nil, remote, "10.0.0.2:8080") {
+		t.Error("expected no policy store to allow the connection")
+	}
+	store.Reset()
+	if !c.authorize(nil, remote, "10.0.0.2:8080") {
+		t.Error("expected the default to be allow once the policy is removed")
+	}
+}
+
+func TestParseSPIFFEID(t *testing.T) {
+	tests := []struct {
+		uri      string
+		identity *Identity
+	}{
+		{"spiffe://cluster.local/ns/shop/sa/frontend", &Identity{TrustDomain: "cluster.local", Namespace: "shop", ServiceAccount: "frontend"}},
+		{"spiffe://example.org/ns/a/sa/b", &Identity{TrustDomain: "example.org", Namespace: "a", ServiceAccount: "b"}},
+		{"https://cluster.local/ns/shop/sa/frontend", nil},
+		{"spiffe:///ns/shop/sa/frontend", nil},
+		{"spiffe://cluster.local/ns/shop", nil},
+		{"spiffe://cluster.local/sa/frontend/ns/shop", nil},
+		{"spiffe://cluster.local/ns//sa/frontend", nil},
+		{"spiffe://cluster.local/ns/shop/sa/frontend/extra", nil},
+	}
+	for _, test := range tests {
+		u, _ := url.Parse(test.uri)
+		id, err := ParseSPIFFEID(u)
+		if test.identity == nil {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %+v", test.uri, id)
+			}
+			continue
+		}
+		if err != nil || *id != *test.identity {
+			t.Errorf("%s: expected %+v, got %+v (%v)", test.uri, test.identity, id, err)
+		}
+		if id.String() != test.uri {
+			t.Errorf("expected the identity to print as %s, got %s", test.uri, id)
+		}
+	}
+}
+
+func TestPeerIdentity(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://cluster.local/ns/shop/sa/frontend")
+	web, _ := url.Parse("https://frontend.shop")
+	c := &Config{TrustDomain: "cluster.local"}
+
+	id, err := c.peerIdentity([]*x509.Certificate{{URIs: []*url.URL{web, spiffe}, DNSNames: []string{"frontend-1"}}})
+	if err != nil || id.Namespace != "shop" || id.ServiceAccount != "frontend" || id.Pod != "frontend-1" {
+		t.Fatalf("expected the SPIFFE identity with its pod, got %+v (%v)", id, err)
+	}
+	id, err = c.peerIdentity(nil)
+	if err != nil || id != nil {
+		t.Fatalf("expected no identity without a certificate, got %+v (%v)", id, err)
+	}
+	if id.String() != "unauthenticated" {
+		t.Fatalf("expected an unauthenticated peer, got %s", id)
+	}
+	_, err = c.peerIdentity([]*x509.Certificate{{URIs: []*url.URL{web}}})
+	if err == nil {
+		t.Fatal("expected a certificate without a SPIFFE ID to be refused")
+	}
+	_, err = (&Config{TrustDomain: "example.org"}).peerIdentity([]*x509.Certificate{{URIs: []*url.URL{spiffe}}})
+	if err == nil || !strings.Contains(err.Error(), "trust domain") {
+		t.Fatalf("expected an identity from another trust domain to be refused, got %v", err)
+	}
+}
+
+func TestReadDestinationResponse(t *testing.T) {
+	tests := []struct {
+		response string
+		err      string
+	}{
+		{string(destinationAccepted), ""},
+		{string(destinationRefused) + "port 22 isn't allowed", "port 22 isn't allowed"},
+		{"X", "unexpected response"},
+		{"", "reading response"},
+	}
+	for _, test := range tests {
+		client, server := net.Pipe()
+		go func() {
+			server.Write([]byte(test.response))
+			server.Close()
+		}()
+		err := readDestinationResponse(client)
+		client.Close()
+		if test.err == "" && err != nil || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%q: expected error %q, got %v", test.response, test.err, err)
+		}
+	}
+}
@@ -1,12 +1,21 @@
 package connection
 
 import (
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"gateway/pkg/accesslog"
+	"gateway/pkg/egress"
 	"gateway/pkg/gateway"
+	"gateway/pkg/intercept"
+	"gateway/pkg/limits"
+	"gateway/pkg/mesh"
+	"gateway/pkg/policy"
+	"gateway/pkg/shaping"
 	"log/slog"
 	"net"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/cilium/ebpf"
@@ -16,28 +25,75 @@ type Config struct {
 	ProxyPort      int
 	ClusterPort    int
 	ClusterTLSPort int
+	AdminPort      int
+	AdminDebug     bool // Serve the /debug endpoints on the admin port
 	Address        string
 	ClusterAddress string // For Debug purposes
 	CgroupOverride string // For Debug purposes
 
 	PodCIDR      string
 	Certificates *Certs
+	TrustDomain  string // SPIFFE trust domain that peer identities must belong to
+	MTLSMode     string // disabled, permissive or strict
+	TLSProfile   string // modern, intermediate or fips
+	AllowedPorts string // Ports that remote gateways may reach in this pod, empty allows any
 	Token        []byte
 
+	TicketRotation time.Duration // How often session ticket keys are rotated, 0 disables session resumption
+
 	Socks *ebpf.Map
 
-	ProxyFunc func(string) string
+	// Connection policies loaded from the pod's configmap
+	Policies *policy.Store
+	targets  *targetRestrictions
+	sessions *sessionResumption
+
+	// Connection limits, the Limiter is shared by every listener
+	Limits  limits.Config
+	Limiter *limits.Limiter
+
+	// How long to wait for the first bytes of a connection to classify it, 0 disables sniffing
+	SniffTimeout time.Duration
+
+	// Bandwidth limits from the pod's configmap
+	Shaper *shaping.Shaper
+
+	// External hosts that are intercepted and reached over TLS with an injected credential
+	Egress *egress.Gateway
+
+	// Mints certificates for the HTTPS hosts that are decrypted, nil if TLS interception is disabled
+	Intercept     *intercept.Authority
+	InterceptPort int            // Port of in-cluster destinations whose TLS may be intercepted
+	InterceptCAs  *x509.CertPool // Verifies intercepted upstreams in place of the system roots, nil uses the system roots
+
+	// Resolves the node gateway for a destination in tunnel mode
+	ProxyFunc      func(string) (string, error)
+	Routes         *mesh.Routes
+	TunnelFallback string // direct or refuse, when a destination isn't in Routes
+	StaticRoutes   bool   // Routes were loaded from a file and aren't watched
+
+	// Gateway-enabled pods and their capabilities, nil if discovery is disabled
+	Peers       *mesh.Peers
+	StaticPeers bool // Peers were loaded from a file and aren't watched
+
+	// What to do when the destination doesn't have a gateway
+	Fallback         string        // fail, direct or retry
+	FallbackRetries  int           // Extra attempts with the retry fallback
+	FallbackCacheTTL time.Duration // How long an unreachable gateway is remembered, 0 disables the cache
+	unmeshed         unmeshedCache
 
 	// Environment Variables
-	Endpoint bool // Run as a simple endoint
-	Tunnel   bool // Running as a tunnel compared to a sidecar
-	Encrypt  bool // Load certificates as traffic is encrypted
-	KTLS     bool // Enable Kernel TLS
-	Flush    bool // Find existing network connections and terminate them
-	AI       bool // Workload is going to be AI
+	Endpoint   bool // Run as a simple endoint
+	Tunnel     bool // Running as a tunnel compared to a sidecar
+	Encrypt    bool // Load certificates as traffic is encrypted
+	KTLS       bool // Enable Kernel TLS
+	KTLSStrict bool // Fail to start if the kernel can't offload TLS
+	Flush      bool // Find existing network connections and terminate them
+	AI         bool // Workload is going to be AI
 
 	// Gateway
 	AITransaction *gateway.AITransaction
+	AccessLog     accesslog.Config // Requests that pass through the HTTP gateway
 
 	Pids []uint32
 }
@@ -73,114 +129,208 @@ func (c *Config) StartListeners(listener net.Listener, internal bool) {
 			if conn != nil {
 				if internal {
 					slog.Info("internal connection", "remote", conn.RemoteAddr().String(), "local", conn.LocalAddr().String())
-					if c.KTLS {
-						go c.internalkTLSProxy(conn)
-					} else {
-						if c.AI {
-							go c.directConnect(conn, gateway.Http_gateway)
-						} else {
-							go c.internalProxy(conn, gateway.Copy_gateway)
-						}
-					}
+					c.serve(listenerInternal, conn, c.internalProxy)
 				} else {
 					slog.Info("external connection", "remote", conn.RemoteAddr().String(), "local", conn.LocalAddr().String())
-					go c.handleExternalConnection(conn)
+					c.serve(listenerExternal, conn, c.handleExternalConnection)
 				}
 			}
 		}
 	}
 }
 
-func (c *Config) directConnect(conn net.Conn, gatewayFunc func(net.Conn, net.Conn, *gateway.AITransaction) error) {
+// gatewayFunc returns how traffic from the application is inspected, independently of how it is carried.
+// HTTP/1 and prior knowledge HTTP/2 (h2c, including gRPC) are parsed by the HTTP/AI gateway, everything else is
+// copied as is, including protocols where the server speaks first. Without sniffing the AI gateway parses
+// everything as HTTP/1, as it did before traffic was classified
+func (c *Config) gatewayFunc(protocol string) (string, func(net.Conn, net.Conn, *gateway.AITransaction) error) {
+	if !c.AI {
+		return "copy", gateway.Copy_gateway
+	}
+	if c.SniffTimeout == 0 {
+		return "http", gateway.Http_gateway
+	}
+	switch protocol {
+	case gateway.ProtocolHTTP1:
+		return "http", gateway.Http_gateway
+	case gateway.ProtocolHTTP2:
+		return "http2", gateway.H2c_gateway
+	}
+	return "copy", gateway.Copy_gateway
+}
+
+// Create internal Proxy, the gatewayFunc for the sniffed protocol is applied to the application traffic before
+// it is carried by the transport (TLS, kTLS, plaintext or direct) to the destination
+func (c *Config) internalProxy(conn net.Conn) {
 	defer conn.Close()
 	// Get original destination address
 	destAddr, destPort, err := c.findTargetFromConnection(conn)
 	if err != nil {
 		return
 	}
-	targetDestination := fmt.Sprintf("%s:%d", destAddr, destPort) //nolint
+	targetDestination := net.JoinHostPort(destAddr, strconv.Itoa(int(destPort)))
 
-	// Check that the original destination address is reachable from the proxy
-	targetConn, err := net.DialTimeout("tcp", targetDestination, 5*time.Second)
+	release, err := c.acquireDestination(listenerInternal, conn.RemoteAddr(), targetDestination)
 	if err != nil {
-		slog.Error("direct connect", "target", targetDestination, "err", err)
+		return
+	}
+	defer release()
 
+	if target := c.Egress.Lookup(targetDestination); target != nil {
+		c.egressProxy(conn, target, targetDestination)
 		return
 	}
-	slog.Info("direct connect", "target", targetDestination)
 
-	// gatewayFunc(input from the application, A destination, the configuration)
+	// HTTPS to an intercepted host is decrypted, and encrypted again inside the transport to the destination.
+	// Anything else carries on as usual
+	if c.Intercept != nil && int(destPort) == c.InterceptPort {
+		var handled bool
+		dial := func() (net.Conn, error) { return c.dialDestination(destAddr, targetDestination) }
+		conn, handled = c.interceptProxy(conn, targetDestination, dial, "", "")
+		if handled {
+			return
+		}
+	}
+
+	targetConn, err := c.dialDestination(destAddr, targetDestination)
+	if err != nil {
+		return
+	}
+	defer targetConn.Close()
 
+	// Classify the traffic once the destination is ready, so protocols where the server speaks first aren't held up
+	// for longer than the sniff timeout
+	protocol := gateway.ProtocolUnknown
+	app := conn
+	if c.SniffTimeout != 0 {
+		protocol, app = gateway.Sniff(conn, c.SniffTimeout)
+	}
+	handler, gatewayFunc := c.gatewayFunc(protocol)
+	protocols.WithLabelValues(protocol, handler).Inc()
+	slog.Info("protocol", "origin", targetDestination, "protocol", protocol, "handler", handler)
 
-	err = gatewayFunc(conn, targetConn, c.AITransaction)
+	// gatewayFunc(input from the application, A destination, the configuration)
+	err = gatewayFunc(c.Shaper.Conn(app, shaping.Egress, targetDestination), c.Shaper.Conn(targetConn, shaping.Ingress, targetDestination), c.AITransaction)
 	if err != nil {
 		slog.Error("data write", "err", err)
 	}
 }
 
-// Create internal Proxy
-func (c *Config) internalProxy(conn net.Conn, gatewayFunc func(net.Conn, net.Conn, *gateway.AITransaction) error) {
-	defer conn.Close()
-	// Get original destination address
-	destAddr, destPort, err := c.findTargetFromConnection(conn)
+// dialDestination connects to targetDestination through the transport, once it returns the connection carries the
+// application's traffic to the destination
+func (c *Config) dialDestination(destAddr, targetDestination string) (net.Conn, error) {
+	targetConn, transport, err := c.dialTransport(destAddr, targetDestination)
 	if err != nil {
-		return
+		slog.Error("proxy create", "origin", targetDestination, "err", err)
+		return nil, err
 	}
-	targetDestination := fmt.Sprintf("%s:%d", destAddr, destPort)
-	var targetConn net.Conn
-	// Send traffic to endpoint gateway
-	if c.Certificates != nil {
-		targetConn, err = c.createTLSProxy(destAddr)
+	c.countConnection(listenerInternal, transport)
+
+	// A direct connection is already with the destination, otherwise the remote gateway needs the destination
+	if transport != "direct" {
+		//log.Printf("Internal proxy sending original destination: %s\n", targetDestination)
+		_, err = targetConn.Write([]byte(targetDestination))
 		if err != nil {
-			slog.Error("proxy create", "err", err)
-			return
+			slog.Error("destination write", "err", err)
 		}
-		slog.Info("proxy (TLS)", "endpoint", targetConn.RemoteAddr().String())
 
-	} else {
-		targetConn, err = c.createProxy(destAddr)
+		// Wait here until our remote endpoint has accepted the targetDestination
+		err = readDestinationResponse(targetConn)
 		if err != nil {
-			panic(err)
+			slog.Error("destination response", "origin", targetDestination, "err", err)
+			targetConn.Close()
+			return nil, err
 		}
-		slog.Info("proxy", "endpoint", targetConn.RemoteAddr().String())
-
 	}
-	defer targetConn.Close()
+	return targetConn, nil
+}
 
-	//log.Printf("Internal proxy sending original destination: %s\n", targetDestination)
-	_, err = targetConn.Write([]byte(targetDestination))
+// dialTransport connects to the gateway that serves destAddr, the connection is encrypted with TLS or kTLS
+// when we have certificates. Without certificates an AI gateway connects directly to the destination, as
+// it may not be running a gateway (e.g. a model server). Destinations whose gateway can't be reached are
+// handled by the fallback, as are destinations that discovery knows can't be reached through a gateway
+func (c *Config) dialTransport(destAddr, targetDestination string) (net.Conn, string, error) {
+	if c.Certificates == nil && c.AI {
+		// Check that the original destination address is reachable from the proxy
+		targetConn, err := net.DialTimeout("tcp", targetDestination, 5*time.Second)
+		if err != nil {
+			return nil, "", fmt.Errorf("direct connect: %v", err)
+		}
+		slog.Info("direct connect", "target", targetDestination)
+		return targetConn, "direct", nil
+	}
+	reason, err := c.checkPeer(destAddr)
 	if err != nil {
-		slog.Error("destination write", "err", err)
+		return nil, "", err
 	}
+	if reason != "" {
+		return c.fallback(destAddr, targetDestination, reason, errors.New("discovered without a usable gateway"))
+	}
+	if c.FallbackCacheTTL != 0 && c.unmeshed.has(destAddr) {
+		return c.fallback(destAddr, targetDestination, "cached", errors.New("gateway recently unreachable"))
+	}
+	targetConn, transport, err := c.dialGatewayRetry(destAddr)
+	if err != nil {
+		if !isDialError(err) {
+			return nil, "", err
+		}
+		if c.FallbackCacheTTL != 0 {
+			c.unmeshed.add(destAddr, c.FallbackCacheTTL)
+		}
+		return c.fallback(destAddr, targetDestination, "dial_failed", err)
+	}
+	return targetConn, transport, nil
+}
 
-	tmp := make([]byte, 256)
-
-	// Ideally we wait here until our remote endpoint has recieved the targetDestination
-	targetConn.Read(tmp)
-
-	//log.Printf("Internal connection from %s to %s\n", conn.RemoteAddr(), targetConn.RemoteAddr())
-
-	// The following code creates two data transfer channels:
-	// - From the client to the target server (handled by a separate goroutine).
-	// - From the target server to the client (handled by the main goroutine).
-	err = gatewayFunc(conn, targetConn, c.AITransaction)
+// dialGateway connects to the gateway that serves destAddr
+func (c *Config) dialGateway(destAddr string) (net.Conn, string, error) {
+	if c.Certificates != nil {
+		var targetConn net.Conn
+		var peer *Identity
+		var err error
+		if c.KTLS {
+			targetConn, peer, err = c.createkTLSProxy(destAddr)
+		} else {
+			targetConn, peer, err = c.createTLSProxy(destAddr)
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		slog.Info("proxy (TLS)", "endpoint", targetConn.RemoteAddr().String(), "peer", peer.String(), "ktls", c.KTLS)
+		return &gateway.PeerConn{Conn: targetConn, Peer: peer.String()}, "mtls", nil
+	}
+	targetConn, err := c.createProxy(destAddr)
 	if err != nil {
-		slog.Error("data write", "err", err)
+		return nil, "", err
 	}
+	slog.Info("proxy", "endpoint", targetConn.RemoteAddr().String())
+	return targetConn, "plaintext", nil
 }
 
-func (c *Config) createProxy(destAddr string) (net.Conn, error) {
-	endpoint := fmt.Sprintf("%s:%d", destAddr, c.ClusterPort)
+// gatewayEndpoint returns the address of the gateway serving destAddr, port is where that gateway listens
+func (c *Config) gatewayEndpoint(destAddr string, port int) (string, error) {
+	if c.Tunnel {
+		node, err := c.ProxyFunc(destAddr)
+		if err != nil {
+			return "", err
+		}
+		return net.JoinHostPort(node, strconv.Itoa(c.ClusterPort)), nil
+	}
 	if c.ClusterAddress != "" {
-		endpoint = fmt.Sprintf("%s:%d", c.ClusterAddress, c.ClusterPort)
+		return net.JoinHostPort(c.ClusterAddress, strconv.Itoa(c.ClusterPort)), nil
 	}
-	if c.Tunnel {
-		endpoint = fmt.Sprintf("%s:%d", c.ProxyFunc(destAddr), c.ClusterPort)
+	return net.JoinHostPort(destAddr, strconv.Itoa(port)), nil
+}
+
+func (c *Config) createProxy(destAddr string) (net.Conn, error) {
+	endpoint, err := c.gatewayEndpoint(destAddr, c.ClusterPort)
+	if err != nil {
+		return nil, err
 	}
 	// Check that the original destination address is reachable from the proxy
 	targetConn, err := net.DialTimeout("tcp", endpoint, 5*time.Second)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to connect to original destination: %v", err)
+		return nil, fmt.Errorf("Failed to connect to original destination: %w", err)
 	}
 	return targetConn, nil
 }
@@ -189,31 +339,26 @@ func (c *Config) createProxy(destAddr string) (net.Conn, error) {
 func (c *Config) handleExternalConnection(conn net.Conn) {
 	defer conn.Close()
 
-	tmp := make([]byte, 256)
-	n, err := conn.Read(tmp)
-	if err != nil {
-		slog.Info("external read", "err", err)
-	}
-	remoteAddress := string(tmp[:n])
-
-	if remoteAddress == fmt.Sprintf("%s:%d", c.Address, c.ProxyPort) {
-		slog.Error("Potential loopback")
+	if c.MTLSMode == MTLSStrict {
+		slog.Warn("plaintext connection refused", "remote", conn.RemoteAddr(), "mtls", c.MTLSMode)
+		connectionsRefused.WithLabelValues(listenerExternal, "mtls_strict").Inc()
 		return
 	}
+	c.countConnection(listenerExternal, "plaintext")
 
-	// Check that the original destination address is reachable from the proxy
-	targetConn, err := net.DialTimeout("tcp", remoteAddress, 5*time.Second)
+	targetConn, err := c.acceptDestination(conn, listenerExternal, nil)
 	if err != nil {
-		slog.Error("connection", "destination", string(tmp), "err", err)
+		slog.Error("destination", "remote", conn.RemoteAddr(), "err", err)
 		return
 	}
 	defer targetConn.Close()
-	conn.Write([]byte{'Y'}) // Send a response to kickstart the comms
+	conn.Write([]byte{destinationAccepted}) // Send a response to kickstart the comms
 
 	slog.Info("connection", "remote", conn.RemoteAddr(), "target", targetConn.RemoteAddr())
 
 	// The following code creates two data transfer channels:
 	// - From the client to the target server (handled by a separate goroutine).
 	// - From the target server to the client (handled by the main goroutine).
-	gateway.Copy_gateway(targetConn, conn, c.AITransaction)
+	app, remote := c.shapeExternal(targetConn, conn)
+	gateway.Copy_gateway(app, remote, c.AITransaction)
 }
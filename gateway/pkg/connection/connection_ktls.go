@@ -5,7 +5,6 @@ import (
 	"errors"
 	"fmt"
 	"gateway/pkg/gateway"
-	"io"
 	"log"
 	"log/slog"
 	"net"
@@ -31,10 +30,12 @@ func (c *Config) StartExternalkTLSListener() net.Listener {
 	config := &tls.Config{
 		ClientCAs:    caCertPool,
 		Certificates: []tls.Certificate{certificate},
-		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ClientAuth:   tls.ClientAuthType(c.mtlsClientAuth()),
 		KernelTX:     true,
 		KernelRX:     true,
 	} //<-- this is the key
+	c.applykTLSProfile(config)
+	c.ktlsListenerResumption(config)
 
 	listener, err := tls.Listen("tcp", proxyAddr, config)
 
@@ -46,6 +47,18 @@ func (c *Config) StartExternalkTLSListener() net.Listener {
 	return listener
 }
 
+// applykTLSProfile sets the profile on a kTLS configuration, the identifiers are shared with crypto/tls
+func (c *Config) applykTLSProfile(config *tls.Config) {
+	p := c.tlsProfile()
+	config.MinVersion = p.minVersion
+	config.MaxVersion = p.maxVersion
+	config.CipherSuites = p.cipherSuites
+	config.CurvePreferences = nil
+	for _, curve := range p.curves {
+		config.CurvePreferences = append(config.CurvePreferences, tls.CurveID(curve))
+	}
+}
+
 // Blocking function
 func (c *Config) StartkTLSListener(listener net.Listener) {
 	for {
@@ -58,101 +71,60 @@ func (c *Config) StartkTLSListener(listener net.Listener) {
 		}
 
 		slog.Info("accepted connection", "remote", conn.RemoteAddr().String(), "local", conn.LocalAddr().String())
-		go c.handlekTLSExternalConnection(conn)
+		c.serve(listenerKTLS, conn, c.handlekTLSExternalConnection)
 
 	}
 }
 
-// HTTP proxy request handler
-func (c *Config) internalkTLSProxy(conn net.Conn) {
-	defer conn.Close()
-	// Get original destination address
-	destAddr, destPort, err := c.findTargetFromConnection(conn)
+func (c *Config) createkTLSProxy(destAddr string) (net.Conn, *Identity, error) {
+	caCertPool := x509.NewCertPool()
+	if !caCertPool.AppendCertsFromPEM(c.Certificates.ca) {
+		log.Fatalf("could not append CA")
+	}
+	certificate, err := tls.X509KeyPair(c.Certificates.cert, c.Certificates.key)
 	if err != nil {
-		return
+		log.Fatalf("could not load certificate: %v", err)
 	}
-	targetDestination := fmt.Sprintf("%s:%d", destAddr, destPort)
-	var targetConn net.Conn
-	var endpoint string
-	// Send traffic to endpoint gateway
-	if c.Certificates != nil {
-
-		caCertPool := x509.NewCertPool()
-		if !caCertPool.AppendCertsFromPEM(c.Certificates.ca) {
-			log.Fatalf("could not append CA")
-		}
-		certificate, err := tls.X509KeyPair(c.Certificates.cert, c.Certificates.key)
-		if err != nil {
-			log.Fatalf("could not load certificate: %v", err)
-		}
-
-		config := &tls.Config{
-			RootCAs:      caCertPool,
-			Certificates: []tls.Certificate{certificate},
-			ClientAuth:   tls.VerifyClientCertIfGiven,
-			KernelTX:     true,
-			KernelRX:     true,
-		} //<-- this is the key
-
-		endpoint = fmt.Sprintf("%s:%d", destAddr, c.ClusterTLSPort)
-		if c.ClusterAddress != "" {
-			endpoint = fmt.Sprintf("%s:%d", c.ClusterAddress, c.ClusterPort)
-		}
-		if c.Tunnel {
-			endpoint = fmt.Sprintf("%s:%d", c.ProxyFunc(destAddr), c.ClusterPort)
-		}
 
-		// Set a timeout, mainly because connections can occur to pods that aren't ready
-		d := net.Dialer{Timeout: time.Second * 3}
-		targetConn, err = tls.DialWithDialer(&d, "tcp", endpoint, config)
-		if err != nil {
-			slog.Error("connecting to destination TLS proxy", "err", err)
-			return
-		}
-	} else {
-		endpoint = fmt.Sprintf("%s:%d", destAddr, c.ClusterPort)
-		if c.ClusterAddress != "" {
-			endpoint = fmt.Sprintf("%s:%d", c.ClusterAddress, c.ClusterPort)
-		}
-		if c.Tunnel {
-			endpoint = fmt.Sprintf("%s:%d", c.ProxyFunc(destAddr), c.ClusterPort)
-		}
-		// Check that the original destination address is reachable from the proxy
-		targetConn, err = net.DialTimeout("tcp", endpoint, 5*time.Second)
-		if err != nil {
-			slog.Error("connecting to original destination", "err", err)
-			return
-		}
+	expected, err := c.expectedGateway(destAddr)
+	if err != nil {
+		return nil, nil, err
 	}
-	defer targetConn.Close()
+	config := &tls.Config{
+		RootCAs:      caCertPool,
+		Certificates: []tls.Certificate{certificate},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		KernelTX:     true,
+		KernelRX:     true,
+		// The chain and destination are checked in verifyGateway, as the endpoint we dial isn't always the destination
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			return c.verifyGateway(caCertPool, cs.PeerCertificates, expected)
+		},
+	} //<-- this is the key
+	c.applykTLSProfile(config)
+	c.ktlsDialerResumption(config)
 
-	slog.Info("connecting", "proxy", endpoint, "origin", targetDestination)
-	//log.Printf("Internal proxy sending original destination: %s\n", targetDestination)
-	_, err = targetConn.Write([]byte(targetDestination))
+	endpoint, err := c.gatewayEndpoint(destAddr, c.ClusterTLSPort)
 	if err != nil {
-		slog.Error("network write", "endpoint", endpoint, "err", err)
+		return nil, nil, err
 	}
 
-	tmp := make([]byte, 256)
-
-	// Ideally we wait here until our remote endpoint has recieved the targetDestination
-	targetConn.Read(tmp)
-
-	//log.Printf("Internal connection from %s to %s\n", conn.RemoteAddr(), targetConn.RemoteAddr())
-
-	// The following code creates two data transfer channels:
-	// - From the client to the target server (handled by a separate goroutine).
-	// - From the target server to the client (handled by the main goroutine).
-	go func() {
-		_, err = io.Copy(targetConn, conn)
-		if err != nil {
-			slog.Error("copying data to target", "err", err)
-		}
-	}()
-	_, err = io.Copy(conn, targetConn)
+	// Set a timeout, mainly because connections can occur to pods that aren't ready
+	d := net.Dialer{Timeout: time.Second * 3}
+	targetConn, err := tls.DialWithDialer(&d, "tcp", endpoint, config)
 	if err != nil {
-		slog.Error("copying data from target", "err", err)
+		return nil, nil, fmt.Errorf("Failed to connect to destination kTLS proxy: %w", err)
 	}
+	state := targetConn.ConnectionState()
+	c.recordHandshake("client", endpoint, state.Version, state.CipherSuite, uint16(state.CurveID), state.DidResume)
+	recordOffload("client", endpoint, targetConn.KernelTX(), targetConn.KernelRX())
+	peer, err := c.peerIdentity(state.PeerCertificates)
+	if err != nil {
+		targetConn.Close()
+		return nil, nil, fmt.Errorf("destination kTLS proxy identity: %v", err)
+	}
+	return targetConn, peer, nil
 }
 
 // Unencrypted external connection
@@ -160,33 +132,34 @@ func (c *Config) handlekTLSExternalConnection(conn net.Conn) {
 	defer conn.Close()
 	var tConn *tls.Conn = conn.(*tls.Conn)
 
-	tmp := make([]byte, 256)
-	n, err := tConn.Read(tmp)
+	err := tConn.Handshake()
 	if err != nil {
-		slog.Error("connection read", "err", err)
+		slog.Error("tls handshake", "remote", conn.RemoteAddr(), "err", err)
+		return
 	}
-
-	remoteAddress := string(tmp[:n])
-
-	if remoteAddress == fmt.Sprintf("%s:%d", c.Address, c.ProxyPort) {
-		slog.Error("Potential loopback", "remoteAdd", remoteAddress)
+	state := tConn.ConnectionState()
+	c.recordHandshake("server", conn.RemoteAddr().String(), state.Version, state.CipherSuite, uint16(state.CurveID), state.DidResume)
+	recordOffload("server", conn.RemoteAddr().String(), tConn.KernelTX(), tConn.KernelRX())
+	peer, err := c.peerIdentity(state.PeerCertificates)
+	if err != nil {
+		slog.Error("peer identity", "remote", conn.RemoteAddr(), "err", err)
 		return
 	}
+	c.countConnection(listenerKTLS, transportFor(peer))
 
-	// Check that the original destination address is reachable from the proxy
-	targetConn, err := net.DialTimeout("tcp", remoteAddress, 5*time.Second)
-	//targetConn, err := tls.Dial("tcp", remoteAddress, config)
+	targetConn, err := c.acceptDestination(tConn, listenerKTLS, peer)
 	if err != nil {
-		slog.Error("connection", "original/local addr", string(tmp), "err", err)
+		slog.Error("destination", "remote", conn.RemoteAddr(), "err", err)
 		return
 	}
 	defer targetConn.Close()
-	tConn.Write([]byte{'Y'}) // Send a response to kickstart the comms
+	tConn.Write([]byte{destinationAccepted}) // Send a response to kickstart the comms
 
-	slog.Info("connection", "remote", conn.RemoteAddr(), "target", targetConn.RemoteAddr())
+	slog.Info("connection", "remote", conn.RemoteAddr(), "peer", peer.String(), "target", targetConn.RemoteAddr())
 
 	// The following code creates two data transfer channels:
 	// - From the client to the target server (handled by a separate goroutine).
 	// - From the target server to the client (handled by the main goroutine).
-	gateway.Copy_gateway(targetConn, tConn, c.AITransaction)
+	app, remote := c.shapeExternal(targetConn, tConn)
+	gateway.Copy_gateway(app, remote, c.AITransaction)
 }
@@ -0,0 +1,34 @@
+package connection
+
+import (
+	"testing"
+	"time"
+
+	"gateway/pkg/gateway"
+)
+
+func TestGatewayFunc(t *testing.T) {
+	tests := []struct {
+		name     string
+		ai       bool
+		sniff    time.Duration
+		protocol string
+		handler  string
+	}{
+		{"HTTP/1", true, time.Second, gateway.ProtocolHTTP1, "http"},
+		{"h2c", true, time.Second, gateway.ProtocolHTTP2, "http2"},
+		{"TLS", true, time.Second, gateway.ProtocolTLS, "copy"},
+		{"Postgres", true, time.Second, gateway.ProtocolPostgres, "copy"},
+		{"Redis", true, time.Second, gateway.ProtocolRedis, "copy"},
+		{"Server speaks first", true, time.Second, gateway.ProtocolUnknown, "copy"},
+		{"Sniffing disabled", true, 0, gateway.ProtocolUnknown, "http"},
+		{"Not AI", false, time.Second, gateway.ProtocolHTTP1, "copy"},
+		{"Not AI without sniffing", false, 0, gateway.ProtocolUnknown, "copy"},
+	}
+	for _, test := range tests {
+		c := &Config{AI: test.ai, SniffTimeout: test.sniff}
+		if handler, _ := c.gatewayFunc(test.protocol); handler != test.handler {
+			t.Errorf("%s: expected %s, got %s", test.name, test.handler, handler)
+		}
+	}
+}
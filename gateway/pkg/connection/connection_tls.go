@@ -5,7 +5,7 @@ import (
 	"crypto/x509"
 	"errors"
 	"fmt"
-	"io"
+	"gateway/pkg/gateway"
 	"log"
 	"log/slog"
 	"net"
@@ -29,8 +29,10 @@ func (c *Config) StartExternalTLSListener() net.Listener {
 	config := &tls.Config{
 		ClientCAs:    caCertPool,
 		Certificates: []tls.Certificate{certificate},
-		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ClientAuth:   c.mtlsClientAuth(),
 	} //<-- this is the key
+	c.applyTLSProfile(config)
+	c.tlsListenerResumption(config)
 
 	listener, err := tls.Listen("tcp", proxyAddr, config)
 
@@ -54,12 +56,12 @@ func (c *Config) StartTLSListener(listener net.Listener) {
 		}
 
 		slog.Info("accepted connection", "remote", conn.RemoteAddr().String(), "local", conn.LocalAddr().String())
-		go c.handleTLSExternalConnection(conn)
+		c.serve(listenerTLS, conn, c.handleTLSExternalConnection)
 
 	}
 }
 
-func (c *Config) createTLSProxy(destAddr string) (net.Conn, error) {
+func (c *Config) createTLSProxy(destAddr string) (net.Conn, *Identity, error) {
 	caCertPool := x509.NewCertPool()
 	if !caCertPool.AppendCertsFromPEM(c.Certificates.ca) {
 		log.Fatalf("could not append CA")
@@ -69,27 +71,42 @@ func (c *Config) createTLSProxy(destAddr string) (net.Conn, error) {
 		log.Fatalf("could not load certificate: %v", err)
 	}
 
+	expected, err := c.expectedGateway(destAddr)
+	if err != nil {
+		return nil, nil, err
+	}
 	config := &tls.Config{
 		RootCAs:      caCertPool,
 		Certificates: []tls.Certificate{certificate},
 		ClientAuth:   tls.VerifyClientCertIfGiven,
+		// The chain and destination are checked in verifyGateway, as the endpoint we dial isn't always the destination
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			return c.verifyGateway(caCertPool, cs.PeerCertificates, expected)
+		},
 	} //<-- this is the key
+	c.applyTLSProfile(config)
+	c.tlsDialerResumption(config)
 
-	endpoint := fmt.Sprintf("%s:%d", destAddr, c.ClusterTLSPort)
-	if c.ClusterAddress != "" {
-		endpoint = fmt.Sprintf("%s:%d", c.ClusterAddress, c.ClusterPort)
-	}
-	if c.Tunnel {
-		endpoint = fmt.Sprintf("%s:%d", c.ProxyFunc(destAddr), c.ClusterPort)
+	endpoint, err := c.gatewayEndpoint(destAddr, c.ClusterTLSPort)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	// Set a timeout, mainly because connections can occur to pods that aren't ready
 	d := net.Dialer{Timeout: time.Second * 3}
 	targetConn, err := tls.DialWithDialer(&d, "tcp", endpoint, config)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to connect to destination TLS proxy: %v", err)
+		return nil, nil, fmt.Errorf("Failed to connect to destination TLS proxy: %w", err)
+	}
+	state := targetConn.ConnectionState()
+	c.recordHandshake("client", endpoint, state.Version, state.CipherSuite, uint16(state.CurveID), state.DidResume)
+	peer, err := c.peerIdentity(state.PeerCertificates)
+	if err != nil {
+		targetConn.Close()
+		return nil, nil, fmt.Errorf("destination TLS proxy identity: %v", err)
 	}
-	return targetConn, nil
+	return targetConn, peer, nil
 }
 
 // Unencrypted external connection
@@ -97,42 +114,33 @@ func (c *Config) handleTLSExternalConnection(conn net.Conn) {
 	defer conn.Close()
 	var tConn *tls.Conn = conn.(*tls.Conn)
 
-	tmp := make([]byte, 256)
-	n, err := tConn.Read(tmp)
+	err := tConn.Handshake()
 	if err != nil {
-		slog.Error("connection read", "err", err)
+		slog.Error("tls handshake", "remote", conn.RemoteAddr(), "err", err)
+		return
 	}
-
-	remoteAddress := string(tmp[:n])
-
-	if remoteAddress == fmt.Sprintf("%s:%d", c.Address, c.ProxyPort) {
-		slog.Error("Potential loopback", "remoteAdd", remoteAddress)
+	state := tConn.ConnectionState()
+	c.recordHandshake("server", conn.RemoteAddr().String(), state.Version, state.CipherSuite, uint16(state.CurveID), state.DidResume)
+	peer, err := c.peerIdentity(state.PeerCertificates)
+	if err != nil {
+		slog.Error("peer identity", "remote", conn.RemoteAddr(), "err", err)
 		return
 	}
+	c.countConnection(listenerTLS, transportFor(peer))
 
-	// Check that the original destination address is reachable from the proxy
-	targetConn, err := net.DialTimeout("tcp", remoteAddress, 5*time.Second)
-	//targetConn, err := tls.Dial("tcp", remoteAddress, config)
+	targetConn, err := c.acceptDestination(tConn, listenerTLS, peer)
 	if err != nil {
-		slog.Error("connection", "original/local addr", string(tmp), "err", err)
+		slog.Error("destination", "remote", conn.RemoteAddr(), "err", err)
 		return
 	}
 	defer targetConn.Close()
-	tConn.Write([]byte{'Y'}) // Send a response to kickstart the comms
+	tConn.Write([]byte{destinationAccepted}) // Send a response to kickstart the comms
 
-	slog.Info("connection", "remote", conn.RemoteAddr(), "target", targetConn.RemoteAddr())
+	slog.Info("connection", "remote", conn.RemoteAddr(), "peer", peer.String(), "target", targetConn.RemoteAddr())
 
 	// The following code creates two data transfer channels:
 	// - From the client to the target server (handled by a separate goroutine).
 	// - From the target server to the client (handled by the main goroutine).
-	go func() {
-		_, err = io.Copy(targetConn, tConn)
-		if err != nil {
-			slog.Error("copying data to target", "err", err)
-		}
-	}()
-	_, err = io.Copy(tConn, targetConn)
-	if err != nil {
-		slog.Error("copying data from target", "err", err)
-	}
+	app, remote := c.shapeExternal(targetConn, tConn)
+	gateway.Copy_gateway(app, remote, c.AITransaction)
 }
@@ -0,0 +1,156 @@
+package connection
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// targetRestrictions limit what a receiving gateway will dial on behalf of a remote gateway, without them the
+// external listeners would relay to anything that the pod can reach
+type targetRestrictions struct {
+	addresses map[string]bool // The pod's own IP addresses
+	network   *net.IPNet      // In tunnel mode any pod in the PodCIDR can be reached
+	ports     []portRange     // No ranges allows any port
+	reserved  map[int]bool    // The gateway's own ports are never dialed
+}
+
+type portRange struct {
+	from, to int
+}
+
+// ParsePorts parses a list of ports and port ranges e.g. "80,443,8000-8100"
+func ParsePorts(ports string) ([]portRange, error) {
+	var ranges []portRange
+	for _, p := range strings.Split(ports, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		from, to, isRange := strings.Cut(p, "-")
+		start, err := strconv.Atoi(from)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port [%s]", p)
+		}
+		end := start
+		if isRange {
+			end, err = strconv.Atoi(to)
+			if err != nil {
+				return nil, fmt.Errorf("invalid port range [%s]", p)
+			}
+		}
+		if start < 1 || end > 65535 || start > end {
+			return nil, fmt.Errorf("invalid port range [%s]", p)
+		}
+		ranges = append(ranges, portRange{from: start, to: end})
+	}
+	return ranges, nil
+}
+
+// LoadTargetRestrictions finds the pod's own addresses and parses the allowed ports, it needs to be called
+// from within the pod's network namespace
+func (c *Config) LoadTargetRestrictions() error {
+	ports, err := ParsePorts(c.AllowedPorts)
+	if err != nil {
+		return err
+	}
+	r := &targetRestrictions{
+		addresses: make(map[string]bool),
+		ports:     ports,
+		reserved:  map[int]bool{c.ProxyPort: true, c.ClusterPort: true, c.ClusterTLSPort: true, c.AdminPort: true},
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return fmt.Errorf("finding pod addresses: %v", err)
+	}
+	for x := range addrs {
+		ipNet, ok := addrs[x].(*net.IPNet)
+		if ok && !ipNet.IP.IsLoopback() {
+			r.addresses[ipNet.IP.String()] = true
+		}
+	}
+	if c.Tunnel {
+		_, r.network, err = net.ParseCIDR(c.PodCIDR)
+		if err != nil {
+			return fmt.Errorf("parsing pod cidr: %v", err)
+		}
+	}
+	c.targets = r
+	slog.Info("target restrictions", "addresses", len(r.addresses), "allowedPorts", c.AllowedPorts)
+	return nil
+}
+
+// checkTarget ensures that a destination sent by a remote gateway is one this gateway is allowed to dial
+func (c *Config) checkTarget(target string) error {
+	host, p, err := net.SplitHostPort(target)
+	if err != nil {
+		return fmt.Errorf("invalid destination")
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return fmt.Errorf("invalid destination port")
+	}
+	r := c.targets
+	if r == nil {
+		return fmt.Errorf("no target restrictions loaded")
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !(r.addresses[ip.String()] || (r.network != nil && r.network.Contains(ip))) {
+		return fmt.Errorf("destination address %s isn't part of this pod", host)
+	}
+	if r.reserved[port] {
+		return fmt.Errorf("destination port %d is reserved by the gateway", port)
+	}
+	if len(r.ports) == 0 {
+		return nil
+	}
+	for x := range r.ports {
+		if port >= r.ports[x].from && port <= r.ports[x].to {
+			return nil
+		}
+	}
+	return fmt.Errorf("destination port %d isn't allowed", port)
+}
+
+// acceptDestination reads the original destination sent by the remote gateway, checks that it may be reached and
+// then dials it. The remote gateway is told why if the destination is refused.
+func (c *Config) acceptDestination(conn net.Conn, listener string, peer *Identity) (net.Conn, error) {
+	tmp := make([]byte, 256)
+	n, err := conn.Read(tmp)
+	if err != nil {
+		return nil, fmt.Errorf("reading destination: %v", err)
+	}
+	target := string(tmp[:n])
+
+	err = c.checkTarget(target)
+	if err != nil {
+		slog.Warn("destination refused", "remote", conn.RemoteAddr(), "peer", peer.String(), "target", target, "err", err)
+		connectionsRefused.WithLabelValues(listener, "target").Inc()
+		refuseDestination(conn, err.Error())
+		return nil, err
+	}
+
+	if !c.authorize(peer, conn.RemoteAddr(), target) {
+		connectionsRefused.WithLabelValues(listener, "policy").Inc()
+		refuseDestination(conn, "denied by policy")
+		return nil, fmt.Errorf("destination %s denied by policy", target)
+	}
+
+	release, err := c.acquireDestination(listener, conn.RemoteAddr(), target)
+	if err != nil {
+		refuseDestination(conn, err.Error())
+		return nil, err
+	}
+
+	// Check that the original destination address is reachable from the proxy
+	targetConn, err := net.DialTimeout("tcp", target, 5*time.Second)
+	if err != nil {
+		release()
+		refuseDestination(conn, "unable to reach target")
+		return nil, fmt.Errorf("connecting to destination %s: %v", target, err)
+	}
+	return &limitedConn{Conn: targetConn, release: release}, nil
+}
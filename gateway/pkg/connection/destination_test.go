@@ -0,0 +1,126 @@
+package connection
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParsePorts(t *testing.T) {
+	tests := []struct {
+		ports    string
+		expected []portRange
+		err      bool
+	}{
+		{"", nil, false},
+		{"80", []portRange{{80, 80}}, false},
+		{"80, 443,8000-8100", []portRange{{80, 80}, {443, 443}, {8000, 8100}}, false},
+		{"http", nil, true},
+		{"8100-8000", nil, true},
+		{"0", nil, true},
+		{"80-70000", nil, true},
+		{"80-", nil, true},
+	}
+	for _, test := range tests {
+		ranges, err := ParsePorts(test.ports)
+		if (err != nil) != test.err {
+			t.Errorf("%q: expected error %v, got %v", test.ports, test.err, err)
+			continue
+		}
+		if len(ranges) != len(test.expected) {
+			t.Errorf("%q: expected %v, got %v", test.ports, test.expected, ranges)
+			continue
+		}
+		for x := range ranges {
+			if ranges[x] != test.expected[x] {
+				t.Errorf("%q: expected %v, got %v", test.ports, test.expected, ranges)
+			}
+		}
+	}
+}
+
+func TestCheckTarget(t *testing.T) {
+	_, podCIDR, _ := net.ParseCIDR("10.244.0.0/16")
+	pod := &targetRestrictions{
+		addresses: map[string]bool{"10.244.1.5": true},
+		reserved:  map[int]bool{18000: true, 18443: true},
+	}
+	tunnel := &targetRestrictions{
+		addresses: map[string]bool{"192.168.1.10": true},
+		network:   podCIDR,
+		reserved:  map[int]bool{18000: true},
+	}
+	ports := &targetRestrictions{
+		addresses: map[string]bool{"10.244.1.5": true},
+		ports:     []portRange{{80, 80}, {8000, 8100}},
+		reserved:  map[int]bool{8080: true},
+	}
+
+	tests := []struct {
+		name    string
+		targets *targetRestrictions
+		target  string
+		allowed bool
+	}{
+		{"The pod's address", pod, "10.244.1.5:8080", true},
+		{"Another pod", pod, "10.244.1.6:8080", false},
+		{"The node", pod, "192.168.1.10:10250", false},
+		{"Loopback", pod, "127.0.0.1:8080", false},
+		{"Metadata service", pod, "169.254.169.254:80", false},
+		{"Reserved port", pod, "10.244.1.5:18443", false},
+		{"Hostname", pod, "localhost:8080", false},
+		{"No port", pod, "10.244.1.5", false},
+		{"Invalid port", pod, "10.244.1.5:http", false},
+		{"Tunnel to a pod in the PodCIDR", tunnel, "10.244.7.3:8080", true},
+		{"Tunnel to the node's own address", tunnel, "192.168.1.10:8080", true},
+		{"Tunnel to another node", tunnel, "192.168.1.11:10250", false},
+		{"Tunnel outside the PodCIDR", tunnel, "10.245.0.1:8080", false},
+		{"Tunnel to a reserved port", tunnel, "10.244.7.3:18000", false},
+		{"Allowed port", ports, "10.244.1.5:80", true},
+		{"Allowed port range", ports, "10.244.1.5:8050", true},
+		{"Port outside the ranges", ports, "10.244.1.5:443", false},
+		{"Reserved port inside a range", ports, "10.244.1.5:8080", false},
+		{"No restrictions loaded", nil, "10.244.1.5:8080", false},
+	}
+	for _, test := range tests {
+		c := &Config{targets: test.targets}
+		err := c.checkTarget(test.target)
+		if (err == nil) != test.allowed {
+			t.Errorf("%s: expected allowed %v, got %v", test.name, test.allowed, err)
+		}
+	}
+}
+
+func TestLoadTargetRestrictions(t *testing.T) {
+	c := &Config{AllowedPorts: "80,8000-8100", ProxyPort: 18000, ClusterPort: 18080, ClusterTLSPort: 18443, AdminPort: 18002}
+	err := c.LoadTargetRestrictions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.targets.addresses["127.0.0.1"] {
+		t.Error("expected loopback not to be one of the pod's addresses")
+	}
+	if c.targets.network != nil {
+		t.Error("expected no PodCIDR outside of tunnel mode")
+	}
+	for _, port := range []int{18000, 18080, 18443, 18002} {
+		if !c.targets.reserved[port] {
+			t.Errorf("expected port %d to be reserved", port)
+		}
+	}
+
+	c = &Config{Tunnel: true, PodCIDR: "10.244.0.0/16"}
+	err = c.LoadTargetRestrictions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.targets.network == nil || !c.targets.network.Contains(net.ParseIP("10.244.3.4")) {
+		t.Errorf("expected the PodCIDR to be reachable in tunnel mode, got %v", c.targets.network)
+	}
+
+	if (&Config{AllowedPorts: "http"}).LoadTargetRestrictions() == nil {
+		t.Error("expected an error for invalid allowed ports")
+	}
+	if (&Config{Tunnel: true, PodCIDR: "10.244.0.0"}).LoadTargetRestrictions() == nil {
+		t.Error("expected an error for an invalid PodCIDR")
+	}
+}
@@ -0,0 +1,75 @@
+package connection
+
+import (
+	"fmt"
+	"gateway/pkg/mesh"
+)
+
+// Reasons for not dialing a destination's gateway, taken from what discovery knows about it
+const (
+	peerNotMeshed    = "not_meshed"    // No gateway in front of the destination
+	peerNoTLS        = "no_tls"        // We encrypt but the destination's gateway has no TLS listener
+	peerMTLSRequired = "mtls_required" // The destination only accepts mTLS and we have no certificates
+	transportNone    = "none"
+	transportUnknown = "unknown" // Discovery is off or hasn't synced, the gateway is dialed blindly
+)
+
+// PeerTransport is the transport chosen for a peer, used in the debug output
+type PeerTransport struct {
+	mesh.Peer
+	Transport string `json:"transport"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// peerTransport chooses how destAddr is reached before anything is dialed. In tunnel mode we dial node
+// gateways rather than the destination's, so discovery doesn't apply
+func (c *Config) peerTransport(destAddr string) (transport, reason string) {
+	if c.Peers == nil || !c.Peers.Ready() || c.Tunnel {
+		return transportUnknown, ""
+	}
+	peer, ok := c.Peers.Lookup(destAddr)
+	if !ok {
+		return transportNone, peerNotMeshed
+	}
+	return c.transportFor(peer)
+}
+
+func (c *Config) transportFor(peer mesh.Peer) (transport, reason string) {
+	if c.Certificates != nil {
+		if !peer.Encrypt {
+			return transportNone, peerNoTLS
+		}
+		return "mtls", ""
+	}
+	if peer.MTLS == MTLSStrict {
+		return transportNone, peerMTLSRequired
+	}
+	return "plaintext", ""
+}
+
+// checkPeer decides up front whether to dial the destination's gateway, a non-empty reason means it shouldn't be
+func (c *Config) checkPeer(destAddr string) (reason string, err error) {
+	transport, reason := c.peerTransport(destAddr)
+	if transport != transportNone {
+		return "", nil
+	}
+	if reason == peerMTLSRequired {
+		// Never fall back around a gateway that requires mTLS
+		return reason, fmt.Errorf("destination %s only accepts mTLS and this gateway has no certificates", destAddr)
+	}
+	return reason, nil
+}
+
+// DescribePeers lists the discovered peers with the transport that would be used for each of them
+func (c *Config) DescribePeers() []PeerTransport {
+	if c.Peers == nil {
+		return nil
+	}
+	peers := c.Peers.List()
+	described := make([]PeerTransport, 0, len(peers))
+	for _, peer := range peers {
+		transport, reason := c.transportFor(peer)
+		described = append(described, PeerTransport{Peer: peer, Transport: transport, Reason: reason})
+	}
+	return described
+}
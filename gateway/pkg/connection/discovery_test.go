@@ -0,0 +1,97 @@
+package connection
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gateway/pkg/mesh"
+)
+
+func testPeers(t *testing.T) *mesh.Peers {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "peers.json")
+	err := os.WriteFile(path, []byte(`[
+		{"address": "10.244.1.5", "encrypt": true},
+		{"address": "10.244.1.6", "encrypt": true, "mtls": "strict"},
+		{"address": "10.244.1.7"},
+		{"address": "10.244.1.8", "mtls": "strict"}
+	]`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peers := mesh.NewPeers()
+	err = peers.LoadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return peers
+}
+
+func TestPeerTransport(t *testing.T) {
+	peers := testPeers(t)
+	tests := []struct {
+		name      string
+		config    *Config
+		dest      string
+		transport string
+		reason    string
+	}{
+		{"TLS peer", &Config{Peers: peers, Certificates: &Certs{}}, "10.244.1.5", "mtls", ""},
+		{"Strict TLS peer", &Config{Peers: peers, Certificates: &Certs{}}, "10.244.1.6", "mtls", ""},
+		{"Peer without TLS", &Config{Peers: peers, Certificates: &Certs{}}, "10.244.1.7", transportNone, peerNoTLS},
+		{"Not meshed", &Config{Peers: peers, Certificates: &Certs{}}, "10.244.1.9", transportNone, peerNotMeshed},
+		{"Plaintext to a TLS peer", &Config{Peers: peers}, "10.244.1.5", "plaintext", ""},
+		{"Plaintext to a strict peer", &Config{Peers: peers}, "10.244.1.6", transportNone, peerMTLSRequired},
+		{"Plaintext to a strict peer without TLS", &Config{Peers: peers}, "10.244.1.8", transportNone, peerMTLSRequired},
+		{"Plaintext peer", &Config{Peers: peers}, "10.244.1.7", "plaintext", ""},
+		{"Discovery off", &Config{}, "10.244.1.9", transportUnknown, ""},
+		{"Not synced", &Config{Peers: mesh.NewPeers()}, "10.244.1.9", transportUnknown, ""},
+		{"Tunnel", &Config{Peers: peers, Tunnel: true}, "10.244.1.9", transportUnknown, ""},
+	}
+	for _, test := range tests {
+		transport, reason := test.config.peerTransport(test.dest)
+		if transport != test.transport || reason != test.reason {
+			t.Errorf("%s: expected %s %q, got %s %q", test.name, test.transport, test.reason, transport, reason)
+		}
+	}
+}
+
+func TestCheckPeer(t *testing.T) {
+	peers := testPeers(t)
+	tests := []struct {
+		name   string
+		config *Config
+		dest   string
+		reason string
+		err    bool
+	}{
+		{"Meshed", &Config{Peers: peers}, "10.244.1.5", "", false},
+		{"Not meshed falls back", &Config{Peers: peers}, "10.244.1.9", peerNotMeshed, false},
+		{"No TLS falls back", &Config{Peers: peers, Certificates: &Certs{}}, "10.244.1.7", peerNoTLS, false},
+		{"Strict is never bypassed", &Config{Peers: peers, Fallback: FallbackDirect}, "10.244.1.6", peerMTLSRequired, true},
+		{"Discovery off", &Config{}, "10.244.1.9", "", false},
+	}
+	for _, test := range tests {
+		reason, err := test.config.checkPeer(test.dest)
+		if reason != test.reason || (err != nil) != test.err {
+			t.Errorf("%s: expected %q error %v, got %q %v", test.name, test.reason, test.err, reason, err)
+		}
+	}
+}
+
+func TestDescribePeers(t *testing.T) {
+	if peers := (&Config{}).DescribePeers(); peers != nil {
+		t.Errorf("expected no peers without discovery, got %+v", peers)
+	}
+	described := (&Config{Peers: testPeers(t)}).DescribePeers()
+	expected := []string{"plaintext", "none", "plaintext", "none"}
+	if len(described) != len(expected) {
+		t.Fatalf("expected %d peers, got %d", len(expected), len(described))
+	}
+	for x, peer := range described {
+		if peer.Transport != expected[x] {
+			t.Errorf("%s: expected %s, got %s", peer.Address, expected[x], peer.Transport)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package connection
+
+import (
+	"crypto/tls"
+	"gateway/pkg/egress"
+	"gateway/pkg/gateway"
+	"gateway/pkg/metrics"
+	"gateway/pkg/shaping"
+	"log/slog"
+	"net"
+	"time"
+)
+
+var egressConnections = metrics.NewCounterVec("kube_gateway_egress_connections_total", "Connections to external hosts from the egress rules", "host", "result")
+
+// egressProxy handles a connection to an external host from the egress rules. The application speaks plain
+// HTTP to the host's address, the gateway originates TLS to the provider and adds the rule's credential to every
+// request. Other protocols are refused, they can't carry the credential. When the host's HTTPS is intercepted the
+// application's TLS is decrypted instead
+func (c *Config) egressProxy(conn net.Conn, target *egress.Target, targetDestination string) {
+	if target.TLS {
+		dial := func() (net.Conn, error) { return net.DialTimeout("tcp", target.Address, 5*time.Second) }
+		_, handled := c.interceptProxy(conn, target.Address, dial, target.Header, target.Value)
+		if !handled {
+			slog.Warn("egress connection refused", "host", target.Host, "origin", targetDestination, "protocol", "not intercepted")
+			egressConnections.WithLabelValues(target.Host, "refused").Inc()
+		}
+		return
+	}
+	protocol := gateway.ProtocolHTTP1
+	app := conn
+	if c.SniffTimeout != 0 {
+		protocol, app = gateway.Sniff(conn, c.SniffTimeout)
+	}
+	var gatewayFunc func(net.Conn, net.Conn, *gateway.AITransaction) error
+	config := &tls.Config{ServerName: target.Host}
+	c.applyTLSProfile(config)
+	switch protocol {
+	case gateway.ProtocolHTTP1:
+		gatewayFunc = gateway.Http_gateway
+		config.NextProtos = []string{"http/1.1"}
+	case gateway.ProtocolHTTP2:
+		gatewayFunc = gateway.H2c_gateway
+		config.NextProtos = []string{"h2"}
+	default:
+		slog.Warn("egress connection refused", "host", target.Host, "origin", targetDestination, "protocol", protocol)
+		egressConnections.WithLabelValues(target.Host, "refused").Inc()
+		return
+	}
+
+	targetConn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", target.Address, config)
+	if err != nil {
+		slog.Error("egress connect", "host", target.Host, "address", target.Address, "err", err)
+		egressConnections.WithLabelValues(target.Host, "failed").Inc()
+		return
+	}
+	defer targetConn.Close()
+	egressConnections.WithLabelValues(target.Host, "connected").Inc()
+	slog.Info("egress connect", "host", target.Host, "origin", targetDestination, "protocol", protocol, "credential", target.Header != "")
+
+	upstream := &gateway.CredentialConn{Conn: targetConn, Header: target.Header, Value: target.Value}
+	err = gatewayFunc(c.Shaper.Conn(app, shaping.Egress, targetDestination), c.Shaper.Conn(upstream, shaping.Ingress, targetDestination), c.AITransaction)
+	if err != nil {
+		slog.Error("data write", "err", err)
+	}
+}
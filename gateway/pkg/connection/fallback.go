@@ -0,0 +1,100 @@
+package connection
+
+import (
+	"errors"
+	"fmt"
+	"gateway/pkg/metrics"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// Fallbacks when the destination pod doesn't have a gateway, set per pod with the kube-gateway.io/fallback annotation
+const (
+	FallbackFail   = "fail"   // Refuse the connection (fail closed)
+	FallbackDirect = "direct" // Connect to the original destination in plaintext
+	FallbackRetry  = "retry"  // Retry the destination's gateway before failing, it may not be ready yet
+)
+
+var fallbacks = metrics.NewCounterVec("kube_gateway_fallbacks_total", "Connections to destinations without a gateway", "fallback", "reason")
+
+func ValidateFallback(fallback string) error {
+	switch fallback {
+	case FallbackFail, FallbackDirect, FallbackRetry:
+		return nil
+	}
+	return fmt.Errorf("unknown fallback [%s], expected %s, %s or %s", fallback, FallbackFail, FallbackDirect, FallbackRetry)
+}
+
+// unmeshedCache remembers destinations whose gateway couldn't be reached, so that we don't wait for a dial
+// timeout on every connection to a pod that isn't meshed
+type unmeshedCache struct {
+	mu      sync.Mutex
+	entries map[string]time.Time // Destination -> expiry
+}
+
+func (u *unmeshedCache) has(destAddr string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	expiry, ok := u.entries[destAddr]
+	if ok && time.Now().After(expiry) {
+		delete(u.entries, destAddr)
+		return false
+	}
+	return ok
+}
+
+func (u *unmeshedCache) add(destAddr string, ttl time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.entries == nil {
+		u.entries = map[string]time.Time{}
+	}
+	u.entries[destAddr] = time.Now().Add(ttl)
+}
+
+// isDialError is true when nothing answered on the gateway port, failed handshakes and verification are never
+// a reason to fall back as a gateway is there
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// dialGatewayRetry dials the destination's gateway, retrying with a backoff when the fallback is retry
+func (c *Config) dialGatewayRetry(destAddr string) (net.Conn, string, error) {
+	attempts := 1
+	if c.Fallback == FallbackRetry {
+		attempts += c.FallbackRetries
+	}
+	backoff := 100 * time.Millisecond
+	var err error
+	for x := 0; x < attempts; x++ {
+		if x != 0 {
+			slog.Debug("retrying gateway", "destination", destAddr, "attempt", x+1, "err", err)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		var conn net.Conn
+		var transport string
+		conn, transport, err = c.dialGateway(destAddr)
+		if err == nil || !isDialError(err) {
+			return conn, transport, err
+		}
+	}
+	return nil, "", err
+}
+
+// fallback handles a destination without a gateway, reason is either dial_failed or cached
+func (c *Config) fallback(destAddr, targetDestination, reason string, err error) (net.Conn, string, error) {
+	fallbacks.WithLabelValues(c.Fallback, reason).Inc()
+	if c.Fallback != FallbackDirect {
+		return nil, "", fmt.Errorf("destination %s has no gateway (%s): %w", destAddr, reason, err)
+	}
+	slog.Warn("destination has no gateway, connecting directly", "target", targetDestination, "reason", reason)
+	targetConn, err := net.DialTimeout("tcp", targetDestination, 5*time.Second)
+	if err != nil {
+		return nil, "", fmt.Errorf("direct connect: %w", err)
+	}
+	return targetConn, "direct", nil
+}
@@ -0,0 +1,172 @@
+package connection
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// listen accepts (and drops) connections on a local port until the test ends
+func listen(t *testing.T, address string) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	return l
+}
+
+// closedPort returns a local port with nothing listening on it
+func closedPort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestValidateFallback(t *testing.T) {
+	for _, fallback := range []string{FallbackFail, FallbackDirect, FallbackRetry} {
+		if err := ValidateFallback(fallback); err != nil {
+			t.Errorf("%s: expected no error, got %v", fallback, err)
+		}
+	}
+	for _, fallback := range []string{"", "refuse", "Direct"} {
+		if ValidateFallback(fallback) == nil {
+			t.Errorf("%q: expected an error", fallback)
+		}
+	}
+}
+
+func TestIsDialError(t *testing.T) {
+	_, refused := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", closedPort(t)), time.Second)
+	tests := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{"Connection refused", refused, true},
+		{"Wrapped dial error", fmt.Errorf("Failed to connect to original destination: %w", refused), true},
+		{"Dial timeout", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("i/o timeout")}, true},
+		{"Read error", &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}, false},
+		{"Handshake", tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}, false},
+		{"Verification", errors.New("unexpected peer identity"), false},
+	}
+	for _, test := range tests {
+		if isDialError(test.err) != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, !test.expected)
+		}
+	}
+}
+
+func TestUnmeshedCache(t *testing.T) {
+	var u unmeshedCache
+	if u.has("10.244.1.5") {
+		t.Error("expected an empty cache")
+	}
+	u.add("10.244.1.5", time.Hour)
+	u.add("10.244.1.6", -time.Second) // Already expired
+	if !u.has("10.244.1.5") {
+		t.Error("expected the destination to be cached")
+	}
+	if u.has("10.244.1.6") {
+		t.Error("expected the expired destination not to be cached")
+	}
+	if _, ok := u.entries["10.244.1.6"]; ok {
+		t.Error("expected the expired destination to be removed")
+	}
+}
+
+func TestDialTransportFallback(t *testing.T) {
+	target := listen(t, "127.0.0.1:0").Addr().String()
+	tests := []struct {
+		name      string
+		fallback  string
+		transport string // Empty when the connection is refused
+	}{
+		{"Fail", FallbackFail, ""},
+		{"Direct", FallbackDirect, "direct"},
+		{"Retry", FallbackRetry, ""},
+	}
+	for _, test := range tests {
+		c := &Config{ClusterAddress: "127.0.0.1", ClusterPort: closedPort(t), Fallback: test.fallback, FallbackRetries: 1}
+		conn, transport, err := c.dialTransport("10.244.1.5", target)
+		if test.transport == "" {
+			if err == nil {
+				conn.Close()
+				t.Errorf("%s: expected the connection to be refused, got %s", test.name, transport)
+			}
+			continue
+		}
+		if err != nil || transport != test.transport {
+			t.Errorf("%s: expected %s, got %s (%v)", test.name, test.transport, transport, err)
+			continue
+		}
+		conn.Close()
+	}
+}
+
+func TestDialTransportRetry(t *testing.T) {
+	port := closedPort(t)
+	c := &Config{ClusterAddress: "127.0.0.1", ClusterPort: port, Fallback: FallbackRetry, FallbackRetries: 3}
+
+	// The gateway starts after the first attempt, within the backoff of the retries
+	started := make(chan struct{})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		listen(t, fmt.Sprintf("127.0.0.1:%d", port))
+		close(started)
+	}()
+	conn, transport, err := c.dialTransport("10.244.1.5", "127.0.0.1:1")
+	<-started
+	if err != nil || transport != "plaintext" {
+		t.Fatalf("expected the gateway to be reached on a retry, got %s (%v)", transport, err)
+	}
+	conn.Close()
+}
+
+func TestDialTransportCache(t *testing.T) {
+	port := closedPort(t)
+	target := listen(t, "127.0.0.1:0").Addr().String()
+	c := &Config{ClusterAddress: "127.0.0.1", ClusterPort: port, Fallback: FallbackDirect, FallbackCacheTTL: time.Hour}
+
+	conn, transport, err := c.dialTransport("10.244.1.5", target)
+	if err != nil || transport != "direct" {
+		t.Fatalf("expected a direct connection, got %s (%v)", transport, err)
+	}
+	conn.Close()
+	if !c.unmeshed.has("10.244.1.5") {
+		t.Fatal("expected the unreachable gateway to be cached")
+	}
+
+	// While cached the gateway isn't tried, even once it is listening
+	listen(t, fmt.Sprintf("127.0.0.1:%d", port))
+	conn, transport, err = c.dialTransport("10.244.1.5", target)
+	if err != nil || transport != "direct" {
+		t.Fatalf("expected the cached destination to connect directly, got %s (%v)", transport, err)
+	}
+	conn.Close()
+
+	// Once the entry expires the gateway is tried again
+	c.unmeshed.add("10.244.1.5", -time.Second)
+	conn, transport, err = c.dialTransport("10.244.1.5", target)
+	if err != nil || transport != "plaintext" {
+		t.Fatalf("expected the gateway once the cache expired, got %s (%v)", transport, err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,79 @@
+package connection
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Identity is the workload identity of a remote gateway, taken from the SPIFFE URI SAN that the watcher
+// adds to every certificate it issues (spiffe://<trust-domain>/ns/<namespace>/sa/<serviceaccount>)
+type Identity struct {
+	TrustDomain    string
+	Namespace      string
+	ServiceAccount string
+	Pod            string
+}
+
+// String returns the SPIFFE ID of the identity, a nil identity is a peer that didn't present a certificate
+func (i *Identity) String() string {
+	if i == nil {
+		return "unauthenticated"
+	}
+	return fmt.Sprintf("spiffe://%s/ns/%s/sa/%s", i.TrustDomain, i.Namespace, i.ServiceAccount)
+}
+
+// ParseSPIFFEID parses a URI of the form spiffe://<trust-domain>/ns/<namespace>/sa/<serviceaccount>
+func ParseSPIFFEID(u *url.URL) (*Identity, error) {
+	if u.Scheme != "spiffe" {
+		return nil, fmt.Errorf("unsupported identity scheme [%s]", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("identity [%s] has no trust domain", u.String())
+	}
+	parts := strings.Split(strings.TrimPrefix(u.Path, "/"), "/")
+	if len(parts) != 4 || parts[0] != "ns" || parts[2] != "sa" || parts[1] == "" || parts[3] == "" {
+		return nil, fmt.Errorf("identity [%s] is not in the form spiffe://<trust-domain>/ns/<namespace>/sa/<serviceaccount>", u.String())
+	}
+	return &Identity{
+		TrustDomain:    u.Host,
+		Namespace:      parts[1],
+		ServiceAccount: parts[3],
+	}, nil
+}
+
+// IdentityFromCertificates finds the SPIFFE identity in the leaf of a verified peer certificate chain
+func IdentityFromCertificates(certs []*x509.Certificate) (*Identity, error) {
+	if len(certs) == 0 {
+		return nil, nil // Peer didn't present a certificate
+	}
+	leaf := certs[0]
+	for x := range leaf.URIs {
+		if leaf.URIs[x].Scheme != "spiffe" {
+			continue
+		}
+		id, err := ParseSPIFFEID(leaf.URIs[x])
+		if err != nil {
+			return nil, err
+		}
+		// The watcher uses the pod name as the DNS name of the certificate
+		if len(leaf.DNSNames) != 0 {
+			id.Pod = leaf.DNSNames[0]
+		}
+		return id, nil
+	}
+	return nil, fmt.Errorf("certificate [%s] has no SPIFFE identity", leaf.Subject.CommonName)
+}
+
+// peerIdentity returns the identity of a peer, ensuring it belongs to our trust domain
+func (c *Config) peerIdentity(certs []*x509.Certificate) (*Identity, error) {
+	id, err := IdentityFromCertificates(certs)
+	if err != nil || id == nil {
+		return id, err
+	}
+	if c.TrustDomain != "" && id.TrustDomain != c.TrustDomain {
+		return nil, fmt.Errorf("identity [%s] is not part of trust domain [%s]", id, c.TrustDomain)
+	}
+	return id, nil
+}
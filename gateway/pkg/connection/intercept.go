@@ -0,0 +1,97 @@
+package connection
+
+import (
+	"crypto/tls"
+	"gateway/pkg/gateway"
+	"gateway/pkg/intercept"
+	"gateway/pkg/metrics"
+	"gateway/pkg/shaping"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// How long to wait for the ClientHello of a connection that may be intercepted, when sniffing is disabled
+const defaultHelloTimeout = 250 * time.Millisecond
+
+var intercepted = metrics.NewCounterVec("kube_gateway_intercepted_connections_total", "TLS connections from the application that the gateway decrypted", "result")
+
+// interceptProxy decrypts a TLS connection from the application whose server name is one of the intercepted hosts.
+// The application is given a certificate minted for that name, the decrypted traffic goes through the HTTP gateway
+// and is encrypted again over the connection from dial, verifying the upstream's certificate against the system
+// roots (or InterceptCAs) and never the mesh CA, as any workload can get a mesh certificate. In-cluster
+// destinations are dialed through the mesh transport, so the remote gateway still authorizes them. The header from
+// the egress rule (if any) is added to every request. Connections that aren't intercepted are returned to be
+// handled as they would be otherwise, along with false
+func (c *Config) interceptProxy(conn net.Conn, address string, dial func() (net.Conn, error), header, value string) (net.Conn, bool) {
+	timeout := c.SniffTimeout
+	if timeout == 0 {
+		timeout = defaultHelloTimeout
+	}
+	hello, app := intercept.PeekClientHello(conn, timeout)
+	if hello == nil || !c.Intercept.Matches(hello.ServerName) {
+		if hello != nil {
+			intercepted.WithLabelValues("passthrough").Inc()
+		}
+		return app, false
+	}
+
+	// The upstream chooses the application protocol from those the application offered, the gateway handles both
+	// HTTP/1.1 and HTTP/2
+	upstreamConfig := &tls.Config{ServerName: hello.ServerName, RootCAs: c.InterceptCAs}
+	c.applyTLSProfile(upstreamConfig)
+	for _, proto := range hello.SupportedProtos {
+		if proto == "h2" || proto == "http/1.1" {
+			upstreamConfig.NextProtos = append(upstreamConfig.NextProtos, proto)
+		}
+	}
+	rawConn, err := dial()
+	if err != nil {
+		slog.Error("intercept upstream", "server", hello.ServerName, "address", address, "err", err)
+		intercepted.WithLabelValues("upstream_failed").Inc()
+		return app, true
+	}
+	targetConn := tls.Client(rawConn, upstreamConfig)
+	defer targetConn.Close()
+	targetConn.SetDeadline(time.Now().Add(5 * time.Second))
+	err = targetConn.Handshake()
+	if err != nil {
+		slog.Error("intercept upstream", "server", hello.ServerName, "address", address, "err", err)
+		intercepted.WithLabelValues("upstream_failed").Inc()
+		return app, true
+	}
+	targetConn.SetDeadline(time.Time{})
+	negotiated := targetConn.ConnectionState().NegotiatedProtocol
+
+	appConfig := &tls.Config{GetCertificate: c.Intercept.GetCertificate}
+	c.applyTLSProfile(appConfig)
+	if negotiated != "" {
+		appConfig.NextProtos = []string{negotiated}
+	}
+	appConn := tls.Server(app, appConfig)
+	defer appConn.Close()
+	appConn.SetDeadline(time.Now().Add(5 * time.Second))
+	err = appConn.Handshake()
+	if err != nil {
+		slog.Error("intercept handshake", "server", hello.ServerName, "err", err)
+		intercepted.WithLabelValues("handshake_failed").Inc()
+		return app, true
+	}
+	appConn.SetDeadline(time.Time{})
+	intercepted.WithLabelValues("intercepted").Inc()
+	slog.Info("intercept", "server", hello.ServerName, "address", address, "protocol", negotiated)
+
+	gatewayFunc := gateway.Http_gateway
+	if negotiated == "h2" {
+		gatewayFunc = gateway.H2c_gateway
+	}
+	var upstream net.Conn = targetConn
+	if header != "" {
+		upstream = &gateway.CredentialConn{Conn: targetConn, Header: header, Value: value}
+	}
+	err = gatewayFunc(c.Shaper.Conn(appConn, shaping.Egress, address), c.Shaper.Conn(upstream, shaping.Ingress, address), c.AITransaction)
+	if err != nil {
+		slog.Error("data write", "err", err)
+	}
+	return app, true
+}
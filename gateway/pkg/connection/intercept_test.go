@@ -0,0 +1,89 @@
+package connection
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gateway/pkg/gateway"
+	"gateway/pkg/intercept"
+)
+
+// interceptGet sends a request through interceptProxy to an upstream presenting cert, the application trusts the
+// intercept CA. It returns the response body, or an error if the application's connection failed
+func interceptGet(t *testing.T, c *Config, interceptCA *testCA, cert tls.Certificate) (string, error) {
+	t.Helper()
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "upstream")
+	}))
+	upstream.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	keyDER, err := x509.MarshalECPrivateKey(interceptCA.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Intercept, err = intercept.New(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: interceptCA.cert.Raw}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		[]string{"api.openai.com"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.AITransaction = &gateway.AITransaction{}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		dial := func() (net.Conn, error) { return net.Dial("tcp", upstream.Listener.Addr().String()) }
+		app, _ := c.interceptProxy(server, "api.openai.com:443", dial, "", "")
+		app.Close()
+	}()
+
+	conn := tls.Client(client, &tls.Config{ServerName: "api.openai.com", RootCAs: interceptCA.pool})
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: api.openai.com\r\n\r\n")
+	if err != nil {
+		return "", err
+	}
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	return string(body), err
+}
+
+// TestInterceptUpstreamRoots checks that a mesh certificate can't stand in for an intercepted provider, pod names
+// are chosen by users so any workload could have a mesh certificate for api.openai.com
+func TestInterceptUpstreamRoots(t *testing.T) {
+	mesh := newTestCA(t)
+	interceptCA := newTestCA(t)
+	impostor := mesh.issue(t, "api.openai.com", "10.0.0.5", "spiffe://cluster.local/ns/default/sa/default")
+	meshPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: mesh.cert.Raw})
+
+	c := &Config{Certificates: &Certs{ca: meshPEM}}
+	if body, err := interceptGet(t, c, interceptCA, impostor); err == nil {
+		t.Fatalf("expected an upstream with a mesh certificate to be refused, got %q", body)
+	}
+
+	// A private CA is trusted when it is configured
+	c = &Config{Certificates: &Certs{ca: meshPEM}, InterceptCAs: mesh.pool}
+	body, err := interceptGet(t, c, interceptCA, impostor)
+	if err != nil {
+		t.Fatalf("expected the configured roots to be trusted, got %v", err)
+	}
+	if body != "upstream" {
+		t.Errorf("expected the upstream's response, got %q", body)
+	}
+}
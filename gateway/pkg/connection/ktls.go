@@ -0,0 +1,96 @@
+package connection
+
+import (
+	"bufio"
+	"fmt"
+	"gateway/pkg/metrics"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ktlsModule       = "/sys/module/tls"    // Present once the kernel tls module is loaded
+	ktlsStatFile     = "/proc/net/tls_stat" // Per network namespace kTLS counters
+	ktlsStatInterval = 15 * time.Second     // How often tls_stat is copied into the metrics
+)
+
+var (
+	ktlsOffload = metrics.NewCounterVec("kube_gateway_ktls_offload_total", "kTLS connections by whether the kernel took the TX and RX offload", "side", "tx", "rx")
+	ktlsStats   = metrics.NewGaugeVec("kube_gateway_ktls_stat", "Counters from /proc/net/tls_stat", "stat")
+)
+
+// CheckKTLS confirms that the kernel can offload TLS, the kTLS library silently falls back to userspace crypto
+// when it can't. The library has already attempted to load the tls module by the time this is called
+func (c *Config) CheckKTLS() error {
+	if !c.KTLS {
+		return nil
+	}
+	var err error
+	if _, statErr := os.Stat(ktlsModule); statErr != nil {
+		err = fmt.Errorf("kernel tls module isn't loaded (modprobe tls on the node)")
+	} else if _, statErr := os.Stat(ktlsStatFile); statErr != nil {
+		err = fmt.Errorf("kernel doesn't expose %s: %v", ktlsStatFile, statErr)
+	}
+	if err == nil {
+		slog.Info("kernel TLS available", "module", ktlsModule)
+		return nil
+	}
+	if c.KTLSStrict {
+		return fmt.Errorf("kTLS is unavailable: %v", err)
+	}
+	slog.Warn("kTLS is unavailable, encryption will be performed in userspace", "err", err)
+	return nil
+}
+
+// recordOffload checks whether the kernel took over encryption for a connection, side is either client or server
+func recordOffload(side string, remote string, tx, rx bool) {
+	ktlsOffload.WithLabelValues(side, strconv.FormatBool(tx), strconv.FormatBool(rx)).Inc()
+	if !tx || !rx {
+		slog.Warn("kTLS offload not engaged", "side", side, "remote", remote, "tx", tx, "rx", rx)
+	}
+}
+
+// WatchKTLSStats copies /proc/net/tls_stat into the metrics every ktlsStatInterval, blocking function
+func (c *Config) WatchKTLSStats() {
+	if !c.KTLS {
+		return
+	}
+	ticker := time.NewTicker(ktlsStatInterval)
+	defer ticker.Stop()
+	for ; ; <-ticker.C {
+		stats, err := readKTLSStats(ktlsStatFile)
+		if err != nil {
+			slog.Error("reading kTLS statistics", "file", ktlsStatFile, "err", err)
+			return // The file won't appear later, CheckKTLS has already warned about this
+		}
+		for name, value := range stats {
+			ktlsStats.WithLabelValues(name).Set(value)
+		}
+	}
+}
+
+// readKTLSStats parses lines of the form "TlsCurrTxSw    1"
+func readKTLSStats(path string) (map[string]float64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	stats := map[string]float64{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		value, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			continue
+		}
+		stats[fields[0]] = value
+	}
+	return stats, scanner.Err()
+}
@@ -0,0 +1,62 @@
+package connection
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadKTLSStats(t *testing.T) {
+	// An older kernel without TlsDecryptRetry and TlsRxNoPadViolation, a counter we don't know about yet and
+	// lines that can't be parsed
+	sample := `TlsCurrTxSw                     	4
+TlsCurrRxSw                     	4
+TlsCurrTxDevice                 	0
+TlsCurrRxDevice                 	0
+TlsTxSw                         	128
+TlsRxSw                         	127
+TlsTxDevice                     	0
+TlsRxDevice                     	0
+TlsDecryptError                 	1
+TlsRxDeviceResync               	0
+TlsTxRekeyOk                    	3
+
+TlsCurrTxSw
+TlsRxSw 127 extra
+TlsTxSw                         	n/a
+`
+	path := filepath.Join(t.TempDir(), "tls_stat")
+	err := os.WriteFile(path, []byte(sample), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := readKTLSStats(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]float64{
+		"TlsCurrTxSw":       4,
+		"TlsCurrRxSw":       4,
+		"TlsCurrTxDevice":   0,
+		"TlsCurrRxDevice":   0,
+		"TlsTxSw":           128,
+		"TlsRxSw":           127,
+		"TlsTxDevice":       0,
+		"TlsRxDevice":       0,
+		"TlsDecryptError":   1,
+		"TlsRxDeviceResync": 0,
+		"TlsTxRekeyOk":      3,
+	}
+	if !maps.Equal(stats, expected) {
+		t.Errorf("expected %v, got %v", expected, stats)
+	}
+	if _, ok := stats["TlsDecryptRetry"]; ok {
+		t.Error("expected a counter missing from the file not to be reported")
+	}
+
+	_, err = readKTLSStats(filepath.Join(t.TempDir(), "missing"))
+	if err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
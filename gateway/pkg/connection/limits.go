@@ -0,0 +1,61 @@
+package connection
+
+import (
+	"errors"
+	"gateway/pkg/limits"
+	"log/slog"
+	"net"
+)
+
+// serve starts a handler for an accepted connection once the global limit allows it, while queueing this
+// blocks the accept loop which pushes back on new connections
+func (c *Config) serve(listener string, conn net.Conn, handler func(net.Conn)) {
+	release, err := c.Limiter.AcquireGlobal(listener)
+	if err != nil {
+		c.limitTripped(listener, conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	go func() {
+		defer release()
+		handler(conn)
+	}()
+}
+
+// acquireDestination applies the per-destination limits
+func (c *Config) acquireDestination(listener string, remote net.Addr, target string) (func(), error) {
+	release, err := c.Limiter.AcquireDestination(listener, target)
+	if err != nil {
+		c.limitTripped(listener, remote, err)
+		return nil, err
+	}
+	return release, nil
+}
+
+func (c *Config) limitTripped(listener string, remote net.Addr, err error) {
+	limit := "unknown"
+	var limitErr *limits.LimitError
+	if errors.As(err, &limitErr) {
+		limit = limitErr.Limit
+	}
+	slog.Warn("connection limit", "listener", listener, "limit", limit, "remote", remote, "err", err)
+	connectionsRefused.WithLabelValues(listener, "limit").Inc()
+}
+
+// limitedConn releases its destination limits when it is closed
+type limitedConn struct {
+	net.Conn
+	release func()
+}
+
+func (l *limitedConn) Close() error {
+	l.release()
+	return l.Conn.Close()
+}
+
+func (l *limitedConn) CloseWrite() error {
+	if cw, ok := l.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
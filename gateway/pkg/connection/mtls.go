@@ -0,0 +1,60 @@
+package connection
+
+import (
+	"crypto/tls"
+	"fmt"
+	"gateway/pkg/metrics"
+)
+
+// Mutual TLS modes, set per pod with the kube-gateway.io/mtls annotation
+const (
+	MTLSDisabled   = "disabled"   // Client certificates aren't requested
+	MTLSPermissive = "permissive" // Client certificates are verified if given, plaintext peers are accepted
+	MTLSStrict     = "strict"     // Client certificates are required and the plaintext listener refuses connections
+)
+
+// Listener names used in logs and metrics
+const (
+	listenerInternal = "internal"
+	listenerExternal = "external"
+	listenerTLS      = "tls"
+	listenerKTLS     = "ktls"
+)
+
+var (
+	connectionsTotal   = metrics.NewCounterVec("kube_gateway_connections_total", "Connections handled by the gateway", "listener", "mtls_mode", "transport")
+	connectionsRefused = metrics.NewCounterVec("kube_gateway_connections_refused_total", "Connections refused by the gateway", "listener", "reason")
+	protocols          = metrics.NewCounterVec("kube_gateway_protocols_total", "Internal connections by sniffed protocol and the handler that served them", "protocol", "handler")
+)
+
+func ValidateMTLSMode(mode string) error {
+	switch mode {
+	case MTLSDisabled, MTLSPermissive, MTLSStrict:
+		return nil
+	}
+	return fmt.Errorf("unknown mTLS mode [%s], expected %s, %s or %s", mode, MTLSDisabled, MTLSPermissive, MTLSStrict)
+}
+
+// mtlsClientAuth returns how the TLS listeners treat client certificates
+func (c *Config) mtlsClientAuth() tls.ClientAuthType {
+	switch c.MTLSMode {
+	case MTLSDisabled:
+		return tls.NoClientCert
+	case MTLSStrict:
+		return tls.RequireAndVerifyClientCert
+	}
+	return tls.VerifyClientCertIfGiven
+}
+
+// countConnection records the mode a connection was handled with, the transport is mtls when the peer
+// presented a certificate, tls when it didn't and plaintext for the unencrypted listeners
+func (c *Config) countConnection(listener, transport string) {
+	connectionsTotal.WithLabelValues(listener, c.MTLSMode, transport).Inc()
+}
+
+func transportFor(peer *Identity) string {
+	if peer != nil {
+		return "mtls"
+	}
+	return "tls"
+}
@@ -0,0 +1,103 @@
+package connection
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// handshake connects a client to a gateway's TLS listener configured for the mTLS mode, returning the transport
+// the connection would be counted as, or the error the listener saw
+func handshake(t *testing.T, c *Config, server tls.Certificate, client *tls.Certificate, roots *testCA) (string, *Identity, error) {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	listener := tls.Server(serverConn, &tls.Config{
+		Certificates: []tls.Certificate{server},
+		ClientCAs:    roots.pool,
+		ClientAuth:   c.mtlsClientAuth(),
+	})
+	config := &tls.Config{RootCAs: roots.pool, ServerName: "backend-1"}
+	if client != nil {
+		config.Certificates = []tls.Certificate{*client}
+	}
+	go func() {
+		// The listener's verdict on the client certificate is only seen by the client once it reads
+		conn := tls.Client(clientConn, config)
+		if conn.Handshake() == nil {
+			conn.Read(make([]byte, 1))
+		}
+		clientConn.Close()
+	}()
+	serverConn.SetDeadline(time.Now().Add(5 * time.Second))
+	err := listener.Handshake()
+	if err != nil {
+		return "", nil, err
+	}
+	peer, err := c.peerIdentity(listener.ConnectionState().PeerCertificates)
+	if err != nil {
+		return "", nil, err
+	}
+	return transportFor(peer), peer, nil
+}
+
+func TestMTLSModes(t *testing.T) {
+	ca := newTestCA(t)
+	untrusted := newTestCA(t)
+	server := ca.issue(t, "backend-1", "10.0.0.2", "spiffe://cluster.local/ns/shop/sa/backend")
+	client := ca.issue(t, "frontend-1", "10.0.0.1", "spiffe://cluster.local/ns/shop/sa/frontend")
+	impostor := untrusted.issue(t, "frontend-1", "10.0.0.1", "spiffe://cluster.local/ns/shop/sa/frontend")
+
+	tests := []struct {
+		mode      string
+		client    *tls.Certificate
+		accepted  bool
+		transport string
+	}{
+		{MTLSDisabled, nil, true, "tls"},
+		{MTLSDisabled, &client, true, "tls"}, // Not asked for
+		{MTLSPermissive, nil, true, "tls"},
+		{MTLSPermissive, &client, true, "mtls"},
+		{MTLSPermissive, &impostor, false, ""},
+		{MTLSStrict, nil, false, ""},
+		{MTLSStrict, &client, true, "mtls"},
+		{MTLSStrict, &impostor, false, ""},
+	}
+	for _, test := range tests {
+		c := &Config{MTLSMode: test.mode, TrustDomain: "cluster.local"}
+		transport, peer, err := handshake(t, c, server, test.client, ca)
+		if (err == nil) != test.accepted || transport != test.transport {
+			t.Errorf("%s with client certificate %v: expected accepted %v over %q, got %q (%v)", test.mode, test.client != nil, test.accepted, test.transport, transport, err)
+		}
+		if transport == "mtls" && (peer.Namespace != "shop" || peer.ServiceAccount != "frontend" || peer.Pod != "frontend-1") {
+			t.Errorf("%s: expected the client's identity, got %+v", test.mode, peer)
+		}
+	}
+}
+
+func TestMTLSStrictRefusesPlaintext(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go (&Config{MTLSMode: MTLSStrict}).handleExternalConnection(server)
+
+	// Closed without the destination being read
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the plaintext connection to be closed, got %v", err)
+	}
+}
+
+func TestValidateMTLSMode(t *testing.T) {
+	for _, mode := range []string{MTLSDisabled, MTLSPermissive, MTLSStrict} {
+		if err := ValidateMTLSMode(mode); err != nil {
+			t.Errorf("%s: %v", mode, err)
+		}
+	}
+	if err := ValidateMTLSMode("optional"); err == nil {
+		t.Error("expected an unknown mode to be refused")
+	}
+}
@@ -0,0 +1,95 @@
+package connection
+
+import (
+	"crypto/tls"
+	"fmt"
+	"gateway/pkg/metrics"
+	"log/slog"
+	"strconv"
+)
+
+// TLS profiles, every listener and dialer (TLS and kTLS) uses the same profile
+const (
+	ProfileModern       = "modern"       // TLS 1.3 only, preferring the X25519MLKEM768 post-quantum hybrid key exchange
+	ProfileIntermediate = "intermediate" // TLS 1.2 and 1.3 with AEAD cipher suites
+	ProfileFIPS         = "fips"         // TLS 1.2 only, restricted to AES-GCM and NIST curves
+)
+
+// tlsProfile holds IANA identifiers so it can be applied to both crypto/tls and the kTLS library
+type tlsProfile struct {
+	minVersion   uint16
+	maxVersion   uint16   // 0 is the latest version
+	cipherSuites []uint16 // Only used by TLS 1.2, TLS 1.3 suites aren't configurable
+	curves       []uint16
+}
+
+var tlsProfiles = map[string]tlsProfile{
+	ProfileModern: {
+		minVersion: tls.VersionTLS13,
+		curves:     []uint16{uint16(tls.X25519MLKEM768), uint16(tls.X25519), uint16(tls.CurveP256)},
+	},
+	ProfileIntermediate: {
+		minVersion: tls.VersionTLS12,
+		cipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		},
+		curves: []uint16{uint16(tls.X25519MLKEM768), uint16(tls.X25519), uint16(tls.CurveP256), uint16(tls.CurveP384)},
+	},
+	// TLS 1.3 suites can't be restricted, so ChaCha20-Poly1305 could still be negotiated over it. The profile is
+	// held to TLS 1.2 where every suite is chosen here
+	ProfileFIPS: {
+		minVersion: tls.VersionTLS12,
+		maxVersion: tls.VersionTLS12,
+		cipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		},
+		curves: []uint16{uint16(tls.CurveP256), uint16(tls.CurveP384)},
+	},
+}
+
+var tlsHandshakes = metrics.NewCounterVec("kube_gateway_tls_handshakes_total", "Completed TLS handshakes by negotiated parameters", "profile", "side", "version", "cipher", "curve", "resumed")
+
+func ValidateTLSProfile(profile string) error {
+	if _, ok := tlsProfiles[profile]; !ok {
+		return fmt.Errorf("unknown TLS profile [%s], expected %s, %s or %s", profile, ProfileModern, ProfileIntermediate, ProfileFIPS)
+	}
+	return nil
+}
+
+func (c *Config) tlsProfile() tlsProfile {
+	p, ok := tlsProfiles[c.TLSProfile]
+	if !ok {
+		return tlsProfiles[ProfileIntermediate]
+	}
+	return p
+}
+
+// applyTLSProfile sets the profile on a crypto/tls configuration
+func (c *Config) applyTLSProfile(config *tls.Config) {
+	p := c.tlsProfile()
+	config.MinVersion = p.minVersion
+	config.MaxVersion = p.maxVersion
+	config.CipherSuites = p.cipherSuites
+	config.CurvePreferences = nil
+	for _, curve := range p.curves {
+		config.CurvePreferences = append(config.CurvePreferences, tls.CurveID(curve))
+	}
+}
+
+// recordHandshake logs and counts the negotiated parameters of a connection, side is either client or server.
+// Resumed handshakes are labelled so the resumption rate can be taken from the same metric
+func (c *Config) recordHandshake(side string, remote string, version, cipher, curve uint16, resumed bool) {
+	v := tls.VersionName(version)
+	cs := tls.CipherSuiteName(cipher)
+	cv := tls.CurveID(curve).String()
+	slog.Info("tls handshake", "side", side, "remote", remote, "profile", c.TLSProfile, "version", v, "cipher", cs, "curve", cv, "resumed", resumed)
+	tlsHandshakes.WithLabelValues(c.TLSProfile, side, v, cs, cv, strconv.FormatBool(resumed)).Inc()
+}
@@ -0,0 +1,109 @@
+package connection
+
+import (
+	"crypto/tls"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestTLSProfiles(t *testing.T) {
+	tests := []struct {
+		profile string
+		min     uint16
+		max     uint16
+		suites  []uint16
+		curves  []tls.CurveID
+	}{
+		{ProfileModern, tls.VersionTLS13, 0, nil, []tls.CurveID{tls.X25519MLKEM768, tls.X25519, tls.CurveP256}},
+		{ProfileIntermediate, tls.VersionTLS12, 0, []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256, tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		}, []tls.CurveID{tls.X25519MLKEM768, tls.X25519, tls.CurveP256, tls.CurveP384}},
+		{ProfileFIPS, tls.VersionTLS12, tls.VersionTLS12, []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		}, []tls.CurveID{tls.CurveP256, tls.CurveP384}},
+		{"", tls.VersionTLS12, 0, nil, nil}, // Unset falls back to intermediate
+	}
+	for _, test := range tests {
+		if test.profile != "" && ValidateTLSProfile(test.profile) != nil {
+			t.Errorf("%s: expected the profile to be valid", test.profile)
+		}
+		c := &Config{TLSProfile: test.profile}
+		config := &tls.Config{MaxVersion: tls.VersionTLS10}
+		c.applyTLSProfile(config)
+		if config.MinVersion != test.min || config.MaxVersion != test.max {
+			t.Errorf("%s: expected versions %x-%x, got %x-%x", test.profile, test.min, test.max, config.MinVersion, config.MaxVersion)
+		}
+		if test.profile == "" {
+			continue
+		}
+		if !slices.Equal(config.CipherSuites, test.suites) {
+			t.Errorf("%s: expected suites %v, got %v", test.profile, test.suites, config.CipherSuites)
+		}
+		if !slices.Equal(config.CurvePreferences, test.curves) {
+			t.Errorf("%s: expected curves %v, got %v", test.profile, test.curves, config.CurvePreferences)
+		}
+	}
+
+	for _, profile := range []string{"", "FIPS", "old", "tls13"} {
+		if ValidateTLSProfile(profile) == nil {
+			t.Errorf("%q: expected an unknown profile to be rejected", profile)
+		}
+	}
+}
+
+// TestTLSProfileFIPSHandshake checks what a fips gateway negotiates with a client that offers more
+func TestTLSProfileFIPSHandshake(t *testing.T) {
+	ca := newTestCA(t)
+	cert := ca.issue(t, "pod-01", "10.0.0.1", "spiffe://cluster.local/ns/default/sa/default")
+
+	tests := []struct {
+		name   string
+		client *tls.Config
+		suite  uint16 // 0 when the handshake should fail
+	}{
+		{"Default client", &tls.Config{}, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		{"TLS 1.3 only", &tls.Config{MinVersion: tls.VersionTLS13}, 0},
+		{"ChaCha20 only", &tls.Config{MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256}}, 0},
+		{"X25519 only", &tls.Config{CurvePreferences: []tls.CurveID{tls.X25519}}, 0},
+	}
+	for _, test := range tests {
+		server := &tls.Config{Certificates: []tls.Certificate{cert}}
+		(&Config{TLSProfile: ProfileFIPS}).applyTLSProfile(server)
+		test.client.RootCAs = ca.pool
+		test.client.ServerName = "pod-01"
+
+		clientConn, serverConn := net.Pipe()
+		done := make(chan error, 1)
+		go func() {
+			s := tls.Server(serverConn, server)
+			s.SetDeadline(time.Now().Add(5 * time.Second))
+			done <- s.Handshake()
+			serverConn.Close()
+		}()
+		client := tls.Client(clientConn, test.client)
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		err := client.Handshake()
+		clientConn.Close()
+		<-done
+
+		if test.suite == 0 {
+			if err == nil {
+				t.Errorf("%s: expected the handshake to fail, negotiated %s", test.name, tls.CipherSuiteName(client.ConnectionState().CipherSuite))
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: expected the handshake to succeed, got %v", test.name, err)
+			continue
+		}
+		state := client.ConnectionState()
+		if state.Version != tls.VersionTLS12 || state.CipherSuite != test.suite {
+			t.Errorf("%s: expected TLS 1.2 with %s, got %s with %s", test.name, tls.CipherSuiteName(test.suite), tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite))
+		}
+	}
+}
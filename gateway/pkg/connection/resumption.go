@@ -0,0 +1,125 @@
+package connection
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"log/slog"
+	"sync"
+	"time"
+
+	ktls "gitlab.com/go-extension/tls"
+)
+
+const (
+	sessionCacheSize = 1024 // Sessions cached per dialer library, one per remote gateway endpoint
+	ticketKeys       = 3    // Current key plus the previous keys that can still decrypt tickets
+)
+
+// sessionResumption holds the client session caches used when dialing other gateways, and the ticket keys
+// shared by the TLS listeners. Keys are rotated by RotateSessionTickets, tickets issued under one of the
+// previous keys are still accepted so rotating doesn't force every peer into a full handshake
+type sessionResumption struct {
+	cache  tls.ClientSessionCache
+	kcache ktls.ClientSessionCache
+
+	mu        sync.Mutex
+	keys      [][32]byte
+	listeners []func([][32]byte)
+}
+
+// LoadSessionResumption creates the session caches and the first ticket key, a rotation of 0 disables resumption
+func (c *Config) LoadSessionResumption() error {
+	if c.TicketRotation == 0 {
+		return nil
+	}
+	s := &sessionResumption{
+		cache:  tls.NewLRUClientSessionCache(sessionCacheSize),
+		kcache: ktls.NewLRUClientSessionCache(sessionCacheSize),
+	}
+	err := s.rotate()
+	if err != nil {
+		return err
+	}
+	c.sessions = s
+	return nil
+}
+
+// RotateSessionTickets replaces the ticket key on every TicketRotation, blocking function
+func (c *Config) RotateSessionTickets() {
+	if c.sessions == nil {
+		return
+	}
+	ticker := time.NewTicker(c.TicketRotation)
+	defer ticker.Stop()
+	for range ticker.C {
+		err := c.sessions.rotate()
+		if err != nil {
+			slog.Error("session ticket rotation", "err", err)
+			continue
+		}
+		slog.Info("session ticket keys rotated", "keys", ticketKeys, "interval", c.TicketRotation)
+	}
+}
+
+// rotate adds a new key in front of the existing ones and hands the keys to every listener
+func (s *sessionResumption) rotate() error {
+	var key [32]byte
+	_, err := rand.Read(key[:])
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = append([][32]byte{key}, s.keys...)
+	if len(s.keys) > ticketKeys {
+		s.keys = s.keys[:ticketKeys]
+	}
+	for x := range s.listeners {
+		s.listeners[x](s.keys)
+	}
+	return nil
+}
+
+// register adds a listener's SetSessionTicketKeys, setting the current keys straight away
+func (s *sessionResumption) register(set func([][32]byte)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listeners = append(s.listeners, set)
+	set(s.keys)
+}
+
+// tlsListenerResumption issues session tickets with the shared keys
+func (c *Config) tlsListenerResumption(config *tls.Config) {
+	if c.sessions == nil {
+		config.SessionTicketsDisabled = true
+		return
+	}
+	c.sessions.register(config.SetSessionTicketKeys)
+}
+
+// tlsDialerResumption resumes sessions with gateways that we've already connected to
+func (c *Config) tlsDialerResumption(config *tls.Config) {
+	if c.sessions == nil {
+		config.SessionTicketsDisabled = true
+		return
+	}
+	config.ClientSessionCache = c.sessions.cache
+}
+
+// ktlsListenerResumption issues session tickets with the shared keys
+func (c *Config) ktlsListenerResumption(config *ktls.Config) {
+	if c.sessions == nil {
+		config.SessionTicketsDisabled = true
+		return
+	}
+	c.sessions.register(config.SetSessionTicketKeys)
+}
+
+// ktlsDialerResumption resumes sessions with gateways that we've already connected to
+func (c *Config) ktlsDialerResumption(config *ktls.Config) {
+	if c.sessions == nil {
+		config.SessionTicketsDisabled = true
+		return
+	}
+	config.ClientSessionCache = c.sessions.kcache
+}
@@ -0,0 +1,94 @@
+package connection
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+)
+
+// resume connects a client to the listener and reports whether the session was resumed. The listener
+// writes a byte so that the client reads the session ticket sent after the handshake
+func resume(t *testing.T, server, client *tls.Config) bool {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	go func() {
+		listener := tls.Server(serverConn, server)
+		if listener.Handshake() == nil {
+			listener.Write([]byte{0})
+		}
+	}()
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn := tls.Client(clientConn, client)
+	_, err := conn.Read(make([]byte, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn.ConnectionState().DidResume
+}
+
+func TestSessionTicketRotation(t *testing.T) {
+	ca := newTestCA(t)
+	c := &Config{TicketRotation: time.Hour}
+	err := c.LoadSessionResumption()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &tls.Config{Certificates: []tls.Certificate{ca.issue(t, "backend-1", "10.0.0.2", "spiffe://cluster.local/ns/shop/sa/backend")}}
+	c.tlsListenerResumption(server)
+	client := &tls.Config{RootCAs: ca.pool, ServerName: "backend-1"}
+	c.tlsDialerResumption(client)
+	// A second client that only holds a ticket from the first key
+	stale := &tls.Config{RootCAs: ca.pool, ServerName: "backend-1", ClientSessionCache: tls.NewLRUClientSessionCache(1)}
+
+	if resume(t, server, client) {
+		t.Fatal("expected a full handshake without a ticket")
+	}
+	resume(t, server, stale)
+	if !resume(t, server, client) {
+		t.Fatal("expected the session to be resumed")
+	}
+
+	// The previous key still decrypts tickets, and the new ticket is encrypted with the new key
+	err = c.sessions.rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resume(t, server, client) {
+		t.Fatal("expected a ticket from the previous key to be accepted")
+	}
+
+	// Once the first key has been rotated out, only tickets from the later keys are accepted
+	for x := 0; x < ticketKeys-1; x++ {
+		err = c.sessions.rotate()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(c.sessions.keys) != ticketKeys {
+		t.Errorf("expected %d keys, got %d", ticketKeys, len(c.sessions.keys))
+	}
+	if !resume(t, server, client) {
+		t.Error("expected the ticket issued after the first rotation to be accepted")
+	}
+	if resume(t, server, stale) {
+		t.Error("expected a ticket from a key that was rotated out to be refused")
+	}
+}
+
+func TestSessionResumptionDisabled(t *testing.T) {
+	c := &Config{}
+	err := c.LoadSessionResumption()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, client := &tls.Config{}, &tls.Config{}
+	c.tlsListenerResumption(server)
+	c.tlsDialerResumption(client)
+	if !server.SessionTicketsDisabled || !client.SessionTicketsDisabled || client.ClientSessionCache != nil {
+		t.Error("expected session tickets to be disabled without a rotation")
+	}
+}
@@ -0,0 +1,21 @@
+package connection
+
+import (
+	"gateway/pkg/shaping"
+	"net"
+)
+
+// shapeExternal applies the bandwidth limits to a connection from another gateway, rules are matched on the
+// remote gateway's address and the port of the target in this pod
+func (c *Config) shapeExternal(targetConn, remoteConn net.Conn) (app, remote net.Conn) {
+	host, _, err := net.SplitHostPort(remoteConn.RemoteAddr().String())
+	if err != nil {
+		return targetConn, remoteConn
+	}
+	_, port, err := net.SplitHostPort(targetConn.RemoteAddr().String())
+	if err != nil {
+		return targetConn, remoteConn
+	}
+	addr := net.JoinHostPort(host, port)
+	return c.Shaper.Conn(targetConn, shaping.Egress, addr), c.Shaper.Conn(remoteConn, shaping.Ingress, addr)
+}
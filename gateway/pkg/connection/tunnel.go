@@ -0,0 +1,38 @@
+package connection
+
+import (
+	"fmt"
+	"gateway/pkg/metrics"
+	"log/slog"
+)
+
+// Tunnel fallbacks, used when a destination isn't in the routing table
+const (
+	TunnelFallbackDirect = "direct" // Connect to the gateway in the destination pod
+	TunnelFallbackRefuse = "refuse" // Refuse the connection
+)
+
+var tunnelRouteMisses = metrics.NewCounterVec("kube_gateway_tunnel_route_misses_total", "Tunnel destinations that weren't in the routing table", "fallback")
+
+func ValidateTunnelFallback(fallback string) error {
+	switch fallback {
+	case TunnelFallbackDirect, TunnelFallbackRefuse:
+		return nil
+	}
+	return fmt.Errorf("unknown tunnel fallback [%s], expected %s or %s", fallback, TunnelFallbackDirect, TunnelFallbackRefuse)
+}
+
+// TunnelRoute resolves the node gateway for a destination through the routing table, it is the ProxyFunc in tunnel mode
+func (c *Config) TunnelRoute(destAddr string) (string, error) {
+	if c.Routes != nil {
+		if address, ok := c.Routes.Lookup(destAddr); ok {
+			return address, nil
+		}
+	}
+	tunnelRouteMisses.WithLabelValues(c.TunnelFallback).Inc()
+	if c.TunnelFallback == TunnelFallbackRefuse {
+		return "", fmt.Errorf("no tunnel route to %s", destAddr)
+	}
+	slog.Warn("no tunnel route, connecting directly", "destination", destAddr)
+	return destAddr, nil
+}
@@ -0,0 +1,57 @@
+package connection
+
+import (
+	"testing"
+
+	"gateway/pkg/mesh"
+)
+
+func TestTunnelRoute(t *testing.T) {
+	routes := mesh.NewRoutes()
+	routes.SetPod("10.244.1.5", "172.18.0.3")
+	err := routes.SetNode("node-2", []string{"10.244.2.0/24"}, "172.18.0.4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		routes   *mesh.Routes
+		fallback string
+		dest     string
+		expected string // Empty when the destination is refused
+	}{
+		{"Pod", routes, TunnelFallbackRefuse, "10.244.1.5", "172.18.0.3"},
+		{"Node CIDR", routes, TunnelFallbackRefuse, "10.244.2.7", "172.18.0.4"},
+		{"No route, direct", routes, TunnelFallbackDirect, "10.244.9.1", "10.244.9.1"},
+		{"No route, refused", routes, TunnelFallbackRefuse, "10.244.9.1", ""},
+		{"No routing table, direct", nil, TunnelFallbackDirect, "10.244.1.5", "10.244.1.5"},
+		{"No routing table, refused", nil, TunnelFallbackRefuse, "10.244.1.5", ""},
+	}
+	for _, test := range tests {
+		c := &Config{Routes: test.routes, TunnelFallback: test.fallback}
+		address, err := c.TunnelRoute(test.dest)
+		if test.expected == "" {
+			if err == nil {
+				t.Errorf("%s: expected the destination to be refused, got %s", test.name, address)
+			}
+			continue
+		}
+		if err != nil || address != test.expected {
+			t.Errorf("%s: expected %s, got %s (%v)", test.name, test.expected, address, err)
+		}
+	}
+}
+
+func TestValidateTunnelFallback(t *testing.T) {
+	for _, fallback := range []string{TunnelFallbackDirect, TunnelFallbackRefuse} {
+		if err := ValidateTunnelFallback(fallback); err != nil {
+			t.Errorf("%s: expected no error, got %v", fallback, err)
+		}
+	}
+	for _, fallback := range []string{"", "drop", "Direct"} {
+		if ValidateTunnelFallback(fallback) == nil {
+			t.Errorf("%q: expected an error", fallback)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package connection
+
+import (
+	"crypto/x509"
+	"fmt"
+	"gateway/pkg/metrics"
+	"log/slog"
+)
+
+var verificationFailures = metrics.NewCounterVec("kube_gateway_peer_verification_failures_total", "Outbound gateway connections whose certificate didn't match the destination", "reason")
+
+// expectedGateway returns the address whose certificate we expect when connecting to the gateway in front of destAddr,
+// this is the destination pod itself unless we're tunneling through a node gateway
+func (c *Config) expectedGateway(destAddr string) (string, error) {
+	if c.Tunnel {
+		return c.ProxyFunc(destAddr)
+	}
+	return destAddr, nil
+}
+
+// verifyGateway replaces the standard verification on outbound gateway connections, the chain must be signed by the
+// cluster CA and the leaf must have been issued to the pod we intended to reach (and not just any meshed pod)
+func (c *Config) verifyGateway(roots *x509.CertPool, certs []*x509.Certificate, expected string) error {
+	if len(certs) == 0 {
+		verificationFailures.WithLabelValues("no_certificate").Inc()
+		return fmt.Errorf("remote gateway for %s presented no certificate", expected)
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	if err != nil {
+		verificationFailures.WithLabelValues("untrusted").Inc()
+		return fmt.Errorf("remote gateway for %s isn't trusted: %v", expected, err)
+	}
+
+	// VerifyHostname checks the IP SANs when given an IP address
+	err = certs[0].VerifyHostname(expected)
+	if err != nil {
+		verificationFailures.WithLabelValues("ip_mismatch").Inc()
+		id, _ := IdentityFromCertificates(certs)
+		slog.Warn("remote gateway mismatch", "expected", expected, "presented", certs[0].IPAddresses, "peer", id.String())
+		return fmt.Errorf("remote gateway certificate (ips %v, identity %s) wasn't issued to destination %s", certs[0].IPAddresses, id.String(), expected)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package connection
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA is a certificate authority like the watcher's, issuing gateway certificates with a SPIFFE identity
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue creates a certificate for a pod, usable by both the client and server side of a gateway connection
+func (ca *testCA) issue(t *testing.T, pod, ip, spiffe string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := url.Parse(spiffe)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: pod},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{pod},
+		IPAddresses:  []net.IP{net.ParseIP(ip)},
+		URIs:         []*url.URL{id},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestVerifyGateway(t *testing.T) {
+	ca := newTestCA(t)
+	other := newTestCA(t)
+	gateway := ca.issue(t, "backend-1", "10.0.0.2", "spiffe://cluster.local/ns/shop/sa/backend").Leaf
+	impostor := other.issue(t, "backend-1", "10.0.0.2", "spiffe://cluster.local/ns/shop/sa/backend").Leaf
+	c := &Config{}
+
+	tests := []struct {
+		name     string
+		certs    []*x509.Certificate
+		expected string
+		err      string
+	}{
+		{"accepted", []*x509.Certificate{gateway}, "10.0.0.2", ""},
+		{"no certificate", nil, "10.0.0.2", "presented no certificate"},
+		{"another CA", []*x509.Certificate{impostor}, "10.0.0.2", "isn't trusted"},
+		{"another pod", []*x509.Certificate{gateway}, "10.0.0.3", "wasn't issued to destination 10.0.0.3"},
+	}
+	for _, test := range tests {
+		err := c.verifyGateway(ca.pool, test.certs, test.expected)
+		if test.err == "" && err != nil || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestExpectedGateway(t *testing.T) {
+	c := &Config{ProxyFunc: func(string) (string, error) { return "192.168.0.10", nil }}
+	if expected, _ := c.expectedGateway("10.0.0.2"); expected != "10.0.0.2" {
+		t.Fatalf("expected the destination pod, got %s", expected)
+	}
+	// Tunneled connections are served by the gateway on the destination's node
+	c.Tunnel = true
+	if expected, _ := c.expectedGateway("10.0.0.2"); expected != "192.168.0.10" {
+		t.Fatalf("expected the node gateway, got %s", expected)
+	}
+}
@@ -0,0 +1,209 @@
+package egress
+
+import (
+	"context"
+	"fmt"
+	"gateway/pkg/metrics"
+	"gateway/pkg/policy"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cilium/ebpf"
+)
+
+// How often hosts are resolved again and secrets are re-read, so rotated credentials and moved providers are
+// picked up without a policy change
+const refreshInterval = 30 * time.Second
+
+var targetsGauge = metrics.NewGaugeVec("kube_gateway_egress_targets", "Addresses intercepted for each egress host", "host")
+
+// Target is an external host that the gateway connects to over TLS on behalf of the application
+type Target struct {
+	Host    string // Server name presented to the provider
+	Address string // Where the gateway connects to (host:tlsPort)
+	Header  string // Header set on every request, empty leaves requests unchanged
+	Value   string
+	TLS     bool // The application connects with TLS, which the gateway intercepts
+}
+
+// key matches struct Egress in mirrors.h, both fields are in host byte order
+type key struct {
+	Addr uint32
+	Port uint16
+	_    uint16
+}
+
+// Gateway keeps the intercepted addresses of the egress rules in step with DNS, and holds the credentials that
+// are injected into their requests
+type Gateway struct {
+	policies *policy.Store
+	bpf      *ebpf.Map // map_egress, nil if the eBPF objects predate egress rules
+
+	// Intercept is true for hosts whose TLS the gateway can decrypt, their TLS port is intercepted as well so the
+	// application can use https. Set before Run
+	Intercept func(host string) bool
+
+	lookup func(ctx context.Context, network, host string) ([]netip.Addr, error)
+
+	mu      sync.RWMutex
+	targets map[netip.AddrPort]*Target
+}
+
+func New(policies *policy.Store) *Gateway {
+	return &Gateway{policies: policies, lookup: net.DefaultResolver.LookupNetIP, targets: map[netip.AddrPort]*Target{}}
+}
+
+// SetMap sets the eBPF map that redirects connections to the intercepted addresses
+func (g *Gateway) SetMap(m *ebpf.Map) {
+	g.bpf = m
+}
+
+// Lookup returns the target for an original destination (ip:port), or nil if it isn't intercepted
+func (g *Gateway) Lookup(dest string) *Target {
+	if g == nil {
+		return nil
+	}
+	addrPort, err := netip.ParseAddrPort(dest)
+	if err != nil {
+		return nil
+	}
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.targets[addrPort]
+}
+
+// Run resolves the egress rules whenever the policy changes and on every refresh, secrets reads a Secret from
+// the pod's namespace. This is a blocking function
+func (g *Gateway) Run(ctx context.Context, secrets func(name string) (map[string][]byte, error)) {
+	generation := g.policies.Generation()
+	g.refresh(ctx, secrets)
+	refresh := time.NewTicker(refreshInterval)
+	defer refresh.Stop()
+	poll := time.NewTicker(time.Second)
+	defer poll.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-poll.C:
+			if gen := g.policies.Generation(); gen != generation {
+				generation = gen
+				g.refresh(ctx, secrets)
+			}
+		case <-refresh.C:
+			g.refresh(ctx, secrets)
+		}
+	}
+}
+
+// refresh builds the targets from the active policy, a host that can't be resolved or whose secret can't be
+// read keeps its previous addresses so a transient failure doesn't expose the application to the provider
+// without its credential
+func (g *Gateway) refresh(ctx context.Context, secrets func(name string) (map[string][]byte, error)) {
+	rules := g.policies.Load().Egress
+	g.mu.RLock()
+	previous := g.targets
+	g.mu.RUnlock()
+
+	targets := map[netip.AddrPort]*Target{}
+	for _, rule := range rules {
+		target := &Target{
+			Host:    rule.Host,
+			Address: net.JoinHostPort(rule.Host, fmt.Sprint(rule.TLSPort)),
+		}
+		addrs, err := g.lookup(ctx, "ip4", rule.Host)
+		if err == nil && rule.Secret != "" {
+			target.Header, target.Value, err = credential(rule, secrets)
+		}
+		if err != nil {
+			slog.Error("egress rule", "host", rule.Host, "err", err)
+			for addrPort, t := range previous {
+				if t.Host == rule.Host {
+					targets[addrPort] = t
+				}
+			}
+			continue
+		}
+		var tlsTarget *Target
+		if g.Intercept != nil && g.Intercept(rule.Host) {
+			tlsTarget = &Target{Host: target.Host, Address: target.Address, Header: target.Header, Value: target.Value, TLS: true}
+		}
+		for _, addr := range addrs {
+			targets[netip.AddrPortFrom(addr.Unmap(), uint16(rule.Port))] = target
+			if tlsTarget != nil {
+				targets[netip.AddrPortFrom(addr.Unmap(), uint16(rule.TLSPort))] = tlsTarget
+			}
+		}
+	}
+
+	g.mu.Lock()
+	g.targets = targets
+	g.mu.Unlock()
+	g.sync(previous, targets)
+
+	// Hosts that were removed or lost their addresses are reported as 0
+	counts := map[string]int{}
+	for _, t := range previous {
+		counts[t.Host] = 0
+	}
+	for _, rule := range rules {
+		counts[rule.Host] = 0
+	}
+	for _, t := range targets {
+		counts[t.Host]++
+	}
+	for host, count := range counts {
+		targetsGauge.WithLabelValues(host).Set(float64(count))
+	}
+}
+
+// credential reads the value of a rule's header from its secret
+func credential(rule policy.EgressRule, secrets func(name string) (map[string][]byte, error)) (string, string, error) {
+	if secrets == nil {
+		return "", "", fmt.Errorf("secrets are unavailable outside of a cluster")
+	}
+	data, err := secrets(rule.Secret)
+	if err != nil {
+		return "", "", fmt.Errorf("reading secret [%s]: %v", rule.Secret, err)
+	}
+	value, ok := data[rule.SecretKey]
+	if !ok {
+		return "", "", fmt.Errorf("secret [%s] has no key [%s]", rule.Secret, rule.SecretKey)
+	}
+	return rule.Header, rule.Prefix + strings.TrimSpace(string(value)), nil
+}
+
+// sync updates the eBPF map so that connections to the intercepted addresses are redirected to the proxy
+func (g *Gateway) sync(previous, targets map[netip.AddrPort]*Target) {
+	if g.bpf == nil {
+		return
+	}
+	for addrPort := range previous {
+		if _, ok := targets[addrPort]; !ok {
+			k := toKey(addrPort)
+			err := g.bpf.Delete(&k)
+			if err != nil {
+				slog.Error("removing egress address", "address", addrPort, "err", err)
+			}
+		}
+	}
+	for addrPort := range targets {
+		k := toKey(addrPort)
+		err := g.bpf.Update(&k, uint8(1), ebpf.UpdateAny)
+		if err != nil {
+			slog.Error("adding egress address", "address", addrPort, "err", err)
+		}
+	}
+}
+
+func toKey(addrPort netip.AddrPort) key {
+	ip := addrPort.Addr().As4()
+	return key{
+		Addr: uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3]),
+		Port: addrPort.Port(),
+	}
+}
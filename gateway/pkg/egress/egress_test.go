@@ -0,0 +1,204 @@
+package egress
+
+import (
+	"context"
+	"fmt"
+	"gateway/pkg/policy"
+	"net/netip"
+	"testing"
+)
+
+// testGateway is a gateway with a fake resolver and secrets, both can be changed between refreshes
+type testGateway struct {
+	*Gateway
+	store   *policy.Store
+	hosts   map[string][]string
+	secrets map[string]map[string][]byte
+}
+
+func newTestGateway(t *testing.T, config string) *testGateway {
+	t.Helper()
+	g := &testGateway{
+		store:   &policy.Store{},
+		hosts:   map[string][]string{},
+		secrets: map[string]map[string][]byte{},
+	}
+	g.setPolicy(t, config)
+	g.Gateway = New(g.store)
+	g.lookup = func(ctx context.Context, network, host string) ([]netip.Addr, error) {
+		addrs, ok := g.hosts[host]
+		if !ok {
+			return nil, fmt.Errorf("no such host")
+		}
+		var result []netip.Addr
+		for _, addr := range addrs {
+			result = append(result, netip.MustParseAddr(addr))
+		}
+		return result, nil
+	}
+	return g
+}
+
+func (g *testGateway) setPolicy(t *testing.T, config string) {
+	t.Helper()
+	err := g.store.Update([]byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (g *testGateway) refresh() {
+	g.Gateway.refresh(context.Background(), func(name string) (map[string][]byte, error) {
+		data, ok := g.secrets[name]
+		if !ok {
+			return nil, fmt.Errorf("not found")
+		}
+		return data, nil
+	})
+}
+
+func TestRefresh(t *testing.T) {
+	g := newTestGateway(t, `{"egress":[{"host":"api.openai.com","secret":"openai"},{"host":"api.anthropic.com","port":8080,"secret":"anthropic","secretKey":"key","header":"x-api-key"},{"host":"example.com"}]}`)
+	g.hosts["api.openai.com"] = []string{"10.0.0.1", "10.0.0.2"}
+	g.hosts["api.anthropic.com"] = []string{"10.0.1.1"}
+	g.hosts["example.com"] = []string{"10.0.2.1"}
+	g.secrets["openai"] = map[string][]byte{"token": []byte("sk-openai\n")}
+	g.secrets["anthropic"] = map[string][]byte{"key": []byte("sk-anthropic")}
+	g.refresh()
+
+	tests := []struct {
+		dest     string
+		expected *Target
+	}{
+		{"10.0.0.1:80", &Target{Host: "api.openai.com", Address: "api.openai.com:443", Header: "Authorization", Value: "Bearer sk-openai"}},
+		{"10.0.0.2:80", &Target{Host: "api.openai.com", Address: "api.openai.com:443", Header: "Authorization", Value: "Bearer sk-openai"}},
+		{"10.0.1.1:8080", &Target{Host: "api.anthropic.com", Address: "api.anthropic.com:443", Header: "X-Api-Key", Value: "sk-anthropic"}},
+		{"10.0.2.1:80", &Target{Host: "example.com", Address: "example.com:443"}},
+		{"10.0.0.1:443", nil},
+		{"10.0.1.1:80", nil},
+		{"10.0.3.1:80", nil},
+		{"api.openai.com:80", nil},
+	}
+	for _, test := range tests {
+		got := g.Lookup(test.dest)
+		if (got == nil) != (test.expected == nil) || (got != nil && *got != *test.expected) {
+			t.Errorf("%s: expected %+v, got %+v", test.dest, test.expected, got)
+		}
+	}
+}
+
+func TestRefreshIntercept(t *testing.T) {
+	g := newTestGateway(t, `{"egress":[{"host":"api.openai.com","secret":"openai"},{"host":"example.com"}]}`)
+	g.hosts["api.openai.com"] = []string{"10.0.0.1"}
+	g.hosts["example.com"] = []string{"10.0.2.1"}
+	g.secrets["openai"] = map[string][]byte{"token": []byte("sk-openai")}
+	g.Intercept = func(host string) bool {
+		return host == "api.openai.com"
+	}
+	g.refresh()
+
+	plain := g.Lookup("10.0.0.1:80")
+	intercepted := g.Lookup("10.0.0.1:443")
+	if plain == nil || plain.TLS {
+		t.Fatalf("expected the plain port to be intercepted without TLS, got %+v", plain)
+	}
+	if intercepted == nil || !intercepted.TLS || intercepted.Value != "Bearer sk-openai" {
+		t.Fatalf("expected the TLS port to be intercepted with the credential, got %+v", intercepted)
+	}
+	if g.Lookup("10.0.2.1:443") != nil {
+		t.Error("expected the TLS port of a host that can't be intercepted to be left alone")
+	}
+}
+
+func TestRefreshDNS(t *testing.T) {
+	g := newTestGateway(t, `{"egress":[{"host":"api.openai.com"}]}`)
+	g.hosts["api.openai.com"] = []string{"10.0.0.1"}
+	g.refresh()
+
+	// Addresses follow DNS
+	g.hosts["api.openai.com"] = []string{"10.0.0.2"}
+	g.refresh()
+	if g.Lookup("10.0.0.1:80") != nil || g.Lookup("10.0.0.2:80") == nil {
+		t.Fatal("expected the new address to replace the old one")
+	}
+
+	// A failed lookup keeps the previous addresses
+	delete(g.hosts, "api.openai.com")
+	g.refresh()
+	if g.Lookup("10.0.0.2:80") == nil {
+		t.Fatal("expected the previous address to be kept when the host can't be resolved")
+	}
+
+	// As does a policy change while the lookup is failing, but a removed rule drops its addresses
+	g.setPolicy(t, `{"egress":[{"host":"api.openai.com"},{"host":"example.com"}]}`)
+	g.hosts["example.com"] = []string{"10.0.2.1"}
+	g.refresh()
+	if g.Lookup("10.0.0.2:80") == nil || g.Lookup("10.0.2.1:80") == nil {
+		t.Fatal("expected both hosts to be intercepted")
+	}
+	g.setPolicy(t, `{"egress":[{"host":"example.com"}]}`)
+	g.refresh()
+	if g.Lookup("10.0.0.2:80") != nil || g.Lookup("10.0.2.1:80") == nil {
+		t.Fatal("expected only the remaining rule to be intercepted")
+	}
+}
+
+func TestRefreshSecrets(t *testing.T) {
+	g := newTestGateway(t, `{"egress":[{"host":"api.openai.com","secret":"openai"}]}`)
+	g.hosts["api.openai.com"] = []string{"10.0.0.1"}
+
+	// A host isn't intercepted until its credential can be read
+	g.refresh()
+	if target := g.Lookup("10.0.0.1:80"); target != nil {
+		t.Fatalf("expected no target without the secret, got %+v", target)
+	}
+	g.secrets["openai"] = map[string][]byte{"other": []byte("sk-openai")}
+	g.refresh()
+	if target := g.Lookup("10.0.0.1:80"); target != nil {
+		t.Fatalf("expected no target without the secret's key, got %+v", target)
+	}
+
+	g.secrets["openai"] = map[string][]byte{"token": []byte("sk-openai")}
+	g.refresh()
+	if target := g.Lookup("10.0.0.1:80"); target == nil || target.Value != "Bearer sk-openai" {
+		t.Fatalf("expected the credential, got %+v", target)
+	}
+
+	// A rotated secret is picked up
+	g.secrets["openai"] = map[string][]byte{"token": []byte("sk-rotated")}
+	g.refresh()
+	if target := g.Lookup("10.0.0.1:80"); target == nil || target.Value != "Bearer sk-rotated" {
+		t.Fatalf("expected the rotated credential, got %+v", target)
+	}
+
+	// And the previous credential is kept if the secret goes missing
+	delete(g.secrets, "openai")
+	g.refresh()
+	if target := g.Lookup("10.0.0.1:80"); target == nil || target.Value != "Bearer sk-rotated" {
+		t.Fatalf("expected the previous credential to be kept, got %+v", target)
+	}
+}
+
+func TestCredential(t *testing.T) {
+	rule := policy.EgressRule{Host: "api.openai.com", Secret: "openai", SecretKey: "token", Header: "Authorization", Prefix: "Bearer "}
+	_, _, err := credential(rule, nil)
+	if err == nil {
+		t.Error("expected an error without access to secrets")
+	}
+	header, value, err := credential(rule, func(name string) (map[string][]byte, error) {
+		return map[string][]byte{"token": []byte("  sk-openai\n")}, nil
+	})
+	if err != nil || header != "Authorization" || value != "Bearer sk-openai" {
+		t.Errorf("expected the trimmed credential, got %s: %s (%v)", header, value, err)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	var g *Gateway
+	if g.Lookup("10.0.0.1:80") != nil {
+		t.Error("expected a nil gateway to intercept nothing")
+	}
+	if toKey(netip.MustParseAddrPort("10.1.2.3:443")) != (key{Addr: 0x0a010203, Port: 443}) {
+		t.Error("expected the key in host byte order")
+	}
+}
@@ -0,0 +1,55 @@
+package gateway
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"gateway/pkg/accesslog"
+)
+
+// countingBody counts the bytes read from a body, it is read and logged from different goroutines
+type countingBody struct {
+	io.ReadCloser
+	n atomic.Int64
+}
+
+func (c *countingBody) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// countBody wraps a body so its size can be logged, empty bodies are left alone so they are still recognised
+func countBody(body io.ReadCloser) (io.ReadCloser, *countingBody) {
+	counter := &countingBody{}
+	if body == nil || body == http.NoBody {
+		return body, counter
+	}
+	counter.ReadCloser = body
+	return counter, counter
+}
+
+// accessLog logs a request once its response has been sent to the application
+func (h *httpRelay) accessLog(p *pendingRequest, res *http.Response, sent *countingBody, upstream time.Duration, decision string) {
+	if !h.c.AccessLog.Enabled() {
+		return
+	}
+	h.c.AccessLog.Log(&accesslog.Entry{
+		Time:          p.start,
+		Protocol:      p.req.Proto,
+		Client:        h.ingress.RemoteAddr().String(),
+		Destination:   h.egress.RemoteAddr().String(),
+		Peer:          h.peer,
+		Method:        p.req.Method,
+		Host:          p.req.Host,
+		Path:          p.req.URL.RequestURI(),
+		Status:        res.StatusCode,
+		RequestBytes:  p.received.n.Load(),
+		ResponseBytes: sent.n.Load(),
+		Upstream:      upstream,
+		Duration:      time.Since(p.start),
+		Decision:      decision,
+	})
+}
@@ -0,0 +1,73 @@
+package gateway
+
+import "net"
+
+// PeerConn is a connection to another gateway, Peer is the identity that the gateway presented
+type PeerConn struct {
+	net.Conn
+	Peer string
+}
+
+// NetConn returns the connection to the gateway
+func (p *PeerConn) NetConn() net.Conn {
+	return p.Conn
+}
+
+func (p *PeerConn) CloseWrite() error {
+	if cw, ok := p.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// CredentialConn is a connection to an external provider, Header is set to Value on every request sent over it
+// so the application never holds the provider's credential
+type CredentialConn struct {
+	net.Conn
+	Header string
+	Value  string
+}
+
+// NetConn returns the connection to the provider
+func (c *CredentialConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *CredentialConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// unwrap finds a connection of type T through any wrapping connections
+func unwrap[T net.Conn](conn net.Conn) (T, bool) {
+	for conn != nil {
+		if t, ok := conn.(T); ok {
+			return t, true
+		}
+		wrapped, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		conn = wrapped.NetConn()
+	}
+	var zero T
+	return zero, false
+}
+
+// peerOf finds the identity of the gateway at the other end of a connection
+func peerOf(conn net.Conn) string {
+	if p, ok := unwrap[*PeerConn](conn); ok {
+		return p.Peer
+	}
+	return ""
+}
+
+// credentialOf finds the header to inject into requests sent over a connection, the header is empty if none
+func credentialOf(conn net.Conn) (header, value string) {
+	if c, ok := unwrap[*CredentialConn](conn); ok {
+		return c.Header, c.Value
+	}
+	return "", ""
+}
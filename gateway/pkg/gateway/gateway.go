@@ -1,34 +1,64 @@
 package gateway
 
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"gateway/pkg/accesslog"
+)
+
+// What happens to chat requests that ask for more tokens than maxTokens
+const (
+	MaxTokensClamp  = "clamp"  // Lower the request's limit to maxTokens
+	MaxTokensReject = "reject" // Answer with an error, the request isn't sent
+)
+
 type endpointToken struct {
 	endpoint string
 	model    string
 }
 
 type AITransaction struct {
-	TokenCount map[endpointToken]bool
-	Request    *Request  `json:"request,omitempty"`
-	Response   *Response `json:"response,omitempty"`
+	TokenCount tokenUsage        `json:"-"` // Tokens used so far, kept across policy reloads
+	AccessLog  *accesslog.Logger `json:"-"` // Set at start up, not part of the policy
+	Request    *Request          `json:"request,omitempty"`
+	Response   *Response         `json:"response,omitempty"`
+	WebSocket  *WebSocket        `json:"websocket,omitempty"`
+}
+
+type WebSocket struct {
+	Debug bool `json:"debug,omitempty"` // Log the metadata of every frame (not the payload)
 }
 
 type Response struct {
-	Debug       bool     `json:"debug,omitempty"`
-	BannedWords []string `json:"bannedWords,omitempty"`
+	Debug        bool     `json:"debug,omitempty"`
+	BannedWords  []string `json:"bannedWords,omitempty"`
+	StreamAction string   `json:"streamAction,omitempty"` // terminate (default) or mask, for streamed responses
 }
 
 type Request struct {
 	MaxTokens         string         `json:"maxTokens,omitempty"`
+	MaxTokensMode     string         `json:"maxTokensMode,omitempty"` // clamp (default) or reject
+	Quota             *Quota         `json:"quota,omitempty"`
 	ModelReplace      []ModelReplace `json:"modelReplace,omitempty"`
 	UserPromptReplace []PromtReplace `json:"userPromptReplace,omitempty"`
 	DevPromptReplace  []PromtReplace `json:"devPromptReplace,omitempty"`
 	Block             bool           `json:"block,omitempty"`
 	Debug             bool           `json:"debug,omitempty"`
+
+	maxTokens int64 // Parsed from MaxTokens, 0 is unlimited
 }
 
 type PromtReplace struct {
 	Orig          string `json:"orig,omitempty"`
 	New           string `json:"new,omitempty"`
 	CaseSensitive bool   `json:"caseSensitive,omitempty"`
+	Regex         bool   `json:"regex,omitempty"`     // Orig is a regular expression, New can use its capture groups
+	WholeWord     bool   `json:"wholeWord,omitempty"` // Only match at word boundaries
+
+	re *regexp.Regexp // Compiled from the fields above when the policy is loaded
 }
 
 type ModelReplace struct {
@@ -36,9 +66,74 @@ type ModelReplace struct {
 	New  string `json:"new,omitempty"`
 }
 
+// Load replaces the policies with those in the configmap, they are only replaced if they are valid
+func (c *AITransaction) Load(data []byte) error {
+	var t AITransaction
+	err := json.Unmarshal(data, &t)
+	if err != nil {
+		return err
+	}
+	if t.Request != nil {
+		err = t.Request.validate()
+		if err != nil {
+			return fmt.Errorf("request: %v", err)
+		}
+	}
+	c.Request = t.Request
+	c.Response = t.Response
+	c.WebSocket = t.WebSocket
+	return nil
+}
+
+func (r *Request) validate() error {
+	if r.MaxTokens != "" {
+		n, err := strconv.ParseInt(r.MaxTokens, 10, 64)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("maxTokens [%s] should be a positive number", r.MaxTokens)
+		}
+		r.maxTokens = n
+	}
+	switch r.MaxTokensMode {
+	case "":
+		r.MaxTokensMode = MaxTokensClamp
+	case MaxTokensClamp, MaxTokensReject:
+	default:
+		return fmt.Errorf("unknown maxTokensMode [%s], expected %s or %s", r.MaxTokensMode, MaxTokensClamp, MaxTokensReject)
+	}
+	for x := range r.UserPromptReplace {
+		err := r.UserPromptReplace[x].compile()
+		if err != nil {
+			return fmt.Errorf("userPromptReplace: %v", err)
+		}
+	}
+	for x := range r.DevPromptReplace {
+		err := r.DevPromptReplace[x].compile()
+		if err != nil {
+			return fmt.Errorf("devPromptReplace: %v", err)
+		}
+	}
+	if r.Quota != nil {
+		return r.Quota.validate()
+	}
+	return nil
+}
+
+// inspectsBody is true when the request policy depends on the body, a body too large to inspect is refused rather
+// than let past the policy
+func (r *Request) inspectsBody() bool {
+	return r != nil && (r.Block || r.maxTokens != 0 || r.Quota != nil || len(r.ModelReplace) != 0 ||
+		len(r.UserPromptReplace) != 0 || len(r.DevPromptReplace) != 0)
+}
+
+// inspectsBody is true when the response policy depends on the body
+func (r *Response) inspectsBody() bool {
+	return r != nil && len(r.BannedWords) != 0
+}
+
 func (c *AITransaction) Reset() {
 	c.Request = nil
 	c.Response = nil
+	c.WebSocket = nil
 }
 
 func (c *AITransaction) GetRequest() *Request {
@@ -48,3 +143,7 @@ func (c *AITransaction) GetRequest() *Request {
 func (c *AITransaction) GetResponse() *Response {
 	return c.Response
 }
+
+func (c *AITransaction) GetWebSocket() *WebSocket {
+	return c.WebSocket
+}
@@ -0,0 +1,994 @@
+package gateway
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gateway/pkg/accesslog"
+	"gateway/pkg/metrics"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+var (
+	http2Streams  = metrics.NewCounterVec("kube_gateway_http2_streams_total", "HTTP/2 streams relayed by the gateway", "status")
+	grpcRequests  = metrics.NewCounterVec("kube_gateway_grpc_requests_total", "gRPC calls relayed by the gateway", "method", "code")
+	grpcMessages  = metrics.NewCounterVec("kube_gateway_grpc_messages_total", "gRPC messages relayed by the gateway", "method", "direction")
+	grpcCodeNames = []string{"OK", "CANCELLED", "UNKNOWN", "INVALID_ARGUMENT", "DEADLINE_EXCEEDED", "NOT_FOUND", "ALREADY_EXISTS",
+		"PERMISSION_DENIED", "RESOURCE_EXHAUSTED", "FAILED_PRECONDITION", "ABORTED", "OUT_OF_RANGE", "UNIMPLEMENTED", "INTERNAL",
+		"UNAVAILABLE", "DATA_LOSS", "UNAUTHENTICATED"}
+
+	// The path of a call comes from the client, only method names (/package.Service/Method) are used as labels
+	// and only the first maxGRPCMethods of them
+	grpcMethodPath = regexp.MustCompile(`^/[A-Za-z_][A-Za-z0-9_.]*/[A-Za-z_][A-Za-z0-9_]*$`)
+	grpcMethods    = metrics.NewLabelSet(maxGRPCMethods)
+)
+
+const (
+	// Header blocks are split so that no frame is larger than the smallest SETTINGS_MAX_FRAME_SIZE allowed
+	maxHeaderFragment = 16384
+	// DATA frames sent by the gateway are no larger than the smallest SETTINGS_MAX_FRAME_SIZE either
+	maxDataFrame = 16384
+	// Distinct gRPC methods that are labelled in the metrics, the rest are counted as "other"
+	maxGRPCMethods = 200
+	// Both sides start with this HPACK table size until their peer's SETTINGS say otherwise
+	initialHeaderTableSize = 4096
+	// Flow control window of the connection and of every stream until the receiver's SETTINGS or WINDOW_UPDATEs
+	initialWindowSize = 65535
+)
+
+// h2Relay proxies prior knowledge HTTP/2 (h2c) between the application (ingress) and the destination (egress).
+// Frames are passed on as they are, except header blocks which are decoded and encoded again. This lets streams
+// be inspected, answered or dropped by the gateway without the HPACK tables of the two sides getting out of step
+type h2Relay struct {
+	ingress net.Conn
+	egress  net.Conn
+	c       *AITransaction
+	peer    string // Identity of the gateway carrying the streams, for the access log
+
+	// Credential added to every request for an egress destination, the name is lowercase as HTTP/2 requires
+	credentialHeader string
+	credentialValue  string
+
+	client *h2Writer // Frames to the application
+	server *h2Writer // Frames to the destination
+
+	mu      sync.Mutex
+	streams map[uint32]*h2Stream
+	done    chan struct{} // Closed once the destination's frames are no longer being read
+
+	// Flow control of the data sent to the destination. The application keeps to the windows the destination gives
+	// it, except for inspected request bodies which are sent by the gateway (see send)
+	sendWindow    int64      // The destination's connection window
+	initialWindow int64      // The destination's window for a new stream
+	owed          int64      // Connection window the destination gives back for data that the application didn't send
+	stopped       bool       // Nothing more can be sent to the destination
+	ready         *sync.Cond // Signalled when a window grows or the relay stops
+}
+
+// h2Stream is what the relay knows about a stream that the application opened
+type h2Stream struct {
+	method     string
+	authority  string
+	path       string
+	grpc       bool
+	start      time.Time
+	upstream   time.Duration // Until the response headers arrived
+	status     string
+	grpcStatus string
+	blocked    bool   // Answered or reset by the gateway, frames for it are no longer passed on
+	decision   string // Policy decision for the access log
+	logged     bool
+
+	requestBytes  int64
+	responseBytes int64
+
+	requestEnded  bool
+	responseEnded bool
+
+	requestMessages  grpcMessageCounter
+	responseMessages grpcMessageCounter
+	tail             []byte // End of the previous DATA frame, so banned words split across frames are found
+
+	// A request body that the policy is applied to is held back until it ends, the gateway then sends the
+	// destination the body that the policy returned
+	inspect   bool
+	buffering bool // Until the body has ended, or is too large to inspect
+	header    []hpack.HeaderField
+	body      bytes.Buffer
+	window    int64 // The stream's window at the destination, for the body sent by the gateway
+}
+
+// h2Reader reads the frames sent by one side, keeping the raw bytes of the last frame so it can be passed on
+type h2Reader struct {
+	direction string // request or response
+	framer    *http2.Framer
+	decoder   *hpack.Decoder
+	frame     bytes.Buffer
+	tableSize atomic.Uint32 // Largest HPACK table the sender may use, from the SETTINGS of its peer
+}
+
+func newH2Reader(direction string, r io.Reader) *h2Reader {
+	d := &h2Reader{direction: direction}
+	d.framer = http2.NewFramer(nil, io.TeeReader(r, &d.frame))
+	d.decoder = hpack.NewDecoder(initialHeaderTableSize, nil)
+	d.framer.ReadMetaHeaders = d.decoder
+	d.tableSize.Store(initialHeaderTableSize)
+	return d
+}
+
+func (d *h2Reader) read() (http2.Frame, error) {
+	d.frame.Reset()
+	d.decoder.SetAllowedMaxDynamicTableSize(d.tableSize.Load())
+	return d.framer.ReadFrame()
+}
+
+// h2Writer serialises the frames written to one side, header blocks are encoded with our own HPACK table
+type h2Writer struct {
+	mu      sync.Mutex
+	conn    net.Conn
+	framer  *http2.Framer
+	encoder *hpack.Encoder
+	block   bytes.Buffer
+
+	// The first frame either side receives has to be SETTINGS, nothing of our own is sent until it has been
+	settings     chan struct{}
+	settingsOnce sync.Once
+}
+
+func newH2Writer(conn net.Conn) *h2Writer {
+	w := &h2Writer{conn: conn, framer: http2.NewFramer(conn, nil), settings: make(chan struct{})}
+	w.encoder = hpack.NewEncoder(&w.block)
+	return w
+}
+
+// forward writes a frame exactly as it was received
+func (w *h2Writer) forward(frame []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err := w.conn.Write(frame)
+	return err
+}
+
+func (w *h2Writer) headers(streamID uint32, fields []hpack.HeaderField, endStream bool, priority http2.PriorityParam) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.block.Reset()
+	for x := range fields {
+		err := w.encoder.WriteField(fields[x])
+		if err != nil {
+			return err
+		}
+	}
+	block := w.block.Bytes()
+	for first := true; first || len(block) != 0; first = false {
+		fragment := block[:min(len(block), maxHeaderFragment)]
+		block = block[len(fragment):]
+		var err error
+		if first {
+			err = w.framer.WriteHeaders(http2.HeadersFrameParam{StreamID: streamID, BlockFragment: fragment, EndStream: endStream, EndHeaders: len(block) == 0, Priority: priority})
+		} else {
+			err = w.framer.WriteContinuation(streamID, len(block) == 0, fragment)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *h2Writer) data(streamID uint32, endStream bool, data []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.framer.WriteData(streamID, endStream, data)
+}
+
+func (w *h2Writer) reset(streamID uint32, code http2.ErrCode) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.framer.WriteRSTStream(streamID, code)
+}
+
+// windowUpdate gives the sender back the flow control window of data that was dropped or held back, for the
+// connection (streamID 0) or a stream
+func (w *h2Writer) windowUpdate(streamID, length uint32) error {
+	if length == 0 {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.framer.WriteWindowUpdate(streamID, length)
+}
+
+// limitTable follows the HPACK table size that the side we write to allows
+func (w *h2Writer) limitTable(size uint32) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.encoder.SetMaxDynamicTableSizeLimit(size)
+}
+
+func H2c_gateway(ingress, egress net.Conn, c *AITransaction) error {
+	client := bufio.NewReader(ingress)
+	preface := make([]byte, len(http2.ClientPreface))
+	_, err := io.ReadFull(client, preface)
+	if err != nil {
+		return fmt.Errorf("Failed reading preface: %v", err)
+	}
+	if string(preface) != http2.ClientPreface {
+		return fmt.Errorf("connection isn't prior knowledge HTTP/2")
+	}
+	_, err = egress.Write(preface)
+	if err != nil {
+		return fmt.Errorf("Writing to remote: %v", err)
+	}
+
+	h := &h2Relay{
+		ingress: ingress,
+		egress:  egress,
+		c:       c,
+		peer:    peerOf(egress),
+		client:  newH2Writer(ingress),
+		server:  newH2Writer(egress),
+		streams: make(map[uint32]*h2Stream),
+		done:    make(chan struct{}),
+
+		sendWindow:    initialWindowSize,
+		initialWindow: initialWindowSize,
+	}
+	h.ready = sync.NewCond(&h.mu)
+	header, value := credentialOf(egress)
+	h.credentialHeader, h.credentialValue = strings.ToLower(header), value
+	requests := newH2Reader("request", client)
+	responses := newH2Reader("response", bufio.NewReader(egress))
+
+	go func() {
+		err := h.relay(requests, responses, h.server, h.client)
+		if err != nil {
+			slog.Error("relaying http2 requests", "err", err)
+		}
+		closeWrite(egress)
+	}()
+	defer close(h.done)
+	defer h.stop()
+	err = h.relay(responses, requests, h.client, h.server)
+	closeWrite(ingress)
+	return err
+}
+
+// relay reads frames from one side and passes them to the other (to), frames that the gateway sends in reply
+// go back to the sender (back). peer reads the frames from the other side
+func (h *h2Relay) relay(from, peer *h2Reader, to, back *h2Writer) error {
+	for {
+		frame, err := from.read()
+		if err != nil {
+			var streamErr http2.StreamError
+			if errors.As(err, &streamErr) {
+				// The header block was decoded but isn't valid HTTP/2, only the stream is refused
+				h.finish(streamErr.StreamID, "reset")
+				err = back.reset(streamErr.StreamID, streamErr.Code)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		switch f := frame.(type) {
+		case *http2.MetaHeadersFrame:
+			if from.direction == "request" {
+				err = h.requestHeaders(f, to, back)
+			} else {
+				err = h.responseHeaders(f, to)
+			}
+		case *http2.DataFrame:
+			err = h.data(from, f, to, back)
+		case *http2.SettingsFrame:
+			if !f.IsAck() {
+				if size, ok := f.Value(http2.SettingHeaderTableSize); ok {
+					back.limitTable(size)
+					peer.tableSize.Store(size)
+				}
+				if size, ok := f.Value(http2.SettingInitialWindowSize); ok && from.direction == "response" {
+					h.setInitialWindow(size)
+				}
+			}
+			err = to.forward(from.frame.Bytes())
+			to.settingsOnce.Do(func() { close(to.settings) })
+		case *http2.RSTStreamFrame:
+			if h.blocked(f.StreamID) {
+				h.finish(f.StreamID, "reset")
+				continue // The other side never saw the stream, or it has been reset already
+			}
+			h.finish(f.StreamID, "reset")
+			err = to.forward(from.frame.Bytes())
+		case *http2.WindowUpdateFrame:
+			if from.direction == "response" {
+				err = h.windowUpdate(f, from, to)
+			} else {
+				err = to.forward(from.frame.Bytes())
+			}
+		case *http2.PushPromiseFrame:
+			return fmt.Errorf("server push isn't supported")
+		default:
+			err = to.forward(from.frame.Bytes())
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// requestHeaders starts a stream, or passes on the trailers of one. Blocked requests are answered by the
+// gateway and never reach the destination
+func (h *h2Relay) requestHeaders(f *http2.MetaHeadersFrame, to, back *h2Writer) error {
+	h.mu.Lock()
+	stream, ok := h.streams[f.StreamID]
+	if !ok {
+		stream = &h2Stream{
+			method:    f.PseudoValue("method"),
+			authority: f.PseudoValue("authority"),
+			path:      f.PseudoValue("path"),
+			start:     time.Now(),
+			decision:  accesslog.DecisionAllowed,
+		}
+		for _, field := range f.RegularFields() {
+			if field.Name == "content-type" && strings.HasPrefix(field.Value, "application/grpc") {
+				stream.grpc = true
+			}
+		}
+		h.streams[f.StreamID] = stream
+	}
+	blocked := stream.blocked
+	h.mu.Unlock()
+
+	if blocked {
+		if f.StreamEnded() {
+			h.ended(f.StreamID, "request")
+		}
+		return nil
+	}
+	fields := f.Fields
+	if !ok && h.c.GetRequest() != nil {
+		if h.c.Request.Debug {
+			debugHeaders("request", f.StreamID, f.Fields)
+		}
+		if h.c.Request.Block {
+			slog.Info("block request", "dest", h.egress.RemoteAddr().String(), "path", stream.path)
+			return h.answer(f, stream, back)
+		}
+		if !stream.grpc && !f.StreamEnded() {
+			var err error
+			fields, err = h.startInspecting(f, stream, back)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if ok && f.StreamEnded() && h.isBuffering(stream) {
+		// Trailers, the body has ended
+		err := h.inspectBody(f.StreamID, stream, false, to, back)
+		if err != nil {
+			return err
+		}
+		if h.blocked(f.StreamID) {
+			h.ended(f.StreamID, "request")
+			return nil
+		}
+	}
+
+	if !ok && h.credentialHeader != "" {
+		fields = h.withCredential(fields)
+	}
+	err := to.headers(f.StreamID, fields, f.StreamEnded(), f.Priority)
+	if err != nil {
+		return err
+	}
+	if f.StreamEnded() {
+		h.ended(f.StreamID, "request")
+	}
+	return nil
+}
+
+// withCredential replaces the credential header in a request's fields, it is never added to the HPACK table
+func (h *h2Relay) withCredential(fields []hpack.HeaderField) []hpack.HeaderField {
+	out := make([]hpack.HeaderField, 0, len(fields)+1)
+	for _, field := range fields {
+		if field.Name != h.credentialHeader {
+			out = append(out, field)
+		}
+	}
+	return append(out, hpack.HeaderField{Name: h.credentialHeader, Value: h.credentialValue, Sensitive: true})
+}
+
+// settled waits until w has passed on the SETTINGS of its peer, as the first frame a side receives has to be
+// SETTINGS. It is false if the relay stops first
+func (h *h2Relay) settled(w *h2Writer) bool {
+	select {
+	case <-w.settings:
+		return true
+	case <-h.done:
+		return false
+	}
+}
+
+// answer sends the application the response to a blocked request
+func (h *h2Relay) answer(f *http2.MetaHeadersFrame, stream *h2Stream, back *h2Writer) error {
+	h.mu.Lock()
+	stream.blocked = true
+	stream.decision = accesslog.DecisionBlockedRequest
+	stream.responseEnded = true
+	if stream.grpc {
+		stream.grpcStatus = "7" // PERMISSION_DENIED
+	} else {
+		stream.status = "403"
+	}
+	h.mu.Unlock()
+
+	if !h.settled(back) {
+		return nil
+	}
+	var err error
+	if stream.grpc {
+		err = back.headers(f.StreamID, []hpack.HeaderField{
+			{Name: ":status", Value: "200"},
+			{Name: "content-type", Value: "application/grpc"},
+			{Name: "grpc-status", Value: "7"},
+			{Name: "grpc-message", Value: "kube-gateway says no"},
+		}, true, http2.PriorityParam{})
+	} else {
+		err = back.headers(f.StreamID, []hpack.HeaderField{
+			{Name: ":status", Value: "403"},
+			{Name: "content-type", Value: "text/plain"},
+		}, false, http2.PriorityParam{})
+		if err == nil {
+			err = back.data(f.StreamID, true, []byte("kube-gateway says no"))
+		}
+	}
+	h.finish(f.StreamID, "blocked")
+	if f.StreamEnded() {
+		h.ended(f.StreamID, "request")
+	}
+	return err
+}
+
+// responseHeaders records the status of a stream and passes the headers (or trailers) to the application
+func (h *h2Relay) responseHeaders(f *http2.MetaHeadersFrame, to *h2Writer) error {
+	h.mu.Lock()
+	stream := h.streams[f.StreamID]
+	if stream != nil {
+		if stream.blocked {
+			h.mu.Unlock()
+			if f.StreamEnded() {
+				h.finish(f.StreamID, "reset")
+			}
+			return nil
+		}
+		if status := f.PseudoValue("status"); status != "" && !strings.HasPrefix(status, "1") {
+			stream.status = status
+			stream.upstream = time.Since(stream.start)
+		}
+		for _, field := range f.RegularFields() {
+			if field.Name == "grpc-status" {
+				stream.grpcStatus = field.Value
+			}
+		}
+	}
+	h.mu.Unlock()
+
+	if h.c.GetResponse() != nil && h.c.Response.Debug {
+		debugHeaders("response", f.StreamID, f.Fields)
+	}
+	if f.StreamEnded() {
+		h.ended(f.StreamID, "response") // Counted before the application can see the end of the stream
+	}
+	return to.headers(f.StreamID, f.Fields, f.StreamEnded(), f.Priority)
+}
+
+// data passes on a DATA frame, counting gRPC messages and looking for banned words in other responses
+func (h *h2Relay) data(from *h2Reader, f *http2.DataFrame, to, back *h2Writer) error {
+	h.mu.Lock()
+	stream := h.streams[f.StreamID]
+	if stream != nil && stream.blocked {
+		h.mu.Unlock()
+		if f.StreamEnded() {
+			h.ended(f.StreamID, from.direction)
+		}
+		// The data is dropped, the sender gets the connection's flow control window back
+		return back.windowUpdate(0, f.Header().Length)
+	}
+	if stream != nil && stream.inspect && from.direction == "request" {
+		h.mu.Unlock()
+		return h.inspectData(f, stream, to, back)
+	}
+	var banned string
+	if stream != nil {
+		if from.direction == "request" {
+			stream.requestBytes += int64(len(f.Data()))
+		} else {
+			stream.responseBytes += int64(len(f.Data()))
+		}
+		switch {
+		case stream.grpc && from.direction == "request":
+			stream.requestMessages.count(f.Data())
+		case stream.grpc:
+			stream.responseMessages.count(f.Data())
+		case from.direction == "response":
+			banned = h.bannedWord(stream, f.Data())
+		}
+	}
+	h.mu.Unlock()
+
+	if banned != "" {
+		slog.Info("block response", "dest", h.egress.RemoteAddr().String(), "path", stream.path)
+		h.mu.Lock()
+		stream.blocked = true
+		stream.decision = accesslog.DecisionBlockedResponse
+		h.mu.Unlock()
+		h.finish(f.StreamID, "blocked")
+		err := back.reset(f.StreamID, http2.ErrCodeCancel)
+		if err == nil {
+			err = back.windowUpdate(0, f.Header().Length)
+		}
+		if err == nil {
+			err = to.reset(f.StreamID, http2.ErrCodeCancel)
+		}
+		return err
+	}
+
+	if from.direction == "request" && !h.reserve(int64(f.Header().Length)) {
+		return nil // Stopped
+	}
+	if f.StreamEnded() {
+		h.ended(f.StreamID, from.direction)
+	}
+	return to.forward(from.frame.Bytes())
+}
+
+// bannedWord returns the first banned word in the response data, including words split across frames
+func (h *h2Relay) bannedWord(stream *h2Stream, data []byte) string {
+	response := h.c.GetResponse()
+	if response == nil || len(response.BannedWords) == 0 {
+		return ""
+	}
+	longest := 0
+	window := append(stream.tail, data...)
+	for _, word := range response.BannedWords {
+		if word != "" && bytes.Contains(window, []byte(word)) {
+			return word
+		}
+		longest = max(longest, len(word))
+	}
+	keep := min(len(window), max(longest-1, 0))
+	stream.tail = append(stream.tail[:0], window[len(window)-keep:]...)
+	return ""
+}
+
+// startInspecting holds back the request body of a new stream so the request policy can be applied to it. The
+// headers are sent on straight away to keep the streams in order, without a content-length as the policy can
+// change the body
+func (h *h2Relay) startInspecting(f *http2.MetaHeadersFrame, stream *h2Stream, back *h2Writer) ([]hpack.HeaderField, error) {
+	fields := make([]hpack.HeaderField, 0, len(f.Fields))
+	expect := false
+	for _, field := range f.Fields {
+		switch {
+		case field.Name == "content-length":
+		case field.Name == "expect" && strings.EqualFold(field.Value, "100-continue"):
+			expect = true
+		default:
+			fields = append(fields, field)
+		}
+	}
+	h.mu.Lock()
+	stream.inspect = true
+	stream.buffering = true
+	stream.header = f.RegularFields()
+	stream.window = h.initialWindow
+	h.mu.Unlock()
+
+	// We need the body before the destination sees the request, so answer the 100 Continue ourselves
+	if expect && h.settled(back) {
+		err := back.headers(f.StreamID, []hpack.HeaderField{{Name: ":status", Value: "100"}}, false, http2.PriorityParam{})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return fields, nil
+}
+
+func (h *h2Relay) isBuffering(stream *h2Stream) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return stream.buffering
+}
+
+// inspectData holds back the request body of an inspected stream. The destination hasn't seen the data, so the
+// application's flow control windows are given back by the gateway
+func (h *h2Relay) inspectData(f *http2.DataFrame, stream *h2Stream, to, back *h2Writer) error {
+	h.mu.Lock()
+	stream.requestBytes += int64(len(f.Data()))
+	buffering := stream.buffering
+	if buffering {
+		stream.body.Write(f.Data())
+	}
+	size := int64(stream.body.Len())
+	h.mu.Unlock()
+
+	if !h.settled(back) {
+		return nil
+	}
+	err := back.windowUpdate(0, f.Header().Length)
+	if err == nil && !f.StreamEnded() {
+		err = back.windowUpdate(f.StreamID, f.Header().Length)
+	}
+	switch {
+	case err != nil:
+	case !buffering:
+		err = h.send(f.StreamID, stream, f.Data(), f.StreamEnded(), to)
+	case size > maxInspectedBody && h.c.GetRequest().inspectsBody():
+		slog.Warn("request body too large to inspect, refusing it", "limit", maxInspectedBody, "host", stream.authority, "path", stream.path)
+		err = h.refuse(f.StreamID, stream, bodyTooLarge(nil, http.StatusRequestEntityTooLarge, "request"), to, back)
+	case size > maxInspectedBody:
+		slog.Warn("request body too large to inspect", "limit", maxInspectedBody)
+		h.mu.Lock()
+		stream.buffering = false
+		body := stream.body.Bytes()
+		stream.body = bytes.Buffer{}
+		h.mu.Unlock()
+		err = h.send(f.StreamID, stream, body, f.StreamEnded(), to)
+	case f.StreamEnded():
+		err = h.inspectBody(f.StreamID, stream, true, to, back)
+	}
+	if f.StreamEnded() {
+		h.ended(f.StreamID, "request")
+	}
+	return err
+}
+
+// inspectBody applies the request policy to a body that has ended, the destination is sent the body that the
+// policy returned, or the application is answered by the gateway instead
+func (h *h2Relay) inspectBody(streamID uint32, stream *h2Stream, endStream bool, to, back *h2Writer) error {
+	h.mu.Lock()
+	stream.buffering = false
+	body := stream.body.Bytes()
+	stream.body = bytes.Buffer{}
+	h.mu.Unlock()
+
+	req := stream.request(body)
+	block, res, err := h.c.openAIRequest(req)
+	switch {
+	case err != nil:
+		// Not a request we understand, send it on as it was
+		slog.Error("parse openAI request", "err", err)
+	case block:
+		slog.Info("block request", "dest", h.egress.RemoteAddr().String(), "path", stream.path)
+		return h.refuse(streamID, stream, res, to, back)
+	default:
+		body, _ = io.ReadAll(req.Body)
+	}
+	return h.send(streamID, stream, body, endStream, to)
+}
+
+// request is the HTTP request of a stream, for the request policy
+func (s *h2Stream) request(body []byte) *http.Request {
+	u, err := url.ParseRequestURI(s.path)
+	if err != nil {
+		u = &url.URL{Path: s.path}
+	}
+	req := &http.Request{
+		Method:        s.method,
+		URL:           u,
+		Proto:         "HTTP/2.0",
+		ProtoMajor:    2,
+		Header:        make(http.Header),
+		Host:          s.authority,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+	for _, field := range s.header {
+		req.Header.Add(field.Name, field.Value)
+	}
+	return req
+}
+
+// refuse answers an inspected request with the gateway's response. The destination has already been sent the
+// headers, so its stream is reset
+func (h *h2Relay) refuse(streamID uint32, stream *h2Stream, res *http.Response, to, back *h2Writer) error {
+	h.mu.Lock()
+	stream.blocked = true
+	stream.buffering = false
+	stream.decision = accesslog.DecisionBlockedRequest
+	stream.status = strconv.Itoa(res.StatusCode)
+	stream.responseEnded = true
+	h.ready.Broadcast() // Nothing more is sent for the stream
+	h.mu.Unlock()
+
+	err := to.reset(streamID, http2.ErrCodeCancel)
+	if err != nil || !h.settled(back) {
+		return err
+	}
+	body, _ := io.ReadAll(res.Body)
+	fields := []hpack.HeaderField{{Name: ":status", Value: strconv.Itoa(res.StatusCode)}}
+	for name, values := range res.Header {
+		for _, value := range values {
+			fields = append(fields, hpack.HeaderField{Name: strings.ToLower(name), Value: value})
+		}
+	}
+	fields = append(fields, hpack.HeaderField{Name: "content-length", Value: strconv.Itoa(len(body))})
+	err = back.headers(streamID, fields, false, http2.PriorityParam{})
+	if err == nil {
+		err = back.data(streamID, true, body)
+	}
+	h.finish(streamID, "blocked")
+	return err
+}
+
+// send writes the request body of an inspected stream, keeping to the destination's flow control windows. The
+// destination gives the connection window back for the data, which the application never sent, so it is owed
+func (h *h2Relay) send(streamID uint32, stream *h2Stream, data []byte, endStream bool, to *h2Writer) error {
+	for first := true; first || len(data) != 0; first = false {
+		h.mu.Lock()
+		for len(data) != 0 && (h.sendWindow <= 0 || stream.window <= 0) {
+			if h.stopped || stream.blocked || h.streams[streamID] != stream {
+				h.mu.Unlock()
+				return nil // The rest of the body is no longer wanted
+			}
+			h.ready.Wait()
+		}
+		n := min(int64(len(data)), h.sendWindow, stream.window, maxDataFrame)
+		h.sendWindow -= n
+		stream.window -= n
+		h.owed += n
+		h.mu.Unlock()
+
+		chunk := data[:n]
+		data = data[n:]
+		err := to.data(streamID, endStream && len(data) == 0, chunk)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reserve takes n bytes of the destination's connection window for data from the application, it only has to wait
+// while the destination is yet to give back the window of a body sent by the gateway. It is false once stopped
+func (h *h2Relay) reserve(n int64) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for n != 0 && h.sendWindow < n {
+		if h.stopped {
+			return false
+		}
+		h.ready.Wait()
+	}
+	h.sendWindow -= n
+	return true
+}
+
+// windowUpdate follows the windows the destination gives. The windows of inspected streams, and the connection
+// window owed for their bodies, are kept by the gateway, everything else is passed on to the application
+func (h *h2Relay) windowUpdate(f *http2.WindowUpdateFrame, from *h2Reader, to *h2Writer) error {
+	increment := int64(f.Increment)
+	h.mu.Lock()
+	if f.StreamID != 0 {
+		stream := h.streams[f.StreamID]
+		inspect := stream != nil && stream.inspect
+		if inspect {
+			stream.window += increment
+			h.ready.Broadcast()
+		}
+		h.mu.Unlock()
+		if inspect {
+			return nil
+		}
+		return to.forward(from.frame.Bytes())
+	}
+	h.sendWindow += increment
+	kept := min(h.owed, increment)
+	h.owed -= kept
+	h.ready.Broadcast()
+	h.mu.Unlock()
+
+	if kept == 0 {
+		return to.forward(from.frame.Bytes())
+	}
+	return to.windowUpdate(0, uint32(increment-kept))
+}
+
+// setInitialWindow applies a change to the destination's initial stream window to the inspected streams
+func (h *h2Relay) setInitialWindow(size uint32) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delta := int64(size) - h.initialWindow
+	h.initialWindow = int64(size)
+	for _, stream := range h.streams {
+		if stream.inspect {
+			stream.window += delta
+		}
+	}
+	h.ready.Broadcast()
+}
+
+// stop wakes anything waiting for the destination's windows, once its frames are no longer being read
+func (h *h2Relay) stop() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.stopped = true
+	h.ready.Broadcast()
+}
+
+func (h *h2Relay) blocked(streamID uint32) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	stream := h.streams[streamID]
+	return stream != nil && stream.blocked
+}
+
+// ended marks one side of a stream as finished, the stream is forgotten once both sides have finished
+func (h *h2Relay) ended(streamID uint32, direction string) {
+	h.mu.Lock()
+	stream := h.streams[streamID]
+	if stream == nil {
+		h.mu.Unlock()
+		return
+	}
+	if direction == "request" {
+		stream.requestEnded = true
+	} else {
+		stream.responseEnded = true
+	}
+	done := stream.requestEnded && stream.responseEnded
+	h.mu.Unlock()
+
+	if direction == "response" || done {
+		h.finish(streamID, "")
+	}
+	if done {
+		h.mu.Lock()
+		delete(h.streams, streamID)
+		h.mu.Unlock()
+	}
+}
+
+// finish logs a stream and counts it in the metrics, once. A reset forgets the stream straight away
+func (h *h2Relay) finish(streamID uint32, outcome string) {
+	h.mu.Lock()
+	stream := h.streams[streamID]
+	if stream == nil {
+		h.mu.Unlock()
+		return
+	}
+	if outcome == "reset" {
+		delete(h.streams, streamID)
+	}
+	if stream.logged {
+		h.mu.Unlock()
+		return
+	}
+	stream.logged = true
+	s := *stream // The other side may still be updating the stream
+	h.mu.Unlock()
+
+	status := s.status
+	if outcome != "" {
+		status = outcome
+	}
+	http2Streams.WithLabelValues(status).Inc()
+	dest := h.egress.RemoteAddr().String()
+	duration := time.Since(s.start)
+	code := ""
+	if s.grpc {
+		code = grpcCode(s.grpcStatus, outcome)
+	}
+	h.accessLog(&s, code, duration)
+
+	if !s.grpc {
+		slog.Info("http2 request", "dest", dest, "method", s.method, "path", s.path, "status", status, "duration", duration)
+		return
+	}
+	requests, responses := s.requestMessages.messages, s.responseMessages.messages
+	method := grpcMethod(s.path)
+	grpcRequests.WithLabelValues(method, code).Inc()
+	grpcMessages.WithLabelValues(method, "request").Add(float64(requests))
+	grpcMessages.WithLabelValues(method, "response").Add(float64(responses))
+	slog.Info("grpc request", "dest", dest, "method", s.path, "code", code, "requestMessages", requests, "responseMessages", responses, "duration", duration)
+}
+
+func (h *h2Relay) accessLog(s *h2Stream, grpcCode string, duration time.Duration) {
+	if !h.c.AccessLog.Enabled() {
+		return
+	}
+	status, _ := strconv.Atoi(s.status) // 0 when the stream was reset before a response
+	h.c.AccessLog.Log(&accesslog.Entry{
+		Time:          s.start,
+		Protocol:      "HTTP/2.0",
+		Client:        h.ingress.RemoteAddr().String(),
+		Destination:   h.egress.RemoteAddr().String(),
+		Peer:          h.peer,
+		Method:        s.method,
+		Host:          s.authority,
+		Path:          s.path,
+		Status:        status,
+		RequestBytes:  s.requestBytes,
+		ResponseBytes: s.responseBytes,
+		Upstream:      s.upstream,
+		Duration:      duration,
+		Decision:      s.decision,
+		GRPCStatus:    grpcCode,
+	})
+}
+
+// grpcMethod returns the metric label of a call's path
+func grpcMethod(path string) string {
+	if !grpcMethodPath.MatchString(path) {
+		return metrics.Other
+	}
+	return grpcMethods.Value(path)
+}
+
+// grpcCode names the grpc-status of a call, calls that were reset before their trailers are CANCELLED
+func grpcCode(status, outcome string) string {
+	if status == "" {
+		if outcome == "reset" {
+			return "CANCELLED"
+		}
+		return "UNKNOWN"
+	}
+	code, err := strconv.Atoi(status)
+	if err != nil || code < 0 || code >= len(grpcCodeNames) {
+		return status
+	}
+	return grpcCodeNames[code]
+}
+
+// grpcMessageCounter counts the length prefixed messages of one direction of a gRPC call
+type grpcMessageCounter struct {
+	messages  int
+	prefix    []byte // Compressed flag and length of the message being read
+	remaining uint32
+}
+
+func (g *grpcMessageCounter) count(p []byte) {
+	for len(p) != 0 {
+		if g.remaining != 0 {
+			skip := min(uint32(len(p)), g.remaining)
+			g.remaining -= skip
+			p = p[skip:]
+			continue
+		}
+		g.prefix = append(g.prefix, p[0])
+		p = p[1:]
+		if len(g.prefix) == 5 {
+			g.messages++
+			g.remaining = binary.BigEndian.Uint32(g.prefix[1:])
+			g.prefix = g.prefix[:0]
+		}
+	}
+}
+
+func debugHeaders(direction string, streamID uint32, fields []hpack.HeaderField) {
+	fmt.Printf("%s stream %d\n", direction, streamID)
+	for x := range fields {
+		fmt.Printf("%s: %s\n", fields[x].Name, fields[x].Value)
+	}
+	fmt.Println()
+}
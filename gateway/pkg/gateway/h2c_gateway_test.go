@@ -0,0 +1,289 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gateway/pkg/metrics"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// h2cClient starts H2c_gateway in front of an h2c server, returning a client that uses a single connection
+func h2cClient(t *testing.T, handler http.Handler, c *AITransaction) *http2.ClientConn {
+	t.Helper()
+	server := httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	t.Cleanup(server.Close)
+	conn, _ := relayWith(t, server, c, H2c_gateway)
+	cc, err := (&http2.Transport{AllowHTTP: true}).NewClientConn(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cc
+}
+
+func h2cGet(t *testing.T, cc *http2.ClientConn, path string) (*http.Response, string) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, "http://test"+path, nil)
+	req.Header.Set("x-request", path) // Indexed by HPACK, the relay has to keep the tables in step
+	res, err := cc.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, readBody(t, res)
+}
+
+func TestH2cGatewayStreams(t *testing.T) {
+	cc := h2cClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("x-response", r.Header.Get("x-request"))
+		echoPath(w, r)
+	}), &AITransaction{})
+
+	var wg sync.WaitGroup
+	for x := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			path := fmt.Sprintf("/%d", x%4)
+			res, body := h2cGet(t, cc, path)
+			if body != "path="+path || res.Header.Get("x-response") != path {
+				t.Errorf("expected path=%s, got %q and header %q", path, body, res.Header.Get("x-response"))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// grpcFrame length prefixes a gRPC message
+func grpcFrame(message string) []byte {
+	b := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(b[1:], uint32(len(message)))
+	return append(b, message...)
+}
+
+func TestH2cGatewayGRPC(t *testing.T) {
+	cc := h2cClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("content-type", "application/grpc")
+		w.Header().Set("trailer", "grpc-status")
+		w.Write(grpcFrame("one"))
+		w.Write(grpcFrame("two"))
+		w.Header().Set("grpc-status", "5")
+	}), &AITransaction{})
+
+	method := fmt.Sprintf("/echo.Echo/Say%d", time.Now().UnixNano()) // The metrics are shared by every test run
+	body := append(grpcFrame("hello"), grpcFrame("world")...)
+	req, _ := http.NewRequest(http.MethodPost, "http://test"+method, bytes.NewReader(body))
+	req.Header.Set("content-type", "application/grpc")
+	res, err := cc.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, res)
+	if got := res.Trailer.Get("grpc-status"); got != "5" {
+		t.Fatalf("expected grpc-status 5, got %q", got)
+	}
+
+	var out bytes.Buffer
+	metrics.Write(&out)
+	for _, expected := range []string{
+		fmt.Sprintf(`kube_gateway_grpc_requests_total{method="%s",code="NOT_FOUND"} 1`, method),
+		fmt.Sprintf(`kube_gateway_grpc_messages_total{method="%s",direction="request"} 2`, method),
+		fmt.Sprintf(`kube_gateway_grpc_messages_total{method="%s",direction="response"} 2`, method),
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("expected metric %s in\n%s", expected, out.String())
+		}
+	}
+}
+
+func TestH2cGatewayCredential(t *testing.T) {
+	server := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Values("Authorization"))
+	}), &http2.Server{}))
+	defer server.Close()
+	conn, _ := relayWith(t, server, &AITransaction{}, withCredential(H2c_gateway))
+	cc, err := (&http2.Transport{AllowHTTP: true}).NewClientConn(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "http://test/", nil)
+	req.Header.Set("Authorization", "Bearer app")
+	res, err := cc.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readBody(t, res); got != "[Bearer secret]" {
+		t.Fatalf("expected the injected credential, got %q", got)
+	}
+}
+
+func TestH2cGatewayBlockedRequest(t *testing.T) {
+	var served int
+	cc := h2cClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served++
+	}), &AITransaction{Request: &Request{Block: true}})
+
+	for range 3 {
+		res, body := h2cGet(t, cc, "/blocked")
+		if res.StatusCode != http.StatusForbidden || body != "kube-gateway says no" {
+			t.Fatalf("expected a blocked response, got %d %q", res.StatusCode, body)
+		}
+	}
+	if served != 0 {
+		t.Fatalf("expected no requests to reach the destination, %d did", served)
+	}
+}
+
+func TestH2cGatewayBannedWords(t *testing.T) {
+	cc := h2cClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/rabbit" {
+			w.Write([]byte("a white rab"))
+			w.(http.Flusher).Flush()
+			w.Write([]byte("bit appears"))
+			return
+		}
+		echoPath(w, r)
+	}), &AITransaction{Response: &Response{BannedWords: []string{"rabbit"}}})
+
+	req, _ := http.NewRequest(http.MethodGet, "http://test/rabbit", nil)
+	res, err := cc.RoundTrip(req)
+	if err == nil {
+		_, err = io.ReadAll(res.Body)
+	}
+	if err == nil {
+		t.Fatal("expected the response to be reset")
+	}
+
+	// The rest of the connection is unaffected
+	_, body := h2cGet(t, cc, "/next")
+	if body != "path=/next" {
+		t.Fatalf("expected path=/next, got %q", body)
+	}
+}
+
+// h2cEcho is an h2c server that returns the request body as it saw it, with windows as small as HTTP/2 allows so
+// that bodies sent by the gateway have to wait for them
+func h2cEcho(t *testing.T, c *AITransaction) *http2.ClientConn {
+	t.Helper()
+	server := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}), &http2.Server{MaxUploadBufferPerConnection: 65535, MaxUploadBufferPerStream: 65535}))
+	t.Cleanup(server.Close)
+	conn, _ := relayWith(t, server, c, H2c_gateway)
+	cc, err := (&http2.Transport{AllowHTTP: true}).NewClientConn(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cc
+}
+
+func h2cPost(t *testing.T, cc *http2.ClientConn, body string) (*http.Response, string) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, "http://test/v1/chat/completions", strings.NewReader(body))
+	req.Header.Set("content-type", "application/json")
+	res, err := cc.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, readBody(t, res)
+}
+
+func TestH2cGatewayRequestPolicy(t *testing.T) {
+	c := &AITransaction{}
+	err := c.Load([]byte(`{"request":{"maxTokens":"50","modelReplace":[{"orig":"gpt-4","new":"llama3"}],"userPromptReplace":[{"orig":"joke","new":"fact"}]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc := h2cEcho(t, c)
+
+	// Larger than the windows, on several streams at once
+	prompt := strings.Repeat("tell me a joke ", 20000)
+	expected := strings.Repeat("tell me a fact ", 20000)
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, body := h2cPost(t, cc, fmt.Sprintf(`{"model":"gpt-4","messages":[{"role":"user","content":%q}]}`, prompt))
+			var chat struct {
+				Model     string `json:"model"`
+				MaxTokens int    `json:"max_completion_tokens"`
+				Messages  []struct {
+					Content string `json:"content"`
+				} `json:"messages"`
+			}
+			err := json.Unmarshal([]byte(body), &chat)
+			if err != nil || res.StatusCode != http.StatusOK {
+				t.Errorf("expected the rewritten request, got %d %.100s", res.StatusCode, body)
+				return
+			}
+			if chat.Model != "llama3" || chat.MaxTokens != 50 || len(chat.Messages) != 1 || chat.Messages[0].Content != expected {
+				t.Errorf("expected the policy to be applied, got model %s and max_completion_tokens %d", chat.Model, chat.MaxTokens)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Bodies that aren't chat completions are sent on as they were
+	if _, body := h2cPost(t, cc, "not json"); body != "not json" {
+		t.Fatalf("expected the body to be unchanged, got %q", body)
+	}
+}
+
+func TestH2cGatewayRequestRefused(t *testing.T) {
+	defer func(limit int64) { maxInspectedBody = limit }(maxInspectedBody)
+	maxInspectedBody = 1024
+
+	c := &AITransaction{}
+	err := c.Load([]byte(`{"request":{"maxTokens":"50","maxTokensMode":"reject"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc := h2cEcho(t, c)
+
+	for _, test := range []struct {
+		body     string
+		status   int
+		expected string
+	}{
+		{`{"model":"llama3","messages":[],"max_tokens":500}`, http.StatusBadRequest, `"code":"max_tokens_exceeded"`},
+		{fmt.Sprintf(`{"model":"llama3","messages":[{"role":"user","content":%q}]}`, strings.Repeat("x", 2048)), http.StatusRequestEntityTooLarge, `"code":"body_too_large"`},
+		{`{"model":"llama3","messages":[],"max_tokens":5}`, http.StatusOK, `"max_tokens":5`}, // The connection is still usable
+	} {
+		res, body := h2cPost(t, cc, test.body)
+		if res.StatusCode != test.status || !strings.Contains(body, test.expected) {
+			t.Errorf("expected %d with %s, got %d %s", test.status, test.expected, res.StatusCode, body)
+		}
+	}
+}
+
+func TestGRPCMethod(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"/helloworld.Greeter/SayHello", "/helloworld.Greeter/SayHello"},
+		{"/grpc.health.v1.Health/Check", "/grpc.health.v1.Health/Check"},
+		{"/", "other"},
+		{"/v1/chat/completions", "other"},
+		{"/helloworld.Greeter/SayHello?id=1", "other"},
+		{"/helloworld.Greeter/" + strings.Repeat("x", 10) + "-1", "other"},
+	}
+	for _, test := range tests {
+		if got := grpcMethod(test.path); got != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.path, test.expected, got)
+		}
+	}
+}
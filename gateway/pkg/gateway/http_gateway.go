@@ -2,93 +2,482 @@ package gateway
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"strings"
+	"sync"
+	"time"
+
+	"gateway/pkg/accesslog"
 
 	"github.com/openai/openai-go"
 )
 
+// Bodies are only buffered when a policy needs to inspect them, and never beyond this size. Larger bodies are
+// refused when the policy depends on the body, otherwise they are streamed through untouched
+var maxInspectedBody int64 = 8 << 20
+
+// Requests that can be in flight on a connection before we stop reading new ones
+const maxPipelined = 64
+
+// httpRelay proxies HTTP/1.x between the application (ingress) and the destination (egress). Both sides keep
+// a single reader for the lifetime of the connection so keep-alive and pipelined requests aren't lost, and
+// responses are paired with requests in the order the requests were sent
+type httpRelay struct {
+	ingress net.Conn
+	egress  net.Conn
+	c       *AITransaction
+	peer    string // Identity of the gateway carrying the requests, for the access log
+
+	// Credential added to every request for an egress destination
+	credentialHeader string
+	credentialValue  string
+
+	client *bufio.Reader
+	server *bufio.Reader
+
+	// Writes to the application come from both loops (100 Continue and responses)
+	clientMu sync.Mutex
+	pending  chan *pendingRequest
+	done     chan struct{} // Closed once responses are no longer being read
+	upgraded chan bool     // Whether the destination accepted an upgrade request
+}
+
+// pendingRequest is a request waiting for its response, a synthetic response (i.e. a blocked request) is sent
+// to the application in turn without anything being read from the destination
+type pendingRequest struct {
+	req       *http.Request
+	synthetic *http.Response
+	upgrade   bool // Connection: Upgrade, nothing else is read until the response is known
+	start     time.Time
+	received  *countingBody
+}
+
 func Http_gateway(ingress, egress net.Conn, c *AITransaction) error {
 	// gatewayFunc(input from the application, A destination, the configuration)
+	h := &httpRelay{
+		ingress:  ingress,
+		egress:   egress,
+		c:        c,
+		peer:     peerOf(egress),
+		client:   bufio.NewReader(ingress),
+		server:   bufio.NewReader(egress),
+		pending:  make(chan *pendingRequest, maxPipelined),
+		done:     make(chan struct{}),
+		upgraded: make(chan bool, 1),
+	}
+	h.credentialHeader, h.credentialValue = credentialOf(egress)
+	go h.requests()
+	defer close(h.done)
+	return h.responses()
+}
 
-	go func() {
-		for {
-			reader := bufio.NewReader(ingress)
-			req, err := http.ReadRequest(reader) // the request is where we aim to do our parsing!
-			if err != nil {
-				if err == io.EOF {
-					return
-				}
-				slog.Error("reading request", "err", err)
-				continue
-				//return
-			}
-			//  fmt.Println(req)
+// queue adds a request to the pending requests, false means the responses have stopped being read
+func (h *httpRelay) queue(p *pendingRequest) bool {
+	select {
+	case h.pending <- p:
+		return true
+	case <-h.done:
+		return false
+	}
+}
 
-			request := c.GetRequest()
-			if request != nil {
+// requests reads requests from the application, applies the request policy and forwards them
+func (h *httpRelay) requests() {
+	defer close(h.pending)
+	defer closeWrite(h.egress) // Let the destination know there won't be any more requests
 
-				block, resp, err := c.openAIRequest(req)
-				if err != nil {
-					slog.Error("parse openAI request", "err", err)
-					continue
-				}
-				if block {
-					err = resp.Write(ingress)
-					if err != nil {
-						slog.Error("writing blocking request", "err", err)
-					}
-					if c.Request.Debug {
-						b, _ := httputil.DumpResponse(resp, true)
-						fmt.Println(string(b))
-					}
-					slog.Info("block request", "dest", ingress.RemoteAddr().String())
-					continue
-				}
+	for {
+		req, err := http.ReadRequest(h.client) // the request is where we aim to do our parsing!
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				slog.Error("reading request", "err", err)
 			}
+			return
+		}
+		start := time.Now()
+		var received *countingBody
+		req.Body, received = countBody(req.Body)
 
-			err = req.Write(egress)
+		block, resp, err := h.inspectRequest(req)
+		if err != nil {
+			slog.Error("parse openAI request", "err", err)
+		}
+		if block {
+			slog.Info("block request", "dest", h.ingress.RemoteAddr().String())
+			err = discard(req.Body) // Read the rest of the request so the next one can be parsed
 			if err != nil {
-				slog.Error("data write", "err", err)
+				slog.Error("discarding blocked request", "err", err)
+				return
+			}
+			if !h.queue(&pendingRequest{req: req, synthetic: resp, start: start, received: received}) || req.Close {
 				return
 			}
+			continue
 		}
-	}()
 
-	for {
+		if h.credentialHeader != "" {
+			req.Header.Set(h.credentialHeader, h.credentialValue) // Replaces anything the application sent
+		}
+		upgrade := isUpgrade(req.Header)
+		if !h.queue(&pendingRequest{req: req, upgrade: upgrade, start: start, received: received}) {
+			return
+		}
+		w := bufio.NewWriter(h.egress)
+		if req.Body != nil && req.Body != http.NoBody {
+			// Headers have to reach the destination before we wait on the body, the application may be waiting
+			// for a 100 Continue before sending it
+			req.Body = &flushOnRead{ReadCloser: req.Body, w: w}
+		}
+		err = req.Write(w)
+		if err == nil {
+			err = w.Flush()
+		}
+		if err != nil {
+			slog.Error("data write", "err", err)
+			return
+		}
+		if req.Close {
+			return
+		}
 
-		reader := bufio.NewReader(egress)
-		res, err := http.ReadResponse(reader, nil) // problem here
-		response := c.GetResponse()
-		if response != nil {
-			if response.Debug {
-				b, _ := httputil.DumpResponse(res, true)
-				fmt.Println(string(b))
+		// Once the destination switches protocols the rest of the stream isn't HTTP
+		if upgrade {
+			select {
+			case accepted := <-h.upgraded:
+				if accepted {
+					h.relayUpgraded(h.egress, h.client, "request", req.Header.Get("Upgrade"))
+					return
+				}
+			case <-h.done:
+				return
 			}
-			body, err := io.ReadAll(res.Body)
+		}
+	}
+}
+
+// responses reads the response for each pending request, applies the response policy and writes it to the
+// application. It returns once the application stops sending requests or either side fails
+func (h *httpRelay) responses() error {
+	for p := range h.pending {
+		if p.synthetic != nil {
+			var sent *countingBody
+			p.synthetic.Body, sent = countBody(p.synthetic.Body)
+			err := h.writeResponse(p.synthetic)
 			if err != nil {
-				slog.Error("data read", "err", err)
-				if err == io.EOF {
-					return err
-				}
-				return err
+				return fmt.Errorf("Writing to local: %v", err)
 			}
-			block, err := c.openAIResponse(body, res)
-			if block {
-				slog.Info("block response", "dest", ingress.RemoteAddr().String())
+			h.accessLog(p, p.synthetic, sent, 0, accesslog.DecisionBlockedRequest)
+			if h.c.Request != nil && h.c.Request.Debug {
+				b, _ := httputil.DumpResponse(p.synthetic, true)
+				fmt.Println(string(b))
 			}
+			continue
 		}
+
+		res, err := h.readResponse(p.req)
 		if err != nil {
 			return fmt.Errorf("Failed reading from remote: %v", err)
 		}
-		err = res.Write(ingress)
+		upstream := time.Since(p.start)
+		if p.upgrade {
+			if res.StatusCode == http.StatusSwitchingProtocols {
+				h.accessLog(p, res, &countingBody{}, upstream, accesslog.DecisionAllowed)
+				return h.switchProtocols(p.req, res)
+			}
+			h.upgraded <- false // Refused, the connection carries on as HTTP
+		}
+
+		block, err := h.inspectResponse(res)
+		if err != nil {
+			slog.Error("parse openAI response", "err", err)
+		}
+		decision := accesslog.DecisionAllowed
+		if block {
+			slog.Info("block response", "dest", h.ingress.RemoteAddr().String())
+			decision = accesslog.DecisionBlockedResponse
+		}
+
+		stream, _ := res.Body.(*sseFilter)
+		var sent *countingBody
+		res.Body, sent = countBody(res.Body)
+		err = h.writeResponse(res)
+		res.Body.Close()
 		if err != nil {
 			return fmt.Errorf("Writing to local: %v", err)
 		}
+		if stream != nil && stream.terminated {
+			decision = accesslog.DecisionBlockedResponse
+		} else if stream != nil && stream.masked != 0 {
+			decision = accesslog.DecisionMaskedResponse
+		}
+		h.accessLog(p, res, sent, upstream, decision)
+		if res.Close || (stream != nil && stream.terminated) {
+			return nil // The destination was closed part way through the terminated stream
+		}
+	}
+	return nil
+}
+
+// switchProtocols forwards the 101 and copies the upgraded stream as is in both directions
+func (h *httpRelay) switchProtocols(req *http.Request, res *http.Response) error {
+	protocol := res.Header.Get("Upgrade")
+	slog.Info("protocol upgrade", "dest", h.ingress.RemoteAddr().String(), "protocol", protocol, "path", req.URL.Path)
+	err := h.writeResponse(res)
+	if err != nil {
+		return fmt.Errorf("Writing to local: %v", err)
+	}
+	h.upgraded <- true // The request loop is waiting for this, it copies the application's side
+	h.relayUpgraded(h.ingress, h.server, "response", protocol)
+	closeWrite(h.ingress)
+	return nil
+}
+
+// relayUpgraded copies an upgraded stream, starting with anything left in the reader's buffer
+func (h *httpRelay) relayUpgraded(dst net.Conn, src *bufio.Reader, direction, protocol string) {
+	var r io.Reader = src
+	if strings.EqualFold(protocol, "websocket") && h.c.GetWebSocket() != nil && h.c.WebSocket.Debug {
+		r = io.TeeReader(src, &websocketLogger{direction: direction, dest: h.ingress.RemoteAddr().String()})
+	}
+	_, err := io.Copy(dst, r)
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		slog.Error("copying upgraded stream", "direction", direction, "err", err)
+	}
+}
+
+// isUpgrade is true for requests that ask to switch protocols (WebSockets, h2c)
+func isUpgrade(header http.Header) bool {
+	if header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, value := range header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// readResponse reads the final response to a request, informational responses (100 Continue) are passed
+// straight to the application
+func (h *httpRelay) readResponse(req *http.Request) (*http.Response, error) {
+	for {
+		res, err := http.ReadResponse(h.server, req)
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode >= 100 && res.StatusCode < 200 && res.StatusCode != http.StatusSwitchingProtocols {
+			err = h.writeResponse(res)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		return res, nil
+	}
+}
+
+func (h *httpRelay) writeResponse(res *http.Response) error {
+	h.clientMu.Lock()
+	defer h.clientMu.Unlock()
+	return res.Write(h.ingress)
+}
+
+// inspectRequest applies the request policy, the body is only read when there is a policy to apply
+func (h *httpRelay) inspectRequest(req *http.Request) (block bool, res *http.Response, err error) {
+	if h.c.GetRequest() == nil || req.Body == http.NoBody {
+		return false, nil, nil
+	}
+
+	// We need the body before the destination sees the request, so answer the 100 Continue ourselves
+	if strings.EqualFold(req.Header.Get("Expect"), "100-continue") {
+		req.Header.Del("Expect")
+		h.clientMu.Lock()
+		_, err = io.WriteString(h.ingress, "HTTP/1.1 100 Continue\r\n\r\n")
+		h.clientMu.Unlock()
+		if err != nil {
+			return false, nil, err
+		}
+	}
+
+	body, complete, err := bufferBody(req.Body)
+	if err != nil {
+		return false, nil, err
+	}
+	if !complete {
+		req.Body = body
+		if !h.c.GetRequest().inspectsBody() {
+			slog.Warn("request body too large to inspect", "limit", maxInspectedBody)
+			return false, nil, nil
+		}
+		slog.Warn("request body too large to inspect, refusing it", "limit", maxInspectedBody, "host", req.Host, "path", req.URL.Path)
+		req.Close = true // The rest of the body is discarded, there is no point reading another request after it
+		return true, bodyTooLarge(req, http.StatusRequestEntityTooLarge, "request"), nil
+	}
+	buffered, _ := io.ReadAll(body)
+
+	req.Body = io.NopCloser(bytes.NewReader(buffered))
+	block, res, err = h.c.openAIRequest(req)
+	if err != nil {
+		// Not a request we understand, send it on as it was
+		req.Body = io.NopCloser(bytes.NewReader(buffered))
+		return false, nil, err
+	}
+	if !block {
+		sendBuffered(req.Header, &req.TransferEncoding, &req.ContentLength, req.Trailer)
+	}
+	return block, res, nil
+}
+
+// inspectResponse applies the response policy, the body is only read when there is a policy to apply or it is a
+// chat completion whose token usage is counted
+func (h *httpRelay) inspectResponse(res *http.Response) (block bool, err error) {
+	response := h.c.GetResponse()
+	usage := isChatCompletion(res.Request) && res.StatusCode < 300
+	if (response == nil && !usage) || res.Body == http.NoBody {
+		return false, nil
+	}
+
+	// Streams are filtered event by event as they are passed on, rather than buffered
+	if isEventStream(res.Header) {
+		if response != nil && response.Debug {
+			b, _ := httputil.DumpResponse(res, false)
+			fmt.Println(string(b))
+		}
+		if usage || len(response.BannedWords) != 0 {
+			res.Body = newSSEFilter(res.Body, h.c, res.Request, func() { h.egress.Close() }, h.ingress.RemoteAddr().String())
+			if res.ContentLength >= 0 {
+				// The filtered stream may be a different length
+				res.ContentLength = -1
+				res.TransferEncoding = []string{"chunked"}
+				res.Header.Del("Content-Length")
+			}
+		}
+		return false, nil
+	}
+
+	body, complete, err := bufferBody(res.Body)
+	if err != nil {
+		return false, err
+	}
+	if !complete {
+		if !response.inspectsBody() {
+			slog.Warn("response body too large to inspect", "limit", maxInspectedBody)
+			res.Body = body
+			return false, nil
+		}
+		slog.Warn("response body too large to inspect, refusing it", "limit", maxInspectedBody, "host", res.Request.Host, "path", res.Request.URL.Path)
+		body.Close()
+		// The rest of the destination's response is never read, so the connection can't be used again
+		*res = *bodyTooLarge(res.Request, http.StatusBadGateway, "response")
+		return true, nil
+	}
+	buffered, _ := io.ReadAll(body)
+	res.Body = io.NopCloser(bytes.NewReader(buffered))
+
+	if response != nil && response.Debug {
+		b, _ := httputil.DumpResponse(res, true)
+		fmt.Println(string(b))
+	}
+
+	block, err = h.c.openAIResponse(buffered, res)
+	if err != nil {
+		res.Body = io.NopCloser(bytes.NewReader(buffered))
+		return false, err
+	}
+	if response == nil {
+		res.Body = io.NopCloser(bytes.NewReader(buffered)) // Passed on as it was
+		return false, nil
+	}
+	sendBuffered(res.Header, &res.TransferEncoding, &res.ContentLength, res.Trailer)
+	return block, nil
+}
+
+// bufferBody reads up to maxInspectedBody of a body. complete is false if the body is larger, the returned body
+// still holds everything that was read followed by the rest of the original body
+func bufferBody(body io.ReadCloser) (io.ReadCloser, bool, error) {
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, io.LimitReader(body, maxInspectedBody+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if n > maxInspectedBody {
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(&buf, body), body}, false, nil
+	}
+	return io.NopCloser(&buf), true, nil
+}
+
+// bodyTooLarge is the gateway's response in place of a message whose body is too large for the policy to inspect,
+// the connection is closed after it
+func bodyTooLarge(req *http.Request, status int, message string) *http.Response {
+	body, _ := json.Marshal(map[string]any{
+		"error": map[string]any{
+			"message": fmt.Sprintf("The %s body is larger than the %d bytes kube-gateway can inspect", message, maxInspectedBody),
+			"type":    "invalid_request_error",
+			"param":   nil,
+			"code":    "body_too_large",
+		},
+	})
+	res := syntheticResponse(req, status, body)
+	res.Close = true
+	return res
+}
+
+// sendBuffered switches a message whose body was replaced to a Content-Length, the body has already been set
+// by the policy. Messages with trailers stay chunked as trailers can only be sent with chunked encoding
+func sendBuffered(header http.Header, transferEncoding *[]string, contentLength *int64, trailer http.Header) {
+	if len(trailer) != 0 {
+		*transferEncoding = []string{"chunked"}
+		*contentLength = -1
+		return
+	}
+	*transferEncoding = nil
+	header.Del("Content-Length") // Written from contentLength
+}
+
+// flushOnRead flushes the request headers the first time the body is read
+type flushOnRead struct {
+	io.ReadCloser
+	w       *bufio.Writer
+	flushed bool
+}
+
+func (f *flushOnRead) Read(p []byte) (int, error) {
+	if !f.flushed {
+		f.flushed = true
+		err := f.w.Flush()
+		if err != nil {
+			return 0, err
+		}
+	}
+	return f.ReadCloser.Read(p)
+}
+
+func discard(body io.ReadCloser) error {
+	if body == nil {
+		return nil
+	}
+	_, err := io.Copy(io.Discard, body)
+	body.Close()
+	return err
+}
+
+// closeWrite half-closes a connection where the connection type supports it
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
 	}
 }
 
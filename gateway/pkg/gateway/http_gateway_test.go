@@ -0,0 +1,775 @@
+package gateway
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gateway/pkg/accesslog"
+
+	"github.com/openai/openai-go"
+)
+
+// relay starts Http_gateway between a client connection and the server, returning the client's end
+func relay(t *testing.T, server *httptest.Server, c *AITransaction) (net.Conn, <-chan error) {
+	t.Helper()
+	return relayWith(t, server, c, Http_gateway)
+}
+
+func relayWith(t *testing.T, server *httptest.Server, c *AITransaction, gatewayFunc func(net.Conn, net.Conn, *AITransaction) error) (net.Conn, <-chan error) {
+	t.Helper()
+	egress, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ingress, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- gatewayFunc(ingress, egress, c)
+		ingress.Close()
+		egress.Close()
+	}()
+	t.Cleanup(func() { client.Close() })
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	return client, done
+}
+
+func readBody(t *testing.T, res *http.Response) string {
+	t.Helper()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func echoPath(w http.ResponseWriter, r *http.Request) {
+	io.Copy(io.Discard, r.Body)
+	fmt.Fprintf(w, "path=%s", r.URL.Path)
+}
+
+func TestHttpGatewayKeepAlive(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(echoPath))
+	defer server.Close()
+	client, _ := relay(t, server, &AITransaction{})
+	reader := bufio.NewReader(client)
+
+	for _, path := range []string{"/one", "/two", "/three"} {
+		fmt.Fprintf(client, "GET %s HTTP/1.1\r\nHost: test\r\n\r\n", path)
+		res, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := readBody(t, res); got != "path="+path {
+			t.Fatalf("expected path=%s, got %q", path, got)
+		}
+	}
+}
+
+func TestHttpGatewayPipelining(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(echoPath))
+	defer server.Close()
+	client, _ := relay(t, server, &AITransaction{})
+
+	// All requests are written before any response is read
+	_, err := io.WriteString(client, "GET /a HTTP/1.1\r\nHost: test\r\n\r\n"+
+		"POST /b HTTP/1.1\r\nHost: test\r\nContent-Length: 5\r\n\r\nhello"+
+		"GET /c HTTP/1.1\r\nHost: test\r\n\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(client)
+	for _, path := range []string{"/a", "/b", "/c"} {
+		res, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := readBody(t, res); got != "path="+path {
+			t.Fatalf("expected path=%s, got %q", path, got)
+		}
+	}
+}
+
+func TestHttpGatewayChunkedTrailers(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Trailer", "X-Checksum")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "body=%s", body)
+		w.(http.Flusher).Flush() // Forces a chunked response
+		w.Header().Set("X-Checksum", r.Trailer.Get("X-Request-Checksum"))
+	}))
+	defer server.Close()
+
+	for _, c := range []*AITransaction{{}, {Request: &Request{}, Response: &Response{}}} {
+		client, _ := relay(t, server, c)
+		_, err := io.WriteString(client, "POST / HTTP/1.1\r\nHost: test\r\nTransfer-Encoding: chunked\r\nTrailer: X-Request-Checksum\r\n\r\n"+
+			"5\r\nhello\r\n6\r\n world\r\n0\r\nX-Request-Checksum: abc123\r\n\r\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.ReadResponse(bufio.NewReader(client), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := readBody(t, res); got != "body=hello world" {
+			t.Fatalf("expected the chunked body to be relayed, got %q", got)
+		}
+		if got := res.Trailer.Get("X-Checksum"); got != "abc123" {
+			t.Fatalf("expected trailers to be relayed in both directions, got %q", got)
+		}
+	}
+}
+
+func TestHttpGatewayExpectContinue(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "body=%s", body)
+	}))
+	defer server.Close()
+
+	// Without a policy the destination sends the 100 Continue, with one the gateway does
+	for _, c := range []*AITransaction{{}, {Request: &Request{}}} {
+		client, _ := relay(t, server, c)
+		reader := bufio.NewReader(client)
+		_, err := io.WriteString(client, "POST / HTTP/1.1\r\nHost: test\r\nContent-Length: 4\r\nExpect: 100-continue\r\n\r\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusContinue {
+			t.Fatalf("expected 100 Continue before sending the body, got %d", res.StatusCode)
+		}
+		io.WriteString(client, "data")
+		res, err = http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := readBody(t, res); got != "body=data" {
+			t.Fatalf("expected body=data, got %q", got)
+		}
+	}
+}
+
+func TestHttpGatewayBlockedRequest(t *testing.T) {
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		echoPath(w, r)
+	}))
+	defer server.Close()
+	client, _ := relay(t, server, &AITransaction{Request: &Request{Block: true}})
+
+	body := `{"model":"llama3","messages":[{"role":"user","content":"hi"}]}`
+	fmt.Fprintf(client, "POST /v1/chat/completions HTTP/1.1\r\nHost: test\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+	fmt.Fprintf(client, "GET /after HTTP/1.1\r\nHost: test\r\n\r\n")
+
+	reader := bufio.NewReader(client)
+	res, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chat openai.ChatCompletion
+	err = json.Unmarshal([]byte(readBody(t, res)), &chat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chat.Choices) != 1 || chat.Choices[0].Message.Content != "kube-gateway says no" {
+		t.Fatalf("expected the blocked response, got %+v", chat.Choices)
+	}
+
+	// The connection carries on with the next request in order
+	res, err = http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readBody(t, res); got != "path=/after" {
+		t.Fatalf("expected path=/after, got %q", got)
+	}
+	if hits.Load() != 1 {
+		t.Fatalf("expected only the unblocked request to reach the server, got %d", hits.Load())
+	}
+}
+
+func TestHttpGatewayMaxTokens(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body) // The request as the destination saw it
+	}))
+	defer server.Close()
+
+	for _, test := range []struct {
+		mode, request, expected string
+		status                  int
+	}{
+		{"clamp", `,"max_tokens":500`, `"max_tokens":50`, http.StatusOK},
+		{"clamp", `,"max_completion_tokens":20`, `"max_completion_tokens":20`, http.StatusOK},
+		{"clamp", ``, `"max_completion_tokens":50`, http.StatusOK}, // No limit supplied
+		{"clamp", `,"stream":false`, `"max_completion_tokens":50`, http.StatusOK},
+		{"reject", `,"max_completion_tokens":500`, `"code":"max_tokens_exceeded"`, http.StatusBadRequest},
+	} {
+		c := &AITransaction{}
+		err := c.Load([]byte(fmt.Sprintf(`{"request":{"maxTokens":"50","maxTokensMode":%q}}`, test.mode)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, _ := relay(t, server, c)
+		body := fmt.Sprintf(`{"model":"llama3","messages":[{"role":"user","content":"hi"}]%s}`, test.request)
+		fmt.Fprintf(client, "POST /v1/chat/completions HTTP/1.1\r\nHost: test\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+		res, err := http.ReadResponse(bufio.NewReader(client), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := readBody(t, res)
+		if res.StatusCode != test.status || !strings.Contains(got, test.expected) {
+			t.Errorf("%s %s: expected %d with %s, got %d %s", test.mode, test.request, test.status, test.expected, res.StatusCode, got)
+		}
+		if test.request == "" && strings.Contains(got, `"max_tokens"`) {
+			t.Errorf("expected only max_completion_tokens to be added, got %s", got)
+		}
+	}
+
+	if err := (&AITransaction{}).Load([]byte(`{"request":{"maxTokens":"fifty"}}`)); err == nil {
+		t.Fatal("expected an invalid maxTokens to be refused")
+	}
+}
+
+func TestHttpGatewayPromptReplace(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body) // The request as the destination saw it
+	}))
+	defer server.Close()
+
+	for _, test := range []struct {
+		rule, prompt, expected string
+	}{
+		{`{"orig":"joke","new":"fact"}`, "Tell me a JOKE", "Tell me a fact"},
+		{`{"orig":"joke","new":"fact","caseSensitive":true}`, "Tell me a JOKE", "Tell me a JOKE"},
+		{`{"orig":"cat","new":"dog","wholeWord":true}`, "cat concatenate Cat", "dog concatenate dog"},
+		{`{"orig":"Go.","new":"horse","wholeWord":true}`, "I like Go. Go.Go", "I like horse horseGo"},
+		{`{"orig":"(\\w+)@example\\.com","new":"$1@redacted","regex":true}`, "mail bob@example.com", "mail bob@redacted"},
+		{`{"orig":"$1","new":"one"}`, "costs $1", "costs one"},
+	} {
+		c := &AITransaction{}
+		err := c.Load([]byte(fmt.Sprintf(`{"request":{"userPromptReplace":[%s]}}`, test.rule)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, _ := relay(t, server, c)
+		body := fmt.Sprintf(`{"model":"llama3","messages":[{"role":"user","content":%q}]}`, test.prompt)
+		fmt.Fprintf(client, "POST /v1/chat/completions HTTP/1.1\r\nHost: test\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+		res, err := http.ReadResponse(bufio.NewReader(client), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var chat struct {
+			Messages []struct {
+				Content string `json:"content"`
+			} `json:"messages"`
+		}
+		err = json.Unmarshal([]byte(readBody(t, res)), &chat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(chat.Messages) != 1 || chat.Messages[0].Content != test.expected {
+			t.Errorf("%s on %q: expected %q, got %+v", test.rule, test.prompt, test.expected, chat.Messages)
+		}
+	}
+
+	if err := (&AITransaction{}).Load([]byte(`{"request":{"userPromptReplace":[{"orig":"(","regex":true}]}}`)); err == nil {
+		t.Fatal("expected an invalid regex to be refused")
+	}
+}
+
+func TestHttpGatewayQuota(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"id":"1","object":"chat.completion","model":"llama3","choices":[{"index":0,"message":{"role":"assistant","content":"hello"},"finish_reason":"stop"}],"usage":{"prompt_tokens":10,"completion_tokens":15,"total_tokens":25}}`)
+	}))
+	defer server.Close()
+
+	c := &AITransaction{}
+	policy := []byte(`{"request":{"quota":{"total":50}}}`)
+	if err := c.Load(policy); err != nil {
+		t.Fatal(err)
+	}
+	client, _ := relay(t, server, c)
+	reader := bufio.NewReader(client)
+	body := `{"model":"llama3","messages":[{"role":"user","content":"hi"}]}`
+	for x, status := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		if x == 2 {
+			// The tokens used so far aren't forgotten when the policy is reloaded
+			if err := c.Load(policy); err != nil {
+				t.Fatal(err)
+			}
+		}
+		fmt.Fprintf(client, "POST /v1/chat/completions HTTP/1.1\r\nHost: test\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+		res, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := readBody(t, res)
+		if res.StatusCode != status {
+			t.Fatalf("request %d: expected %d, got %d %s", x, status, res.StatusCode, got)
+		}
+		if status == http.StatusTooManyRequests && !strings.Contains(got, `"code":"quota_exceeded"`) {
+			t.Fatalf("expected a quota error, got %s", got)
+		}
+	}
+	if count := c.TokenCount.endpoints[endpointToken{endpoint: "test", model: "llama3"}]; count == nil || count.prompt != 20 || count.completion != 30 {
+		t.Fatalf("expected 20 prompt and 30 completion tokens, got %+v", count)
+	}
+
+	if err := (&AITransaction{}).Load([]byte(`{"request":{"quota":{"daily":-1}}}`)); err == nil {
+		t.Fatal("expected a negative quota to be refused")
+	}
+}
+
+func TestHttpGatewayStreamUsage(t *testing.T) {
+	usage := "data: {\"id\":\"1\",\"object\":\"chat.completion.chunk\",\"created\":1,\"model\":\"llama3\",\"choices\":[],\"usage\":{\"prompt_tokens\":7,\"completion_tokens\":3,\"total_tokens\":10}}\n\n"
+	next := make(chan struct{}, 3)
+	server := streamServer(t, []string{streamChunk("hello", "null"), streamChunk(" world", `"stop"`), usage}, next)
+	c := &AITransaction{}
+	client, _ := relay(t, server, c)
+
+	// Without a response policy the stream is only read for the usage
+	fmt.Fprintf(client, "GET /v1/chat/completions HTTP/1.1\r\nHost: test\r\n\r\n")
+	res, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, finish := readStream(t, res.Body, func() { next <- struct{}{} })
+	if strings.Join(content, "") != "hello world" || finish != "stop" {
+		t.Fatalf("expected the stream to be passed on, got %q %q", content, finish)
+	}
+	c.TokenCount.mu.Lock()
+	defer c.TokenCount.mu.Unlock()
+	if c.TokenCount.total != 10 {
+		t.Fatalf("expected 10 tokens to be counted, got %d", c.TokenCount.total)
+	}
+}
+
+func TestHttpGatewayStreamUsageRequested(t *testing.T) {
+	usage := "data: {\"id\":\"1\",\"object\":\"chat.completion.chunk\",\"created\":1,\"model\":\"llama3\",\"choices\":[],\"usage\":{\"prompt_tokens\":7,\"completion_tokens\":3,\"total_tokens\":10}}\n\n"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var chat struct {
+			Stream        bool `json:"stream"`
+			StreamOptions struct {
+				IncludeUsage bool `json:"include_usage"`
+			} `json:"stream_options"`
+		}
+		json.NewDecoder(r.Body).Decode(&chat)
+		w.Header().Set("Content-Type", "text/event-stream")
+		if chat.Stream && chat.StreamOptions.IncludeUsage {
+			// As OpenAI does, every chunk has a usage field that is null until the last one
+			io.WriteString(w, strings.Replace(streamChunk("hello", `"stop"`), "}]}", `}],"usage":null}`, 1))
+			io.WriteString(w, usage)
+		} else {
+			io.WriteString(w, streamChunk("hello", `"stop"`))
+		}
+		io.WriteString(w, "data: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	for _, test := range []struct {
+		options string
+		chunk   bool // The application sees the usage chunk
+	}{
+		{``, false},
+		{`,"stream_options":{"include_usage":false}`, false},
+		{`,"stream_options":{"include_usage":true}`, true},
+	} {
+		c := &AITransaction{}
+		if err := c.Load([]byte(`{"request":{"quota":{"total":1000}}}`)); err != nil {
+			t.Fatal(err)
+		}
+		client, _ := relay(t, server, c)
+		body := fmt.Sprintf(`{"model":"llama3","messages":[{"role":"user","content":"hi"}],"stream":true%s}`, test.options)
+		fmt.Fprintf(client, "POST /v1/chat/completions HTTP/1.1\r\nHost: test\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+		res, err := http.ReadResponse(bufio.NewReader(client), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := readBody(t, res)
+		if !strings.Contains(got, "hello") || !strings.HasSuffix(got, "data: [DONE]\n\n") {
+			t.Fatalf("%s: expected the stream to be passed on, got %q", test.options, got)
+		}
+		if strings.Contains(got, `"prompt_tokens":7`) != test.chunk {
+			t.Errorf("%s: expected the usage chunk to be passed on %v, got %q", test.options, test.chunk, got)
+		}
+		if strings.Contains(got, `"usage":null`) != test.chunk {
+			t.Errorf("%s: expected the usage field to be passed on %v, got %q", test.options, test.chunk, got)
+		}
+		c.TokenCount.mu.Lock()
+		total := c.TokenCount.total
+		c.TokenCount.mu.Unlock()
+		if total != 10 {
+			t.Errorf("%s: expected 10 tokens to be counted, got %d", test.options, total)
+		}
+	}
+}
+
+func TestHttpGatewayBannedWords(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"id":"1","object":"chat.completion","model":"llama3","choices":[{"index":0,"message":{"role":"assistant","content":"the secret is 42"},"finish_reason":"stop"}]}`)
+	}))
+	defer server.Close()
+	client, _ := relay(t, server, &AITransaction{Response: &Response{BannedWords: []string{"secret"}}})
+
+	fmt.Fprintf(client, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+	res, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := readBody(t, res)
+	if strings.Contains(body, "secret") || !strings.Contains(body, "kube-gateway says no") {
+		t.Fatalf("expected the response to be replaced, got %q", body)
+	}
+	if res.ContentLength != int64(len(body)) {
+		t.Fatalf("expected Content-Length %d to match the new body, got %d", len(body), res.ContentLength)
+	}
+}
+
+// streamChunk is a chat completion chunk as an SSE event, finish is the JSON finish reason
+func streamChunk(content, finish string) string {
+	return fmt.Sprintf("data: {\"id\":\"1\",\"object\":\"chat.completion.chunk\",\"created\":1,\"model\":\"llama3\",\"choices\":[{\"index\":0,\"delta\":{\"content\":%q},\"finish_reason\":%s}]}\n\n", content, finish)
+}
+
+// streamServer sends each chunk once the previous one has been read by the application
+func streamServer(t *testing.T, chunks []string, next <-chan struct{}) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for x, chunk := range chunks {
+			if x != 0 {
+				select {
+				case <-next:
+				case <-r.Context().Done():
+					return
+				}
+			}
+			io.WriteString(w, chunk)
+			w.(http.Flusher).Flush()
+		}
+		io.WriteString(w, "data: [DONE]\n\n")
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// readStream reads the content and finish reason of each chunk, calling read after each event
+func readStream(t *testing.T, body io.Reader, read func()) (content []string, finish string) {
+	t.Helper()
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		if data == "[DONE]" {
+			return content, finish
+		}
+		var chunk openai.ChatCompletionChunk
+		err := json.Unmarshal([]byte(data), &chunk)
+		if err != nil {
+			t.Fatalf("invalid chunk %q: %v", data, err)
+		}
+		for _, choice := range chunk.Choices {
+			content = append(content, choice.Delta.Content)
+			if choice.FinishReason != "" {
+				finish = choice.FinishReason
+			}
+		}
+		read()
+	}
+	t.Fatalf("stream ended without [DONE]: %v", scanner.Err())
+	return nil, ""
+}
+
+func TestHttpGatewayStreamTerminated(t *testing.T) {
+	next := make(chan struct{}, 4)
+	server := streamServer(t, []string{streamChunk("a white rab", "null"), streamChunk("bit appears", "null"), streamChunk(" again", "\"stop\"")}, next)
+	client, done := relay(t, server, &AITransaction{Response: &Response{BannedWords: []string{"rabbit"}}})
+
+	fmt.Fprintf(client, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+	res, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, finish := readStream(t, res.Body, func() { next <- struct{}{} })
+	got := strings.Join(content, "")
+	if strings.Contains(got, "rab") || !strings.HasSuffix(got, "kube-gateway says no") || finish != "content_filter" {
+		t.Fatalf("expected the stream to be terminated before the banned word, got %q (%s)", got, finish)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHttpGatewayStreamMasked(t *testing.T) {
+	next := make(chan struct{}, 4)
+	server := streamServer(t, []string{streamChunk("a white rab", "null"), streamChunk("bit appears", "null"), streamChunk("", "\"stop\"")}, next)
+	client, _ := relay(t, server, &AITransaction{Response: &Response{BannedWords: []string{"rabbit"}, StreamAction: StreamMask}})
+
+	fmt.Fprintf(client, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+	res, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each chunk has to reach the application before the next one is sent
+	content, finish := readStream(t, res.Body, func() { next <- struct{}{} })
+	if got := strings.Join(content, ""); got != "a white ****** appears" || finish != "stop" {
+		t.Fatalf("expected the banned word to be masked, got %q (%s)", got, finish)
+	}
+	if content[0] == "" {
+		t.Fatal("expected the start of the first chunk to be sent straight away")
+	}
+}
+
+func TestHttpGatewayLargeBodyNotBuffered(t *testing.T) {
+	defer func(limit int64) { maxInspectedBody = limit }(maxInspectedBody)
+	maxInspectedBody = 16
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer server.Close()
+	// Only the token usage is read from chat completions, which isn't a reason to refuse them
+	client, _ := relay(t, server, &AITransaction{Request: &Request{Debug: true}})
+
+	body := strings.Repeat("x", 1000)
+	fmt.Fprintf(client, "POST /v1/chat/completions HTTP/1.1\r\nHost: test\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+	res, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readBody(t, res); got != body {
+		t.Fatalf("expected the large body to pass through untouched, got %d bytes", len(got))
+	}
+}
+
+func TestHttpGatewayLargeBodyRefused(t *testing.T) {
+	defer func(limit int64) { maxInspectedBody = limit }(maxInspectedBody)
+	maxInspectedBody = 16
+
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		io.WriteString(w, strings.Repeat("y", 1000))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		c      *AITransaction
+		body   string
+		status int
+	}{
+		{"request", &AITransaction{Request: &Request{ModelReplace: []ModelReplace{{Orig: "a", New: "b"}}}}, strings.Repeat("x", 1000), http.StatusRequestEntityTooLarge},
+		{"response", &AITransaction{Response: &Response{BannedWords: []string{"x"}}}, "{}", http.StatusBadGateway},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requests.Store(0)
+			client, _ := relay(t, server, test.c)
+			fmt.Fprintf(client, "POST / HTTP/1.1\r\nHost: test\r\nContent-Length: %d\r\n\r\n%s", len(test.body), test.body)
+			res, err := http.ReadResponse(bufio.NewReader(client), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body := readBody(t, res)
+			if res.StatusCode != test.status || !res.Close || !strings.Contains(body, "body_too_large") {
+				t.Fatalf("expected a %d that closes the connection, got %d %q", test.status, res.StatusCode, body)
+			}
+			if test.status == http.StatusRequestEntityTooLarge && requests.Load() != 0 {
+				t.Fatal("expected the request not to reach the destination")
+			}
+		})
+	}
+}
+
+func TestHttpGatewayNotHTTP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(echoPath))
+	defer server.Close()
+	client, done := relay(t, server, &AITransaction{})
+
+	io.WriteString(client, "\x00\x01\x02 this isn't http\r\n\r\n")
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the gateway to give up on a stream that isn't HTTP")
+	}
+}
+
+// upgradeEcho switches to an echo protocol after answering an upgrade with a 101
+func upgradeEcho(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Upgrade") != "echo" {
+		http.Error(w, "upgrade required", http.StatusBadRequest)
+		return
+	}
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	rw.Flush()
+	io.Copy(conn, rw)
+}
+
+func TestHttpGatewayUpgrade(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(upgradeEcho))
+	defer server.Close()
+	client, _ := relay(t, server, &AITransaction{WebSocket: &WebSocket{Debug: true}})
+	reader := bufio.NewReader(client)
+
+	// The first bytes of the new protocol arrive with the request, they mustn't be parsed as HTTP
+	fmt.Fprintf(client, "GET /stream HTTP/1.1\r\nHost: test\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\nhello ")
+	res, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected 101, got %d", res.StatusCode)
+	}
+	fmt.Fprintf(client, "GET / HTTP/1.1\r\n\r\n")
+	expected := "hello GET / HTTP/1.1\r\n\r\n"
+	got := make([]byte, len(expected))
+	if _, err := io.ReadFull(reader, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != expected {
+		t.Fatalf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestHttpGatewayUpgradeRefused(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(upgradeEcho))
+	defer server.Close()
+	client, _ := relay(t, server, &AITransaction{})
+	reader := bufio.NewReader(client)
+
+	fmt.Fprintf(client, "GET /stream HTTP/1.1\r\nHost: test\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+	res, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, res)
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", res.StatusCode)
+	}
+
+	// The connection carries on as HTTP
+	fmt.Fprintf(client, "GET /next HTTP/1.1\r\nHost: test\r\n\r\n")
+	res, err = http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", res.StatusCode)
+	}
+}
+
+func TestWebSocketLogger(t *testing.T) {
+	w := &websocketLogger{direction: "request"}
+	// Masked text frame with a 16 bit length, split across writes, followed by a ping
+	frame := []byte{0x81, 0xfe, 0x01, 0x00, 1, 2, 3, 4}
+	frame = append(frame, make([]byte, 256)...)
+	frame = append(frame, 0x89, 0x00)
+	w.Write(frame[:3])
+	w.Write(frame[3:100])
+	w.Write(frame[100:])
+	if w.remaining != 0 || len(w.header) != 0 {
+		t.Fatalf("expected to be between frames, %d bytes remaining and %d header bytes", w.remaining, len(w.header))
+	}
+}
+
+func TestHttpGatewayAccessLog(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(echoPath))
+	defer server.Close()
+	path := filepath.Join(t.TempDir(), "access.log")
+	// Allowed requests are never sampled, blocked ones are always logged
+	logger, err := accesslog.New(accesslog.Config{Output: path, Format: accesslog.FormatJSON, Sample: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, done := relay(t, server, &AITransaction{Request: &Request{Block: true}, AccessLog: logger})
+
+	body := `{"model":"llama3","messages":[{"role":"user","content":"hi"}]}`
+	fmt.Fprintf(client, "POST /v1/chat/completions HTTP/1.1\r\nHost: model\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+	fmt.Fprintf(client, "GET /allowed HTTP/1.1\r\nHost: model\r\nConnection: close\r\n\r\n")
+	io.Copy(io.Discard, client)
+	<-done
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected only the blocked request to be logged, got %q", lines)
+	}
+	var entry accesslog.Entry
+	err = json.Unmarshal([]byte(lines[0]), &entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Method != "POST" || entry.Host != "model" || entry.Path != "/v1/chat/completions" || entry.Status != http.StatusOK ||
+		entry.RequestBytes != int64(len(body)) || entry.ResponseBytes == 0 || entry.Decision != accesslog.DecisionBlockedRequest {
+		t.Fatalf("unexpected entry %+v", entry)
+	}
+}
+
+// withCredential runs a gateway as the egress proxy does, with the credential carried by the connection
+func withCredential(gatewayFunc func(net.Conn, net.Conn, *AITransaction) error) func(net.Conn, net.Conn, *AITransaction) error {
+	return func(ingress, egress net.Conn, c *AITransaction) error {
+		return gatewayFunc(ingress, &CredentialConn{Conn: egress, Header: "Authorization", Value: "Bearer secret"}, c)
+	}
+}
+
+func TestHttpGatewayCredential(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Values("Authorization"))
+	}))
+	defer server.Close()
+	client, _ := relayWith(t, server, &AITransaction{}, withCredential(Http_gateway))
+	reader := bufio.NewReader(client)
+
+	// The application's own header is replaced on every request
+	for _, auth := range []string{"", "Authorization: Bearer app\r\n"} {
+		fmt.Fprintf(client, "GET / HTTP/1.1\r\nHost: test\r\n%s\r\n", auth)
+		res, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := readBody(t, res); got != "[Bearer secret]" {
+			t.Fatalf("expected the injected credential, got %q", got)
+		}
+	}
+}
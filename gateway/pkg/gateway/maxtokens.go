@@ -0,0 +1,59 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/openai/openai-go"
+	"github.com/openai/openai-go/packages/param"
+)
+
+// enforceMaxTokens applies maxTokens to a chat request, returning the error to answer with if the request is
+// rejected. Both max_tokens and max_completion_tokens are limited, a request without either is given
+// max_completion_tokens as max_tokens is deprecated and refused by reasoning models
+func (r *Request) enforceMaxTokens(chat *openai.ChatCompletionNewParams, req *http.Request) *http.Response {
+	limits := []struct {
+		field string
+		value *param.Opt[int64]
+	}{
+		{"max_tokens", &chat.MaxTokens},
+		{"max_completion_tokens", &chat.MaxCompletionTokens},
+	}
+	unset := true
+	for _, limit := range limits {
+		if !limit.value.Valid() {
+			continue
+		}
+		unset = false
+		requested := limit.value.Value
+		if requested <= r.maxTokens {
+			continue
+		}
+		if r.MaxTokensMode == MaxTokensReject {
+			slog.Info("rejecting max tokens", "field", limit.field, "requested", requested, "allowed", r.maxTokens, "model", chat.Model)
+			return maxTokensError(req, limit.field, requested, r.maxTokens)
+		}
+		slog.Info("clamping max tokens", "field", limit.field, "requested", requested, "enforced", r.maxTokens, "model", chat.Model)
+		*limit.value = openai.Int(r.maxTokens)
+	}
+	if unset {
+		slog.Info("clamping max tokens", "field", "max_completion_tokens", "requested", "unlimited", "enforced", r.maxTokens, "model", chat.Model)
+		chat.MaxCompletionTokens = openai.Int(r.maxTokens)
+	}
+	return nil
+}
+
+// maxTokensError is an OpenAI style error for a request asking for too many tokens
+func maxTokensError(req *http.Request, field string, requested, allowed int64) *http.Response {
+	body, _ := json.Marshal(map[string]any{
+		"error": map[string]any{
+			"message": fmt.Sprintf("%s of %d is more than the %d allowed by kube-gateway", field, requested, allowed),
+			"type":    "invalid_request_error",
+			"param":   field,
+			"code":    "max_tokens_exceeded",
+		},
+	})
+	return syntheticResponse(req, http.StatusBadRequest, body)
+}
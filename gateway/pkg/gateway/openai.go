@@ -2,6 +2,7 @@ package gateway
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -49,22 +50,17 @@ func (c *AITransaction) openAIRequest(req *http.Request) (block bool, res *http.
 			// Very unlikely this should ever happen
 			slog.Error("generating blocking request", "err", err)
 		}
-		r := http.Response{
-			Status:     "200 OK",
-			StatusCode: 200,
-			Proto:      "HTTP/1.1",
-			ProtoMajor: 1,
-			ProtoMinor: 1,
-			Request:    req,
-			Header:     make(http.Header),
-		}
-		r.Header.Add("Content-Type", "application/json")
-		r.Header.Add("User-Agent", "kube-gateway")
-		r.ContentLength = int64(len(newBody))
-		r.Body = io.NopCloser(bytes.NewBuffer(newBody))
-		return true, &r, nil
+		return true, syntheticResponse(req, http.StatusOK, newBody), nil
 
 	}
+	if r := c.checkQuota(req); r != nil {
+		return true, r, nil
+	}
+	if c.Request.maxTokens != 0 {
+		if r := c.Request.enforceMaxTokens(&chat, req); r != nil {
+			return true, r, nil
+		}
+	}
 	if len(c.Request.ModelReplace) != 0 {
 		for x := range c.Request.ModelReplace {
 			if chat.Model == c.Request.ModelReplace[x].Orig {
@@ -85,10 +81,7 @@ func (c *AITransaction) openAIRequest(req *http.Request) (block bool, res *http.
 			if !param.IsOmitted(chat.Messages[x].OfUser.Content.OfString) {
 				content = chat.Messages[x].OfUser.Content.OfString.Value
 				if len(c.Request.UserPromptReplace) != 0 {
-					for y := range c.Request.UserPromptReplace {
-						content = strings.ReplaceAll(content, c.Request.UserPromptReplace[y].Orig, c.Request.UserPromptReplace[y].New)
-						slog.Info("changing prompt word", "role", role, "original", c.Request.UserPromptReplace[y].Orig, "replacement", c.Request.UserPromptReplace[y].New)
-					}
+					content = replacePrompt(c.Request.UserPromptReplace, role, content)
 					chat.Messages[x].OfUser.Content.OfString.Value = content // swap the modified prompt
 				}
 			}
@@ -109,6 +102,10 @@ func (c *AITransaction) openAIRequest(req *http.Request) (block bool, res *http.
 			role = "developer"
 			if !param.IsOmitted(chat.Messages[x].OfDeveloper.Content.OfString) {
 				content = chat.Messages[x].OfDeveloper.Content.OfString.Value
+				if len(c.Request.DevPromptReplace) != 0 {
+					content = replacePrompt(c.Request.DevPromptReplace, role, content)
+					chat.Messages[x].OfDeveloper.Content.OfString.Value = content
+				}
 			}
 		case chat.Messages[x].OfTool != nil:
 			role = "tool"
@@ -120,18 +117,78 @@ func (c *AITransaction) openAIRequest(req *http.Request) (block bool, res *http.
 		//fmt.Printf("Role: %s\nContent: %s\n\n", role, content)
 	}
 
+	// Streams only report their usage when asked to, it is asked for on the application's behalf and the extra chunk
+	// is removed from the response (see sseFilter). Only HTTP/1 responses are filtered
+	if isStream(body) && req.ProtoMajor == 1 && !(chat.StreamOptions.IncludeUsage.Valid() && chat.StreamOptions.IncludeUsage.Value) {
+		chat.StreamOptions.IncludeUsage = openai.Bool(true)
+		*req = *req.WithContext(context.WithValue(req.Context(), addedUsage{}, true))
+	}
+
 	newBody, _ := json.Marshal(chat)
+	newBody = keepFields(body, newBody)
 	req.ContentLength = int64(len(newBody))
 	req.Body = io.NopCloser(bytes.NewBuffer(newBody))
 	return false, nil, nil
 }
 
+// addedUsage is set in the context of a streamed request whose usage was asked for by the gateway
+type addedUsage struct{}
+
+func isStream(body []byte) bool {
+	var chat struct {
+		Stream bool `json:"stream"`
+	}
+	json.Unmarshal(body, &chat)
+	return chat.Stream
+}
+
+// keepFields adds the fields of the original body that the SDK doesn't know (such as stream) to the body it
+// marshalled, so they aren't lost when a request is rewritten
+func keepFields(original, body []byte) []byte {
+	var fields, known map[string]json.RawMessage
+	if json.Unmarshal(original, &fields) != nil || json.Unmarshal(body, &known) != nil {
+		return body
+	}
+	for name, value := range fields {
+		if _, ok := known[name]; !ok {
+			known[name] = value
+		}
+	}
+	merged, err := json.Marshal(known)
+	if err != nil {
+		return body
+	}
+	return merged
+}
+
+// syntheticResponse is a JSON response from the gateway in place of the destination's
+func syntheticResponse(req *http.Request, status int, body []byte) *http.Response {
+	r := http.Response{
+		Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode: status,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Request:    req,
+		Header:     make(http.Header),
+	}
+	r.Header.Add("Content-Type", "application/json")
+	r.Header.Add("User-Agent", "kube-gateway")
+	r.ContentLength = int64(len(body))
+	r.Body = io.NopCloser(bytes.NewBuffer(body))
+	return &r
+}
+
 func (c *AITransaction) openAIResponse(body []byte, res *http.Response) (block bool, err error) {
 	var chat openai.ChatCompletion
 	err = json.Unmarshal(body, &chat)
 	if err != nil {
 		return false, err
 	}
+	c.recordUsage(res.Request, chat.Model, chat.Usage)
+	if c.Response == nil {
+		return false, nil // Only read for the token usage
+	}
 
 	for x := range chat.Choices {
 		for y := range c.Response.BannedWords {
@@ -0,0 +1,67 @@
+package gateway
+
+import (
+	"fmt"
+	"log/slog"
+	"regexp"
+	"unicode"
+	"unicode/utf8"
+)
+
+// compile builds the expression for a rule, it is done once when the policy is loaded. A literal rule matches orig
+// as written, a regex rule treats orig as an RE2 expression whose capture groups can be used in new as $1 or ${name}
+func (p *PromtReplace) compile() error {
+	if p.Orig == "" {
+		return fmt.Errorf("orig can't be empty")
+	}
+	pattern := p.Orig
+	if !p.Regex {
+		pattern = regexp.QuoteMeta(p.Orig)
+	}
+	if p.WholeWord {
+		// A literal that starts or ends with punctuation (e.g. "Go.") only needs a boundary on its word side
+		first, _ := utf8.DecodeRuneInString(p.Orig)
+		last, _ := utf8.DecodeLastRuneInString(p.Orig)
+		pattern = "(?:" + pattern + ")"
+		if p.Regex || isWordRune(first) {
+			pattern = `\b` + pattern
+		}
+		if p.Regex || isWordRune(last) {
+			pattern += `\b`
+		}
+	}
+	if !p.CaseSensitive {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("orig [%s]: %v", p.Orig, err)
+	}
+	p.re = re
+	return nil
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// replacePrompt applies the rules in order, only the rules that matched are logged
+func replacePrompt(rules []PromtReplace, role, content string) string {
+	for x := range rules {
+		rule := &rules[x]
+		if rule.re == nil {
+			continue // Not loaded through Load, so never compiled
+		}
+		n := len(rule.re.FindAllStringIndex(content, -1))
+		if n == 0 {
+			continue
+		}
+		if rule.Regex {
+			content = rule.re.ReplaceAllString(content, rule.New)
+		} else {
+			content = rule.re.ReplaceAllLiteralString(content, rule.New)
+		}
+		slog.Info("changing prompt word", "role", role, "original", rule.Orig, "replacement", rule.New, "count", n)
+	}
+	return content
+}
@@ -0,0 +1,155 @@
+package gateway
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// Protocols recognised from the first bytes that a client sends
+const (
+	ProtocolHTTP1    = "http/1"
+	ProtocolHTTP2    = "h2c"
+	ProtocolTLS      = "tls"
+	ProtocolPostgres = "postgres"
+	ProtocolRedis    = "redis"
+	ProtocolUnknown  = "unknown" // Includes protocols where the server speaks first
+)
+
+var (
+	http2Preface = []byte("PRI * HTTP/2.0")
+	httpMethods  = [][]byte{
+		[]byte("GET "), []byte("POST "), []byte("PUT "), []byte("DELETE "), []byte("HEAD "),
+		[]byte("OPTIONS "), []byte("PATCH "), []byte("CONNECT "), []byte("TRACE "),
+	}
+)
+
+// PostgreSQL startup packets: an int32 length followed by an int32 protocol version or request code
+const (
+	postgresProtocol3  = 196608   // 3.0
+	postgresSSLRequest = 80877103 // SSLRequest
+	postgresGSSRequest = 80877104 // GSSENCRequest
+	postgresCancel     = 80877102 // CancelRequest
+)
+
+// Sniff peeks at the first bytes from a client and classifies the protocol. The returned connection must be
+// used in place of conn as it still holds the peeked bytes. Bytes can arrive in more than one segment, so it keeps
+// peeking until the prefix can only be one protocol. Clients that don't send anything within timeout (i.e. the
+// server speaks first) are classified as unknown. Clients that stop part way through an HTTP method or the HTTP/2
+// preface are classified as HTTP, so splitting the first bytes doesn't get a request past the policy
+func Sniff(conn net.Conn, timeout time.Duration) (string, net.Conn) {
+	reader := bufio.NewReader(conn)
+	peeked := &peekedConn{Conn: conn, reader: reader}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	var data []byte
+	for {
+		// Waits for at least one more byte, and fills the buffer with whatever has arrived
+		_, err := reader.Peek(reader.Buffered() + 1)
+		data, _ = reader.Peek(reader.Buffered())
+		if err != nil && undecided(data) {
+			return partial(data), peeked
+		}
+		if err != nil || !undecided(data) {
+			break
+		}
+	}
+	return Classify(data), peeked
+}
+
+// partial returns the protocol of a prefix that stopped before it was decisive, only HTTP is assumed as the rest
+// are copied anyway
+func partial(data []byte) string {
+	if len(data) == 0 {
+		return ProtocolUnknown
+	}
+	for _, method := range httpMethods {
+		if bytes.HasPrefix(method, data) {
+			return ProtocolHTTP1
+		}
+	}
+	if bytes.HasPrefix(http2Preface, data) {
+		return ProtocolHTTP2
+	}
+	return ProtocolUnknown
+}
+
+// undecided is true while data is the start of a prefix that Classify recognises, more bytes could change the
+// protocol (e.g. "P" could become "POST " or the HTTP/2 preface)
+func undecided(data []byte) bool {
+	if len(data) == 0 {
+		return true
+	}
+	if len(data) < len(http2Preface) && bytes.HasPrefix(http2Preface, data) {
+		return true
+	}
+	for _, method := range httpMethods {
+		if len(data) < len(method) && bytes.HasPrefix(method, data) {
+			return true
+		}
+	}
+	switch {
+	case data[0] == 0x16 && len(data) < 3: // TLS record header
+		return true
+	case data[0] == '*' && len(data) < 2: // RESP array
+		return true
+	case data[0] == 0 && len(data) < 8: // PostgreSQL length, which is always under 64k
+		return true
+	}
+	return false
+}
+
+// Classify returns the protocol of the first bytes sent by a client
+func Classify(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, http2Preface):
+		return ProtocolHTTP2
+	case len(data) >= 3 && data[0] == 0x16 && data[1] == 0x03 && data[2] <= 0x04: // Handshake record, TLS 1.0 to 1.3
+		return ProtocolTLS
+	case len(data) >= 2 && data[0] == '*' && data[1] >= '0' && data[1] <= '9': // RESP array of bulk strings
+		return ProtocolRedis
+	case isPostgres(data):
+		return ProtocolPostgres
+	}
+	for _, method := range httpMethods {
+		if bytes.HasPrefix(data, method) {
+			return ProtocolHTTP1
+		}
+	}
+	return ProtocolUnknown
+}
+
+func isPostgres(data []byte) bool {
+	if len(data) < 8 {
+		return false
+	}
+	length := binary.BigEndian.Uint32(data[0:4])
+	if length < 8 || length > 10000 {
+		return false
+	}
+	switch binary.BigEndian.Uint32(data[4:8]) {
+	case postgresProtocol3, postgresSSLRequest, postgresGSSRequest, postgresCancel:
+		return true
+	}
+	return false
+}
+
+// peekedConn reads through the buffer that holds the sniffed bytes
+type peekedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (p *peekedConn) Read(b []byte) (int, error) {
+	return p.reader.Read(b)
+}
+
+func (p *peekedConn) CloseWrite() error {
+	if cw, ok := p.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
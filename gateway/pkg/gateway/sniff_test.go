@@ -0,0 +1,101 @@
+package gateway
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		data     string
+		protocol string
+	}{
+		{"GET / HTTP/1.1\r\n", ProtocolHTTP1},
+		{"POST /v1/chat/completions HTTP/1.1\r\n", ProtocolHTTP1},
+		{"PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n", ProtocolHTTP2},
+		{"\x16\x03\x01\x02\x00", ProtocolTLS},
+		{"*1\r\n$4\r\nPING\r\n", ProtocolRedis},
+		{"\x00\x00\x00\x08\x04\xd2\x16\x2f", ProtocolPostgres},
+		{"SSH-2.0-OpenSSH\r\n", ProtocolUnknown},
+		{"PO", ProtocolUnknown},
+	}
+	for _, test := range tests {
+		if protocol := Classify([]byte(test.data)); protocol != test.protocol {
+			t.Errorf("%q: expected %s, got %s", test.data, test.protocol, protocol)
+		}
+	}
+}
+
+// TestSniffSplit sends the first bytes in separate writes, the classification has to wait for all of them
+func TestSniffSplit(t *testing.T) {
+	tests := []struct {
+		writes   []string
+		protocol string
+	}{
+		{[]string{"P", "OST / HTTP/1.1\r\n"}, ProtocolHTTP1},
+		{[]string{"PRI * ", "HTTP/2.0\r\n\r\nSM\r\n\r\n"}, ProtocolHTTP2},
+		{[]string{"\x16", "\x03\x01"}, ProtocolTLS},
+		{[]string{"\x00\x00\x00", "\x08\x04\xd2\x16\x2f"}, ProtocolPostgres},
+		// Stops part way, classified once the timeout passes
+		{[]string{"GE"}, ProtocolHTTP1},
+		{[]string{"P"}, ProtocolHTTP1},
+		{[]string{"PRI * HT"}, ProtocolHTTP2},
+		{[]string{"\x16"}, ProtocolUnknown},
+		{[]string{"\x00\x00"}, ProtocolUnknown},
+		{[]string{}, ProtocolUnknown}, // The server speaks first
+	}
+	for _, test := range tests {
+		client, server := net.Pipe()
+		go func() {
+			for _, w := range test.writes {
+				client.Write([]byte(w))
+				time.Sleep(10 * time.Millisecond)
+			}
+		}()
+		protocol, conn := Sniff(server, 200*time.Millisecond)
+		if protocol != test.protocol {
+			t.Errorf("%q: expected %s, got %s", test.writes, test.protocol, protocol)
+		}
+		// The peeked bytes are still read by the handler
+		client.Close()
+		data, _ := io.ReadAll(conn)
+		sent := ""
+		for _, w := range test.writes {
+			sent += w
+		}
+		if string(data) != sent {
+			t.Errorf("expected %q to be replayed, got %q", sent, data)
+		}
+		server.Close()
+	}
+}
+
+// TestSniffCloseWrite checks that the sniffed connection can still be half-closed, the handlers rely on it to pass on
+// the end of a stream
+func TestSniffCloseWrite(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client.Write([]byte("GET / HTTP/1.1\r\n"))
+	_, conn := Sniff(server, time.Second)
+	closeWrite(conn)
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the client to see the end of the stream, got %v", err)
+	}
+}
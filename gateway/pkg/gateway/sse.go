@@ -0,0 +1,303 @@
+package gateway
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/openai/openai-go"
+	"github.com/tidwall/sjson"
+)
+
+// What happens to a streamed response once a banned word is found
+const (
+	StreamTerminate = "terminate" // End the stream with a refusal, the rest of the completion is dropped
+	StreamMask      = "mask"      // Replace the word with asterisks and carry on
+)
+
+// The refusal ends a terminated stream, with the finish reason OpenAI uses for filtered content
+const streamRefusal = "kube-gateway says no"
+
+// isEventStream is true for Server-Sent Events, i.e. chat completions with stream: true
+func isEventStream(header http.Header) bool {
+	mediaType, _, _ := strings.Cut(header.Get("Content-Type"), ";")
+	return strings.EqualFold(strings.TrimSpace(mediaType), "text/event-stream")
+}
+
+// sseFilter applies the banned words to a stream of chat completion chunks as it is read. Each event is passed on
+// as soon as it is complete, except for the end of each choice's content which is held back until it can't be the
+// start of a banned word. That way a word split across chunks is found before any of it reaches the application.
+// Events that aren't chat completion chunks are passed on untouched. Without banned words the chunks are only read
+// for the token usage, which is in the last one when the request asked for stream_options.include_usage. When it
+// was the gateway that asked, the usage chunk is read and not passed on, and the usage field is removed from the rest
+type sseFilter struct {
+	src    *bufio.Reader
+	body   io.Closer
+	words  []string
+	mask   bool
+	stop   func() // Closes the destination, so a terminated completion isn't read to the end
+	dest   string
+	window int // Bytes of content held back, one less than the longest banned word
+
+	pending map[int64]string // Content held back for each choice
+	last    []byte           // Last chunk, a template for content that is still held back at the end
+	out     bytes.Buffer
+	err     error
+
+	masked     int  // Banned words replaced
+	terminated bool // A banned word ended the stream
+
+	c         *AITransaction
+	req       *http.Request
+	model     string
+	usage     openai.CompletionUsage // Latest usage in the stream, recorded at [DONE] or once it is closed
+	recorded  bool
+	hideUsage bool // The application didn't ask for the usage chunk
+}
+
+func newSSEFilter(body io.ReadCloser, c *AITransaction, req *http.Request, stop func(), dest string) *sseFilter {
+	f := &sseFilter{
+		src:     bufio.NewReader(body),
+		body:    body,
+		stop:    stop,
+		dest:    dest,
+		pending: map[int64]string{},
+		c:       c,
+		req:     req,
+	}
+	if req != nil && req.Context().Value(addedUsage{}) != nil {
+		f.hideUsage = true
+	}
+	if response := c.GetResponse(); response != nil {
+		f.mask = response.StreamAction == StreamMask
+		for _, word := range response.BannedWords {
+			if word != "" {
+				f.words = append(f.words, word)
+				f.window = max(f.window, len(word)-1)
+			}
+		}
+	}
+	return f
+}
+
+func (f *sseFilter) Read(p []byte) (int, error) {
+	for f.out.Len() == 0 && f.err == nil {
+		f.err = f.next()
+	}
+	if f.out.Len() != 0 {
+		return f.out.Read(p)
+	}
+	return 0, f.err
+}
+
+func (f *sseFilter) Close() error {
+	f.record()
+	err := f.body.Close()
+	if f.terminated {
+		return nil // The destination was closed to stop the completion, the rest of the body can't be read
+	}
+	return err
+}
+
+// next reads an event and adds what should be passed on to the output
+func (f *sseFilter) next() error {
+	if f.terminated {
+		return io.EOF
+	}
+	var lines []string
+	for {
+		line, err := f.src.ReadString('\n')
+		if err != nil {
+			// The stream ended, anything that was held back is still owed to the application
+			if line != "" {
+				lines = append(lines, strings.TrimRight(line, "\r\n"))
+			}
+			if len(lines) != 0 {
+				f.event(lines)
+			}
+			f.flush()
+			return err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			if len(lines) != 0 {
+				f.event(lines)
+			}
+			return nil
+		}
+		lines = append(lines, line)
+	}
+}
+
+// record accounts for the stream's token usage, once it has finished
+func (f *sseFilter) record() {
+	if !f.recorded {
+		f.recorded = true
+		f.c.recordUsage(f.req, f.model, f.usage)
+	}
+}
+
+// event filters a complete event, given as its lines without the blank line that ends it
+func (f *sseFilter) event(lines []string) {
+	var data []string
+	for _, line := range lines {
+		if value, ok := strings.CutPrefix(line, "data:"); ok {
+			data = append(data, strings.TrimPrefix(value, " "))
+		}
+	}
+	payload := strings.Join(data, "\n")
+	if payload == "[DONE]" {
+		f.flush()
+		f.record()
+	}
+	if len(data) == 0 || payload == "[DONE]" {
+		f.write(lines)
+		return
+	}
+
+	var chunk openai.ChatCompletionChunk
+	if json.Unmarshal([]byte(payload), &chunk) != nil || chunk.Object != "chat.completion.chunk" {
+		f.write(lines)
+		return
+	}
+	if chunk.Usage.PromptTokens != 0 || chunk.Usage.CompletionTokens != 0 {
+		f.model = chunk.Model
+		f.usage = chunk.Usage
+		if f.hideUsage && len(chunk.Choices) == 0 {
+			return
+		}
+	}
+	rewritten := []byte(payload)
+	if f.hideUsage {
+		// Asking for the usage adds "usage": null to every chunk, the application gets chunks as if it hadn't
+		rewritten, _ = sjson.DeleteBytes(rewritten, "usage")
+	}
+	if f.words == nil {
+		if f.hideUsage {
+			lines = replaceData(lines, rewritten)
+		}
+		f.write(lines)
+		return
+	}
+	f.last = rewritten
+	for x, choice := range chunk.Choices {
+		content := f.pending[choice.Index] + choice.Delta.Content
+		if word := f.find(content); word != "" {
+			if !f.mask {
+				f.terminate(rewritten, choice.Index, word)
+				return
+			}
+			content = f.maskWords(content)
+		}
+		// Content is held back until the choice has finished, or until it can't be part of a banned word
+		send := content
+		if choice.FinishReason == "" {
+			send = content[:runeStart(content, len(content)-f.window)]
+		}
+		f.pending[choice.Index] = content[len(send):]
+		if send != choice.Delta.Content {
+			rewritten, _ = sjson.SetBytes(rewritten, fmt.Sprintf("choices.%d.delta.content", x), send)
+		}
+	}
+	f.write(replaceData(lines, rewritten))
+}
+
+// find returns the first banned word in content
+func (f *sseFilter) find(content string) string {
+	for _, word := range f.words {
+		if strings.Contains(content, word) {
+			return word
+		}
+	}
+	return ""
+}
+
+func (f *sseFilter) maskWords(content string) string {
+	for _, word := range f.words {
+		n := strings.Count(content, word)
+		if n == 0 {
+			continue
+		}
+		f.masked += n
+		slog.Info("mask response", "dest", f.dest, "word", word, "count", n)
+		content = strings.ReplaceAll(content, word, strings.Repeat("*", utf8.RuneCountInString(word)))
+	}
+	return content
+}
+
+// terminate ends the stream with a refusal in place of the chunk that completed a banned word, nothing that was
+// held back is sent
+func (f *sseFilter) terminate(chunk []byte, index int64, word string) {
+	slog.Info("block response", "dest", f.dest, "word", word, "stream", true)
+	f.terminated = true
+	refusal, _ := sjson.SetBytes(chunk, "choices", []any{map[string]any{
+		"index":         index,
+		"delta":         map[string]any{"content": streamRefusal},
+		"finish_reason": "content_filter",
+	}})
+	f.out.WriteString("data: ")
+	f.out.Write(refusal)
+	f.out.WriteString("\n\ndata: [DONE]\n\n")
+	f.pending = map[int64]string{}
+	if f.stop != nil {
+		f.stop()
+	}
+}
+
+// flush sends the content that is still held back, as a chunk built from the last one
+func (f *sseFilter) flush() {
+	if f.last == nil {
+		return
+	}
+	for index, content := range f.pending {
+		if content == "" {
+			continue
+		}
+		chunk, _ := sjson.SetBytes(f.last, "choices", []any{map[string]any{
+			"index": index,
+			"delta": map[string]any{"content": content},
+		}})
+		f.write([]string{"data: " + string(chunk)})
+	}
+	f.pending = map[int64]string{}
+}
+
+func (f *sseFilter) write(lines []string) {
+	for _, line := range lines {
+		f.out.WriteString(line)
+		f.out.WriteByte('\n')
+	}
+	f.out.WriteByte('\n')
+}
+
+// replaceData swaps the data of an event for a single line, other fields (event, id etc.) are kept
+func replaceData(lines []string, data []byte) []string {
+	out := make([]string, 0, len(lines))
+	replaced := false
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "data:") {
+			out = append(out, line)
+		} else if !replaced {
+			out = append(out, "data: "+string(data))
+			replaced = true
+		}
+	}
+	return out
+}
+
+// runeStart moves n back to the start of a rune, so held back content isn't split in the middle of a character
+func runeStart(s string, n int) int {
+	if n <= 0 {
+		return 0
+	}
+	for n < len(s) && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return n
+}
@@ -0,0 +1,174 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gateway/pkg/metrics"
+
+	"github.com/openai/openai-go"
+)
+
+var (
+	aiTokens        = metrics.NewCounterVec("kube_gateway_ai_tokens_total", "Tokens used by chat completions", "endpoint", "model", "type")
+	quotaRejections = metrics.NewCounterVec("kube_gateway_ai_quota_rejections_total", "Chat requests refused because a token quota was used up", "period")
+
+	// The Host header and the model come from the client, so usage is only kept for the first maxTokenLabels of
+	// each and the rest are counted as "other"
+	tokenEndpoints = metrics.NewLabelSet(maxTokenLabels)
+	tokenModels    = metrics.NewLabelSet(maxTokenLabels)
+)
+
+const maxTokenLabels = 100
+
+const (
+	quotaPeriodHour  = "hourly"
+	quotaPeriodDay   = "daily"
+	quotaPeriodTotal = "total"
+)
+
+// Quota is the number of tokens (prompt and completion) the pod may use, 0 is unlimited. The hourly and daily
+// windows start on the hour and at midnight UTC
+type Quota struct {
+	Hourly int64 `json:"hourly,omitempty"`
+	Daily  int64 `json:"daily,omitempty"`
+	Total  int64 `json:"total,omitempty"`
+}
+
+func (q *Quota) validate() error {
+	if q.Hourly < 0 || q.Daily < 0 || q.Total < 0 {
+		return fmt.Errorf("quota limits can't be negative")
+	}
+	return nil
+}
+
+type tokenCount struct {
+	prompt     int64
+	completion int64
+}
+
+// tokenUsage is the tokens used by completions since the gateway started, it isn't part of the policy so it
+// carries on across reloads
+type tokenUsage struct {
+	mu        sync.Mutex
+	endpoints map[endpointToken]*tokenCount
+	hour      time.Time // Start of the current hourly window
+	day       time.Time // Start of the current daily window
+	hourly    int64
+	daily     int64
+	total     int64
+}
+
+// roll starts new windows once the current ones have passed, the caller holds the lock
+func (u *tokenUsage) roll(now time.Time) {
+	now = now.UTC()
+	if hour := now.Truncate(time.Hour); !hour.Equal(u.hour) {
+		u.hour = hour
+		u.hourly = 0
+	}
+	if day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC); !day.Equal(u.day) {
+		u.day = day
+		u.daily = 0
+	}
+}
+
+func (u *tokenUsage) add(endpoint, model string, prompt, completion int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.endpoints == nil {
+		u.endpoints = map[endpointToken]*tokenCount{}
+	}
+	key := endpointToken{endpoint: endpoint, model: model}
+	count, ok := u.endpoints[key]
+	if !ok {
+		count = &tokenCount{}
+		u.endpoints[key] = count
+	}
+	count.prompt += prompt
+	count.completion += completion
+
+	u.roll(time.Now())
+	u.hourly += prompt + completion
+	u.daily += prompt + completion
+	u.total += prompt + completion
+}
+
+// exceeded returns the first period of the quota that has been used up, and how long until it resets (0 for the
+// total, which never does)
+func (u *tokenUsage) exceeded(q *Quota, now time.Time) (period string, retry time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.roll(now)
+	switch {
+	case q.Total != 0 && u.total >= q.Total:
+		return quotaPeriodTotal, 0
+	case q.Daily != 0 && u.daily >= q.Daily:
+		return quotaPeriodDay, u.day.Add(24 * time.Hour).Sub(now)
+	case q.Hourly != 0 && u.hourly >= q.Hourly:
+		return quotaPeriodHour, u.hour.Add(time.Hour).Sub(now)
+	}
+	return "", 0
+}
+
+// recordUsage accounts for the tokens of a completion, the endpoint is the host the request was sent to (without
+// its port)
+func (c *AITransaction) recordUsage(req *http.Request, model string, usage openai.CompletionUsage) {
+	if usage.PromptTokens == 0 && usage.CompletionTokens == 0 {
+		return
+	}
+	endpoint := ""
+	if req != nil {
+		endpoint = req.Host
+		if host, _, err := net.SplitHostPort(endpoint); err == nil {
+			endpoint = host
+		}
+		endpoint = tokenEndpoints.Value(strings.ToLower(endpoint))
+	}
+	model = tokenModels.Value(model)
+	c.TokenCount.add(endpoint, model, usage.PromptTokens, usage.CompletionTokens)
+	aiTokens.WithLabelValues(endpoint, model, "prompt").Add(float64(usage.PromptTokens))
+	aiTokens.WithLabelValues(endpoint, model, "completion").Add(float64(usage.CompletionTokens))
+	slog.Debug("token usage", "endpoint", endpoint, "model", model, "prompt", usage.PromptTokens, "completion", usage.CompletionTokens)
+}
+
+// checkQuota returns a 429 in place of the destination's response once a quota has been used up. Usage is only
+// known once a completion has finished, so requests already in flight can take the pod past its quota
+func (c *AITransaction) checkQuota(req *http.Request) *http.Response {
+	q := c.Request.Quota
+	if q == nil {
+		return nil
+	}
+	period, retry := c.TokenCount.exceeded(q, time.Now())
+	if period == "" {
+		return nil
+	}
+	quotaRejections.WithLabelValues(period).Inc()
+	slog.Warn("token quota exceeded", "period", period, "host", req.Host, "path", req.URL.Path)
+
+	body, _ := json.Marshal(map[string]any{
+		"error": map[string]any{
+			"message": fmt.Sprintf("The %s token quota for this workload has been used up", period),
+			"type":    "insufficient_quota",
+			"param":   nil,
+			"code":    "quota_exceeded",
+		},
+	})
+	res := syntheticResponse(req, http.StatusTooManyRequests, body)
+	if retry > 0 {
+		res.Header.Set("Retry-After", strconv.FormatInt(int64((retry+time.Second-1)/time.Second), 10))
+	}
+	return res
+}
+
+// isChatCompletion is true for requests to the chat completions API, their responses are read for token usage
+// even without a response policy
+func isChatCompletion(req *http.Request) bool {
+	return req != nil && req.URL != nil && strings.HasSuffix(req.URL.Path, "/chat/completions")
+}
@@ -0,0 +1,27 @@
+package gateway
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/openai/openai-go"
+)
+
+func TestRecordUsageEndpoint(t *testing.T) {
+	tests := []struct {
+		host     string
+		expected string
+	}{
+		{"api.example.com", "api.example.com"},
+		{"API.example.com:8080", "api.example.com"},
+		{"10.0.0.1:80", "10.0.0.1"},
+	}
+	for _, test := range tests {
+		c := &AITransaction{}
+		req, _ := http.NewRequest(http.MethodPost, "http://"+test.host+"/v1/chat/completions", nil)
+		c.recordUsage(req, "llama3", openai.CompletionUsage{PromptTokens: 1, CompletionTokens: 2})
+		if count := c.TokenCount.endpoints[endpointToken{endpoint: test.expected, model: "llama3"}]; count == nil {
+			t.Errorf("%s: expected usage for %s, got %v", test.host, test.expected, c.TokenCount.endpoints)
+		}
+	}
+}
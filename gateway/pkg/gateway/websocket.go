@@ -0,0 +1,76 @@
+package gateway
+
+import (
+	"encoding/binary"
+	"log/slog"
+)
+
+var websocketOpcodes = map[byte]string{
+	0x0: "continuation",
+	0x1: "text",
+	0x2: "binary",
+	0x8: "close",
+	0x9: "ping",
+	0xa: "pong",
+}
+
+// websocketLogger follows the frames of one direction of a WebSocket stream and logs their metadata,
+// payloads are skipped over and never logged
+type websocketLogger struct {
+	direction string
+	dest      string
+	header    []byte // Header bytes of the frame being parsed
+	remaining uint64 // Payload bytes left in the current frame
+}
+
+// Write never fails, the logger only observes the stream
+func (w *websocketLogger) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) != 0 {
+		if w.remaining != 0 {
+			skip := min(uint64(len(p)), w.remaining)
+			w.remaining -= skip
+			p = p[skip:]
+			continue
+		}
+		w.header = append(w.header, p[0])
+		p = p[1:]
+		w.parseHeader()
+	}
+	return n, nil
+}
+
+// parseHeader logs the frame once its header is complete
+func (w *websocketLogger) parseHeader() {
+	if len(w.header) < 2 {
+		return
+	}
+	size := 2
+	length := uint64(w.header[1] & 0x7f)
+	switch length {
+	case 126:
+		size += 2
+	case 127:
+		size += 8
+	}
+	masked := w.header[1]&0x80 != 0
+	if masked {
+		size += 4
+	}
+	if len(w.header) < size {
+		return
+	}
+	switch length {
+	case 126:
+		length = uint64(binary.BigEndian.Uint16(w.header[2:4]))
+	case 127:
+		length = binary.BigEndian.Uint64(w.header[2:10])
+	}
+	opcode, ok := websocketOpcodes[w.header[0]&0x0f]
+	if !ok {
+		opcode = "reserved"
+	}
+	slog.Info("websocket frame", "dest", w.dest, "direction", w.direction, "opcode", opcode, "length", length, "fin", w.header[0]&0x80 != 0, "masked", masked)
+	w.header = w.header[:0]
+	w.remaining = length
+}
@@ -0,0 +1,58 @@
+package intercept
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+var errPeeked = errors.New("client hello read")
+
+// PeekClientHello reads the ClientHello that a client sends to start TLS, without answering it. The returned
+// connection must be used in place of conn as it replays what was read. The ClientHello is nil if the client
+// didn't start a TLS handshake within timeout
+func PeekClientHello(conn net.Conn, timeout time.Duration) (*tls.ClientHelloInfo, net.Conn) {
+	var read bytes.Buffer
+	var hello *tls.ClientHelloInfo
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	tls.Server(&helloConn{Conn: conn, r: io.TeeReader(conn, &read)}, &tls.Config{
+		GetConfigForClient: func(h *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = h
+			return nil, errPeeked
+		},
+	}).Handshake()
+	conn.SetReadDeadline(time.Time{})
+	return hello, &replayConn{Conn: conn, r: io.MultiReader(&read, conn)}
+}
+
+// helloConn lets the TLS server read the ClientHello, nothing it writes (i.e. the alert) reaches the client
+type helloConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (h *helloConn) Read(b []byte) (int, error) {
+	return h.r.Read(b)
+}
+
+func (h *helloConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+// replayConn reads the bytes consumed by PeekClientHello before the rest of the connection
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (r *replayConn) Read(b []byte) (int, error) {
+	return r.r.Read(b)
+}
+
+// NetConn returns the connection to the client
+func (r *replayConn) NetConn() net.Conn {
+	return r.Conn
+}
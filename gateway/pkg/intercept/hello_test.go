@@ -0,0 +1,93 @@
+package intercept
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPeekClientHello(t *testing.T) {
+	ca := newTestCA(t, 365*24*time.Hour, true)
+	a := ca.authority(t, "api.openai.com")
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	result := make(chan error, 1)
+	go func() {
+		conn := tls.Client(client, &tls.Config{ServerName: "api.openai.com", RootCAs: ca.roots})
+		err := conn.Handshake()
+		if err == nil {
+			_, err = conn.Write([]byte("hello"))
+		}
+		result <- err
+	}()
+
+	hello, conn := PeekClientHello(server, time.Second)
+	if hello == nil || hello.ServerName != "api.openai.com" {
+		t.Fatalf("expected the ClientHello for api.openai.com, got %+v", hello)
+	}
+
+	// The ClientHello is replayed, so the handshake carries on as if nothing had been read
+	tlsConn := tls.Server(conn, &tls.Config{GetCertificate: a.GetCertificate})
+	buf := make([]byte, 5)
+	_, err := io.ReadFull(tlsConn, buf)
+	if err != nil {
+		t.Fatalf("expected the handshake to complete, got %v", err)
+	}
+	if string(buf) != "hello" {
+		t.Errorf("expected hello, got %q", buf)
+	}
+	if err := <-result; err != nil {
+		t.Errorf("expected the client to trust the minted certificate, got %v", err)
+	}
+	if conn.(interface{ NetConn() net.Conn }).NetConn() != server {
+		t.Error("expected NetConn to return the client's connection")
+	}
+}
+
+func TestPeekClientHelloPlaintext(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	request := "GET / HTTP/1.1\r\nHost: api.openai.com\r\n\r\n"
+	go client.Write([]byte(request))
+	hello, conn := PeekClientHello(server, time.Second)
+	if hello != nil {
+		t.Fatalf("expected no ClientHello, got %+v", hello)
+	}
+	buf := make([]byte, len(request))
+	_, err := io.ReadFull(conn, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != request {
+		t.Errorf("expected the request to be replayed, got %q", buf)
+	}
+}
+
+func TestPeekClientHelloTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	start := time.Now()
+	hello, conn := PeekClientHello(server, 50*time.Millisecond)
+	if hello != nil {
+		t.Fatalf("expected no ClientHello, got %+v", hello)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected to give up after the timeout, took %v", elapsed)
+	}
+
+	// The deadline is cleared, so the connection is still usable
+	go client.Write([]byte("late"))
+	buf := make([]byte, 4)
+	_, err := io.ReadFull(conn, buf)
+	if err != nil || string(buf) != "late" {
+		t.Errorf("expected to read after the timeout, got %q (%v)", buf, err)
+	}
+}
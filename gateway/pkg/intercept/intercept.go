@@ -0,0 +1,148 @@
+package intercept
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"gateway/pkg/metrics"
+	"log/slog"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	leafLifetime = 24 * time.Hour
+	leafRenewal  = time.Hour // Leaves this close to expiring are minted again
+	maxLeaves    = 1024      // Cached leaves, the cache is emptied when it is full
+)
+
+var minted = metrics.NewCounterVec("kube_gateway_intercept_certificates_total", "Certificates minted for intercepted server names", "result")
+
+// Authority mints certificates for the server names that the application connects to, signed by the pod's
+// intermediate CA. Applications trust them through the CA in the kube-gateway-ca trust bundle
+type Authority struct {
+	hosts []string
+	ca    *x509.Certificate
+	chain tls.Certificate
+
+	mu     sync.Mutex
+	leaves map[string]*tls.Certificate
+}
+
+// New loads the pod's intermediate CA, hosts are the server names to intercept: an exact name, *.<domain> for
+// any of its subdomains or * for everything
+func New(certPEM, keyPEM []byte, hosts []string) (*Authority, error) {
+	chain, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("loading intercept CA: %v", err)
+	}
+	ca, err := x509.ParseCertificate(chain.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("loading intercept CA: %v", err)
+	}
+	if !ca.IsCA {
+		return nil, fmt.Errorf("intercept certificate [%s] isn't a CA", ca.Subject.CommonName)
+	}
+	a := &Authority{ca: ca, chain: chain, leaves: map[string]*tls.Certificate{}}
+	for _, host := range hosts {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if host != "" {
+			a.hosts = append(a.hosts, host)
+		}
+	}
+	if len(a.hosts) == 0 {
+		return nil, fmt.Errorf("no hosts to intercept")
+	}
+	slog.Info("tls interception", "ca", ca.Subject.CommonName, "hosts", a.hosts, "expires", ca.NotAfter)
+	return a, nil
+}
+
+// Matches is true when the server name is one of the intercepted hosts
+func (a *Authority) Matches(serverName string) bool {
+	if a == nil || serverName == "" {
+		return false
+	}
+	serverName = strings.ToLower(serverName)
+	for _, host := range a.hosts {
+		switch {
+		case host == "*", host == serverName:
+			return true
+		case strings.HasPrefix(host, "*.") && strings.HasSuffix(serverName, host[1:]):
+			return true
+		}
+	}
+	return false
+}
+
+// GetCertificate returns the certificate for the server name in a ClientHello, leaves are cached until they
+// are close to expiring
+func (a *Authority) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(hello.ServerName)
+	if !a.Matches(name) {
+		return nil, fmt.Errorf("server name [%s] isn't intercepted", name)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if leaf, ok := a.leaves[name]; ok && time.Until(leaf.Leaf.NotAfter) > leafRenewal {
+		return leaf, nil
+	}
+	leaf, err := a.mint(name)
+	if err != nil {
+		minted.WithLabelValues("failed").Inc()
+		return nil, err
+	}
+	minted.WithLabelValues("minted").Inc()
+	if len(a.leaves) >= maxLeaves {
+		clear(a.leaves)
+	}
+	a.leaves[name] = leaf
+	return leaf, nil
+}
+
+// mint signs a certificate for a server name, followed by the intermediate so the application only needs the root
+func (a *Authority) mint(name string) (*tls.Certificate, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	notAfter := time.Now().Add(leafLifetime)
+	if a.ca.NotAfter.Before(notAfter) {
+		notAfter = a.ca.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"kube-gateway"},
+			CommonName:   name,
+		},
+		NotBefore:   time.Now().Add(-5 * time.Minute), // Allow for clock skew with the application
+		NotAfter:    notAfter,
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:    []string{name},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, a.ca, priv.Public(), a.chain.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("minting certificate for [%s]: %v", name, err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("minted certificate", "name", name, "expires", notAfter)
+	return &tls.Certificate{
+		Certificate: [][]byte{der, a.chain.Certificate[0]},
+		PrivateKey:  priv,
+		Leaf:        leaf,
+	}, nil
+}
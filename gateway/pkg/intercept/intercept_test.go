@@ -0,0 +1,235 @@
+package intercept
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// testCA is a root CA with an intermediate, as the gateway is given a pod's intermediate and applications trust
+// the root
+type testCA struct {
+	roots   *x509.CertPool
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func newTestCA(t *testing.T, lifetime time.Duration, isCA bool) *testCA {
+	t.Helper()
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "kube-gateway-intercept"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	rootDER, err := x509.CreateCertificate(rand.Reader, root, root, rootKey.Public(), rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err = x509.ParseCertificate(rootDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	intermediate := &x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: "default/app"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(lifetime),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, intermediate, root, key.Public(), rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	return &testCA{
+		roots:   roots,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func (ca *testCA) authority(t *testing.T, hosts ...string) *Authority {
+	t.Helper()
+	a, err := New(ca.certPEM, ca.keyPEM, hosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestNew(t *testing.T) {
+	ca := newTestCA(t, 24*time.Hour, true)
+	leafCA := newTestCA(t, 24*time.Hour, false)
+	tests := []struct {
+		name    string
+		certPEM []byte
+		keyPEM  []byte
+		hosts   []string
+		err     bool
+	}{
+		{"Valid", ca.certPEM, ca.keyPEM, []string{"api.openai.com"}, false},
+		{"No hosts", ca.certPEM, ca.keyPEM, []string{" ", ""}, true},
+		{"Not a CA", leafCA.certPEM, leafCA.keyPEM, []string{"api.openai.com"}, true},
+		{"Mismatched key", ca.certPEM, leafCA.keyPEM, []string{"api.openai.com"}, true},
+		{"Invalid PEM", []byte("invalid"), ca.keyPEM, []string{"api.openai.com"}, true},
+	}
+	for _, test := range tests {
+		_, err := New(test.certPEM, test.keyPEM, test.hosts)
+		if (err != nil) != test.err {
+			t.Errorf("%s: expected error %v, got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestAuthorityMatches(t *testing.T) {
+	a := newTestCA(t, 24*time.Hour, true).authority(t, " API.openai.com ", "*.anthropic.com")
+	tests := []struct {
+		serverName string
+		expected   bool
+	}{
+		{"api.openai.com", true},
+		{"API.OpenAI.com", true},
+		{"openai.com", false},
+		{"other.openai.com", false},
+		{"api.anthropic.com", true},
+		{"a.b.anthropic.com", true},
+		{"anthropic.com", false},
+		{"notanthropic.com", false},
+		{"anthropic.com.evil.com", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if got := a.Matches(test.serverName); got != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.serverName, test.expected, got)
+		}
+	}
+
+	all := newTestCA(t, 24*time.Hour, true).authority(t, "*")
+	if !all.Matches("example.com") || all.Matches("") {
+		t.Error("expected * to match any server name")
+	}
+	var none *Authority
+	if none.Matches("api.openai.com") {
+		t.Error("expected a nil authority to match nothing")
+	}
+}
+
+func TestGetCertificate(t *testing.T) {
+	ca := newTestCA(t, 365*24*time.Hour, true)
+	a := ca.authority(t, "*.openai.com")
+
+	cert, err := a.GetCertificate(&tls.ClientHelloInfo{ServerName: "API.openai.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cert.Certificate) != 2 {
+		t.Fatalf("expected the leaf and the intermediate, got %d certificates", len(cert.Certificate))
+	}
+	intermediates := x509.NewCertPool()
+	intermediate, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	intermediates.AddCert(intermediate)
+	_, err = cert.Leaf.Verify(x509.VerifyOptions{DNSName: "api.openai.com", Roots: ca.roots, Intermediates: intermediates})
+	if err != nil {
+		t.Fatalf("expected the leaf to be trusted through the root, got %v", err)
+	}
+	if lifetime := time.Until(cert.Leaf.NotAfter); lifetime > leafLifetime || lifetime < leafLifetime-time.Minute {
+		t.Errorf("expected the leaf to last %v, got %v", leafLifetime, lifetime)
+	}
+
+	// Leaves are cached whatever the case of the server name
+	cached, err := a.GetCertificate(&tls.ClientHelloInfo{ServerName: "api.openai.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached != cert {
+		t.Error("expected the cached leaf")
+	}
+
+	_, err = a.GetCertificate(&tls.ClientHelloInfo{ServerName: "api.anthropic.com"})
+	if err == nil {
+		t.Error("expected an error for a server name that isn't intercepted")
+	}
+}
+
+func TestGetCertificateRenewal(t *testing.T) {
+	a := newTestCA(t, 365*24*time.Hour, true).authority(t, "api.openai.com")
+	hello := &tls.ClientHelloInfo{ServerName: "api.openai.com"}
+	cert, err := a.GetCertificate(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A leaf close to expiring is minted again
+	expiring := *cert.Leaf
+	expiring.NotAfter = time.Now().Add(leafRenewal - time.Minute)
+	a.leaves["api.openai.com"] = &tls.Certificate{Certificate: cert.Certificate, PrivateKey: cert.PrivateKey, Leaf: &expiring}
+	renewed, err := a.GetCertificate(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed.Leaf == &expiring || renewed.Leaf.SerialNumber.Cmp(cert.Leaf.SerialNumber) == 0 {
+		t.Error("expected a new leaf")
+	}
+
+	// The cache is emptied when it is full
+	for x := range maxLeaves {
+		a.leaves[fmt.Sprintf("%d.openai.com", x)] = cert
+	}
+	_, err = a.GetCertificate(&tls.ClientHelloInfo{ServerName: "API.openai.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a.leaves) != maxLeaves+1 {
+		t.Fatalf("expected a cached leaf to be used, got %d leaves", len(a.leaves))
+	}
+	delete(a.leaves, "api.openai.com")
+	_, err = a.GetCertificate(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a.leaves) != 1 {
+		t.Errorf("expected the cache to be emptied, got %d leaves", len(a.leaves))
+	}
+}
+
+func TestGetCertificateExpiringCA(t *testing.T) {
+	a := newTestCA(t, 2*time.Hour, true).authority(t, "api.openai.com")
+	cert, err := a.GetCertificate(&tls.ClientHelloInfo{ServerName: "api.openai.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cert.Leaf.NotAfter.Equal(a.ca.NotAfter) {
+		t.Errorf("expected the leaf to expire with the CA at %v, got %v", a.ca.NotAfter, cert.Leaf.NotAfter)
+	}
+}
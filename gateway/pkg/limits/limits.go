@@ -0,0 +1,194 @@
+package limits
+
+import (
+	"context"
+	"fmt"
+	"gateway/pkg/metrics"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Limits that can trip, used in errors, logs and metrics
+const (
+	LimitGlobal      = "global"      // Concurrent connections across every listener
+	LimitConcurrency = "concurrency" // Concurrent connections to a destination
+	LimitRate        = "rate"        // New connections per second to a destination
+)
+
+var (
+	rejected = metrics.NewCounterVec("kube_gateway_limit_rejections_total", "Connections rejected by a limit", "listener", "limit")
+	queued   = metrics.NewCounterVec("kube_gateway_limit_queued_total", "Connections that waited for a limit", "listener", "limit")
+	active   = metrics.NewGaugeVec("kube_gateway_active_connections", "Connections currently counted against the global limit", "listener")
+)
+
+// Config sets the limits, a zero value disables that limit
+type Config struct {
+	MaxConnections     int           // Concurrent connections across every listener
+	MaxPerDestination  int           // Concurrent connections to a single destination
+	RatePerDestination float64       // New connections per second to a single destination
+	Burst              int           // New connections allowed above the rate at once
+	Queue              time.Duration // How long an excess connection waits before it is rejected, 0 rejects straight away
+}
+
+// LimitError is returned when a connection is rejected, Limit is the limit that tripped
+type LimitError struct {
+	Limit       string
+	Destination string
+}
+
+func (e *LimitError) Error() string {
+	if e.Destination == "" {
+		return fmt.Sprintf("%s connection limit reached", e.Limit)
+	}
+	return fmt.Sprintf("%s connection limit reached for %s", e.Limit, e.Destination)
+}
+
+// Limiter enforces the limits, it is shared by every listener
+type Limiter struct {
+	cfg    Config
+	global chan struct{}
+
+	mu           sync.Mutex
+	destinations map[string]*destination
+}
+
+type destination struct {
+	active int
+	slots  chan struct{}
+	rate   *rate.Limiter
+}
+
+func New(cfg Config) *Limiter {
+	l := &Limiter{
+		cfg:          cfg,
+		destinations: map[string]*destination{},
+	}
+	if cfg.MaxConnections > 0 {
+		l.global = make(chan struct{}, cfg.MaxConnections)
+	}
+	if l.cfg.Burst <= 0 {
+		l.cfg.Burst = 1
+	}
+	return l
+}
+
+// AcquireGlobal takes a slot from the global limit, release must be called when the connection closes
+func (l *Limiter) AcquireGlobal(listener string) (release func(), err error) {
+	if l == nil || l.global == nil {
+		return func() {}, nil
+	}
+	err = l.take(l.global, listener, LimitGlobal, "")
+	if err != nil {
+		return nil, err
+	}
+	active.WithLabelValues(listener).Inc()
+	return sync.OnceFunc(func() {
+		active.WithLabelValues(listener).Dec()
+		<-l.global
+	}), nil
+}
+
+// AcquireDestination applies the per-destination rate and concurrency limits, release must be called when
+// the connection closes
+func (l *Limiter) AcquireDestination(listener, dest string) (release func(), err error) {
+	if l == nil || (l.cfg.MaxPerDestination <= 0 && l.cfg.RatePerDestination <= 0) {
+		return func() {}, nil
+	}
+	d := l.destination(dest)
+	defer func() {
+		if err != nil {
+			l.done(dest, d)
+		}
+	}()
+
+	if d.rate != nil {
+		err = l.wait(d.rate, listener, dest)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if d.slots != nil {
+		err = l.take(d.slots, listener, LimitConcurrency, dest)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sync.OnceFunc(func() {
+		if d.slots != nil {
+			<-d.slots
+		}
+		l.done(dest, d)
+	}), nil
+}
+
+// destination returns the state for a destination, counting the caller as active so it isn't removed
+func (l *Limiter) destination(dest string) *destination {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	d, ok := l.destinations[dest]
+	if !ok {
+		d = &destination{}
+		if l.cfg.MaxPerDestination > 0 {
+			d.slots = make(chan struct{}, l.cfg.MaxPerDestination)
+		}
+		if l.cfg.RatePerDestination > 0 {
+			d.rate = rate.NewLimiter(rate.Limit(l.cfg.RatePerDestination), l.cfg.Burst)
+		}
+		l.destinations[dest] = d
+	}
+	d.active++
+	return d
+}
+
+// done removes a destination once it has no connections and its rate has fully recovered
+func (l *Limiter) done(dest string, d *destination) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	d.active--
+	if d.active == 0 && (d.rate == nil || d.rate.Tokens() >= float64(l.cfg.Burst)) {
+		delete(l.destinations, dest)
+	}
+}
+
+func (l *Limiter) take(slots chan struct{}, listener, limit, dest string) error {
+	select {
+	case slots <- struct{}{}:
+		return nil
+	default:
+	}
+	if l.cfg.Queue <= 0 {
+		rejected.WithLabelValues(listener, limit).Inc()
+		return &LimitError{Limit: limit, Destination: dest}
+	}
+	queued.WithLabelValues(listener, limit).Inc()
+	timer := time.NewTimer(l.cfg.Queue)
+	defer timer.Stop()
+	select {
+	case slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		rejected.WithLabelValues(listener, limit).Inc()
+		return &LimitError{Limit: limit, Destination: dest}
+	}
+}
+
+func (l *Limiter) wait(r *rate.Limiter, listener, dest string) error {
+	if r.Allow() {
+		return nil
+	}
+	if l.cfg.Queue <= 0 {
+		rejected.WithLabelValues(listener, LimitRate).Inc()
+		return &LimitError{Limit: LimitRate, Destination: dest}
+	}
+	queued.WithLabelValues(listener, LimitRate).Inc()
+	ctx, cancel := context.WithTimeout(context.Background(), l.cfg.Queue)
+	defer cancel()
+	err := r.Wait(ctx)
+	if err != nil {
+		rejected.WithLabelValues(listener, LimitRate).Inc()
+		return &LimitError{Limit: LimitRate, Destination: dest}
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package limits
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// limitOf returns the limit that rejected a connection, or "" if it was let through
+func limitOf(t *testing.T, err error) string {
+	t.Helper()
+	if err == nil {
+		return ""
+	}
+	var limitErr *LimitError
+	if !errors.As(err, &limitErr) {
+		t.Fatalf("expected a LimitError, got %v", err)
+	}
+	return limitErr.Limit
+}
+
+func TestLimiterGlobal(t *testing.T) {
+	l := New(Config{MaxConnections: 2})
+	first, err := l.AcquireGlobal("internal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := l.AcquireGlobal("external")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = l.AcquireGlobal("internal")
+	if limit := limitOf(t, err); limit != LimitGlobal {
+		t.Fatalf("expected the global limit, got %q", limit)
+	}
+
+	// Releasing twice only frees one slot
+	first()
+	first()
+	third, err := l.AcquireGlobal("internal")
+	if err != nil {
+		t.Fatalf("expected a released slot to be reused, got %v", err)
+	}
+	_, err = l.AcquireGlobal("internal")
+	if limitOf(t, err) != LimitGlobal {
+		t.Fatal("expected a double release not to free another slot")
+	}
+	second()
+	third()
+}
+
+func TestLimiterPerDestination(t *testing.T) {
+	l := New(Config{MaxPerDestination: 1})
+	release, err := l.AcquireDestination("internal", "10.0.0.2:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = l.AcquireDestination("internal", "10.0.0.2:80")
+	if limit := limitOf(t, err); limit != LimitConcurrency {
+		t.Fatalf("expected the concurrency limit, got %q", limit)
+	}
+	other, err := l.AcquireDestination("internal", "10.0.0.3:80")
+	if err != nil {
+		t.Fatalf("expected another destination to have its own limit, got %v", err)
+	}
+	release()
+	other()
+
+	again, err := l.AcquireDestination("internal", "10.0.0.2:80")
+	if err != nil {
+		t.Fatalf("expected the released slot to be reused, got %v", err)
+	}
+	again()
+
+	// Destinations are forgotten once their connections have closed, including rejected ones
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.destinations) != 0 {
+		t.Fatalf("expected no destinations to be kept, got %d", len(l.destinations))
+	}
+}
+
+func TestLimiterRate(t *testing.T) {
+	l := New(Config{RatePerDestination: 1, Burst: 2})
+	for x := range 2 {
+		release, err := l.AcquireDestination("internal", "10.0.0.2:80")
+		if err != nil {
+			t.Fatalf("connection %d: expected the burst to be allowed, got %v", x, err)
+		}
+		release()
+	}
+	_, err := l.AcquireDestination("internal", "10.0.0.2:80")
+	if limit := limitOf(t, err); limit != LimitRate {
+		t.Fatalf("expected the rate limit, got %q", limit)
+	}
+	if _, err := l.AcquireDestination("internal", "10.0.0.3:80"); err != nil {
+		t.Fatalf("expected another destination to have its own rate, got %v", err)
+	}
+
+	// A destination is kept until its rate has recovered, so closing connections doesn't reset it
+	l.mu.Lock()
+	_, kept := l.destinations["10.0.0.2:80"]
+	l.mu.Unlock()
+	if !kept {
+		t.Fatal("expected the destination's rate to be kept")
+	}
+}
+
+func TestLimiterQueue(t *testing.T) {
+	l := New(Config{MaxPerDestination: 1, Queue: 100 * time.Millisecond})
+	release, err := l.AcquireDestination("internal", "10.0.0.2:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is released, so the queued connection is rejected once the queue time has passed
+	start := time.Now()
+	_, err = l.AcquireDestination("internal", "10.0.0.2:80")
+	if limitOf(t, err) != LimitConcurrency || time.Since(start) < 100*time.Millisecond {
+		t.Fatalf("expected to be rejected after waiting, got %v after %v", err, time.Since(start))
+	}
+
+	// A slot released while waiting is taken
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		release()
+	}()
+	queued, err := l.AcquireDestination("internal", "10.0.0.2:80")
+	if err != nil {
+		t.Fatalf("expected the queued connection to get the released slot, got %v", err)
+	}
+	queued()
+}
+
+func TestLimiterDisabled(t *testing.T) {
+	for _, l := range []*Limiter{nil, New(Config{})} {
+		for range 100 {
+			global, err := l.AcquireGlobal("internal")
+			if err != nil {
+				t.Fatal(err)
+			}
+			dest, err := l.AcquireDestination("internal", "10.0.0.2:80")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer global()
+			defer dest()
+		}
+	}
+}
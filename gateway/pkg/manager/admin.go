@@ -0,0 +1,42 @@
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"gateway/pkg/connection"
+	"gateway/pkg/metrics"
+	"log/slog"
+	"net/http"
+)
+
+// startAdmin serves the gateway's metrics, and the debug endpoints when they are enabled, this is a blocking
+// function. The admin port is reachable from anywhere in the cluster (it is scraped for metrics), so the debug
+// endpoints are off by default as they describe the mesh around the pod
+func startAdmin(c *connection.Config) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	if c.AdminDebug {
+		handleDebug(mux, c)
+	}
+
+	addr := fmt.Sprintf("0.0.0.0:%d", c.AdminPort)
+	slog.Info("admin server", "addr", addr, "debug", c.AdminDebug)
+	err := http.ListenAndServe(addr, mux)
+	if err != nil {
+		slog.Error("admin server", "err", err)
+	}
+}
+
+func handleDebug(mux *http.ServeMux, c *connection.Config) {
+	mux.HandleFunc("/debug/peers", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(map[string]any{
+			"enabled": c.Peers != nil,
+			"ready":   c.Peers != nil && c.Peers.Ready(),
+			"peers":   c.DescribePeers(),
+		})
+		if err != nil {
+			slog.Error("debug peers", "err", err)
+		}
+	})
+}
@@ -5,10 +5,18 @@ package manager
 import (
 	"bufio"
 	"context"
+	"crypto/x509"
 	"flag"
 	"fmt"
+	"gateway/pkg/accesslog"
 	"gateway/pkg/connection"
+	"gateway/pkg/egress"
 	"gateway/pkg/gateway"
+	"gateway/pkg/intercept"
+	"gateway/pkg/limits"
+	"gateway/pkg/mesh"
+	"gateway/pkg/policy"
+	"gateway/pkg/shaping"
 	"gateway/pkg/watcher"
 	"io"
 	"log/slog"
@@ -18,6 +26,7 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/cilium/ebpf"
 	"github.com/cilium/ebpf/link"
@@ -94,6 +103,11 @@ func LoadEPF(c *connection.Config) error {
 		panic(err)
 	}
 
+	if tracker.objs.MapEgress == nil {
+		return fmt.Errorf("eBPF objects have no map_egress, they need to be regenerated with go generate")
+	}
+	c.Egress.SetMap(tracker.objs.MapEgress)
+
 	//defer objs.Close()
 	// Attach eBPF programs to the root cgroup
 	tracker.connect4Link, err = link.AttachCgroup(link.CgroupOptions{
@@ -139,6 +153,8 @@ func Cleanup() {
 }
 
 func Setup() (*connection.Config, error) {
+	var routesFile, peersFile, interceptHosts, interceptRoots string
+	var discovery bool
 	var c connection.Config
 
 	flag.StringVar(&c.Address, "address", "127.0.0.1", "Address to bind to, can also be a hostname")
@@ -149,7 +165,36 @@ func Setup() (*connection.Config, error) {
 	flag.IntVar(&c.ClusterTLSPort, "clusterTLSPort", 18443, "External port for cluster connectivity (TLS)")
 	flag.StringVar(&c.PodCIDR, "podCIDR", "10.244.0.0/16", "The CIDR range used for POD IP addresses")
 	flag.BoolVar(&c.Tunnel, "tunnel", false, "Run as a tunnel")
+	flag.StringVar(&c.TunnelFallback, "tunnelFallback", connection.TunnelFallbackDirect, "Tunnel destinations without a route are connected directly or refused (direct or refuse)")
+	flag.BoolVar(&discovery, "discovery", false, "Discover gateway-enabled pods and choose the transport per destination (watches every pod in the cluster)")
+	flag.StringVar(&peersFile, "discoveryFile", "", "Static list of gateway-enabled pods (JSON), instead of watching pods")
+	flag.StringVar(&routesFile, "tunnelRoutes", "", "Static tunnel routing table (JSON), instead of watching pods and nodes")
 	flag.BoolVar(&c.KTLS, "ktls", false, "Enable TLS to be performed by the kernel")
+	flag.BoolVar(&c.KTLSStrict, "ktlsStrict", false, "Fail to start if kTLS is enabled but the kernel can't offload TLS")
+	flag.StringVar(&c.TrustDomain, "trustDomain", "cluster.local", "The SPIFFE trust domain of peer identities")
+	flag.StringVar(&c.MTLSMode, "mtls", connection.MTLSPermissive, "Mutual TLS mode for incoming connections (disabled, permissive or strict)")
+	flag.StringVar(&c.TLSProfile, "tlsProfile", connection.ProfileIntermediate, "TLS profile for all gateway connections (modern, intermediate or fips)")
+	flag.IntVar(&c.AdminPort, "adminPort", 18002, "Port for the admin server (metrics), 0 disables it")
+	flag.BoolVar(&c.AdminDebug, "adminDebug", false, "Serve the unauthenticated /debug endpoints (e.g. the pod's peers) on the admin server")
+	flag.StringVar(&c.AllowedPorts, "allowedPorts", "", "Ports that remote gateways may connect to in this pod e.g. 80,8000-8100 (empty allows any)")
+	flag.StringVar(&c.Fallback, "fallback", connection.FallbackFail, "When the destination has no gateway fail, connect directly or retry (fail, direct or retry)")
+	flag.IntVar(&c.FallbackRetries, "fallbackRetries", 3, "Extra attempts to reach the destination's gateway with the retry fallback")
+	flag.DurationVar(&c.FallbackCacheTTL, "fallbackCacheTTL", 30*time.Second, "How long destinations without a gateway are remembered, 0 disables the cache")
+	flag.IntVar(&c.Limits.MaxConnections, "maxConnections", 0, "Concurrent connections across every listener, 0 is unlimited")
+	flag.IntVar(&c.Limits.MaxPerDestination, "maxPerDestination", 0, "Concurrent connections to a single destination, 0 is unlimited")
+	flag.Float64Var(&c.Limits.RatePerDestination, "ratePerDestination", 0, "New connections per second to a single destination, 0 is unlimited")
+	flag.IntVar(&c.Limits.Burst, "rateBurst", 10, "New connections allowed above the rate at once")
+	flag.DurationVar(&c.Limits.Queue, "limitQueue", 0, "How long connections over a limit wait before being rejected, 0 rejects straight away")
+	flag.DurationVar(&c.SniffTimeout, "sniffTimeout", 250*time.Millisecond, "How long to wait for a client's first bytes to classify the protocol, 0 disables sniffing")
+	flag.DurationVar(&c.TicketRotation, "ticketRotation", time.Hour, "How often TLS session ticket keys are rotated, 0 disables session resumption")
+	flag.StringVar(&c.AccessLog.Output, "accessLog", accesslog.OutputNone, "Where HTTP requests are logged, stdout or a file path (empty disables the access log)")
+	flag.StringVar(&c.AccessLog.Format, "accessLogFormat", accesslog.FormatJSON, "Format of the access log (json or common)")
+	flag.Float64Var(&c.AccessLog.Sample, "accessLogSample", 1, "Fraction of allowed requests that are logged, blocked requests are always logged")
+	flag.Int64Var(&c.AccessLog.MaxSize, "accessLogMaxSize", 100, "Size in MB at which the access log file is rotated, 0 never rotates")
+	flag.IntVar(&c.AccessLog.MaxBackups, "accessLogMaxBackups", 3, "Rotated access log files that are kept")
+	flag.StringVar(&interceptHosts, "interceptTLS", "", "Hosts whose HTTPS is decrypted e.g. api.openai.com,*.example.com (empty disables TLS interception)")
+	flag.IntVar(&c.InterceptPort, "interceptPort", 443, "Port of in-cluster destinations whose TLS may be intercepted")
+	flag.StringVar(&interceptRoots, "interceptRoots", "", "PEM bundle that intercepted upstreams are verified against (empty uses the system roots)")
 	flag.Parse()
 
 	// Parse the Environment variables
@@ -159,6 +204,11 @@ func Setup() (*connection.Config, error) {
 		c.KTLS = true
 	}
 
+	_, exists = os.LookupEnv("KTLS_STRICT")
+	if exists {
+		c.KTLSStrict = true
+	}
+
 	_, exists = os.LookupEnv("TUNNEL")
 	if exists {
 		c.Tunnel = true
@@ -183,6 +233,16 @@ func Setup() (*connection.Config, error) {
 	if exists {
 		c.Flush = true
 	}
+
+	_, exists = os.LookupEnv("ADMIN_DEBUG")
+	if exists {
+		c.AdminDebug = true
+	}
+
+	_, exists = os.LookupEnv("DISCOVERY")
+	if exists {
+		discovery = true
+	}
 	// Lookup for environment variable
 	envAddress, exists := os.LookupEnv("KUBE_NODE_NAME")
 	if exists {
@@ -211,29 +271,212 @@ func Setup() (*connection.Config, error) {
 		c.PodCIDR = podCIDR
 	}
 
+	// Overwrite the trust domain
+	trustDomain, exists := os.LookupEnv("TRUST_DOMAIN")
+	if exists {
+		c.TrustDomain = trustDomain
+	}
+
+	// Overwrite the mTLS mode
+	mtlsMode, exists := os.LookupEnv("MTLS_MODE")
+	if exists {
+		c.MTLSMode = mtlsMode
+	}
+	err = connection.ValidateMTLSMode(c.MTLSMode)
+	if err != nil {
+		return nil, err
+	}
+
+	// Overwrite the TLS profile
+	tlsProfile, exists := os.LookupEnv("TLS_PROFILE")
+	if exists {
+		c.TLSProfile = tlsProfile
+	}
+	err = connection.ValidateTLSProfile(c.TLSProfile)
+	if err != nil {
+		return nil, err
+	}
+
+	// Overwrite the allowed ports
+	allowedPorts, exists := os.LookupEnv("ALLOWED_PORTS")
+	if exists {
+		c.AllowedPorts = allowedPorts
+	}
+	err = c.LoadTargetRestrictions()
+	if err != nil {
+		return nil, err
+	}
+
+	// Overwrite the fallback for destinations without a gateway
+	fallback, exists := os.LookupEnv("FALLBACK")
+	if exists {
+		c.Fallback = fallback
+	}
+	err = connection.ValidateFallback(c.Fallback)
+	if err != nil {
+		return nil, err
+	}
+
+	// Overwrite the connection limits
+	err = loadLimits(&c.Limits)
+	if err != nil {
+		return nil, err
+	}
+	c.Limiter = limits.New(c.Limits)
+
+	// Overwrite the session ticket rotation
+	ticketRotation, exists := os.LookupEnv("TICKET_ROTATION")
+	if exists {
+		c.TicketRotation, err = time.ParseDuration(ticketRotation)
+		if err != nil {
+			return nil, fmt.Errorf("parsing TICKET_ROTATION: %v", err)
+		}
+	}
+	err = c.CheckKTLS()
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.LoadSessionResumption()
+	if err != nil {
+		return nil, err
+	}
+
+	// Tunnel routing, from a static file or the cluster (started with the watchers)
+	if c.Tunnel {
+		tunnelFallback, exists := os.LookupEnv("TUNNEL_FALLBACK")
+		if exists {
+			c.TunnelFallback = tunnelFallback
+		}
+		err = connection.ValidateTunnelFallback(c.TunnelFallback)
+		if err != nil {
+			return nil, err
+		}
+		envRoutes, exists := os.LookupEnv("TUNNEL_ROUTES")
+		if exists {
+			routesFile = envRoutes
+		}
+		c.Routes = mesh.NewRoutes()
+		if routesFile != "" {
+			err = c.Routes.LoadFile(routesFile)
+			if err != nil {
+				return nil, err
+			}
+			c.StaticRoutes = true
+		}
+		c.ProxyFunc = c.TunnelRoute
+	}
+
+	// Mesh discovery, from a static file or the cluster (started with the watchers)
+	envPeers, exists := os.LookupEnv("DISCOVERY_FILE")
+	if exists {
+		peersFile = envPeers
+	}
+	if discovery || peersFile != "" {
+		c.Peers = mesh.NewPeers()
+		if peersFile != "" {
+			err = c.Peers.LoadFile(peersFile)
+			if err != nil {
+				return nil, err
+			}
+			c.StaticPeers = true
+		}
+	}
+
 	c.AITransaction = &gateway.AITransaction{}
 
+	// Overwrite the access log
+	err = loadAccessLog(&c.AccessLog)
+	if err != nil {
+		return nil, err
+	}
+	c.AITransaction.AccessLog, err = accesslog.New(c.AccessLog)
+	if err != nil {
+		return nil, err
+	}
+	c.Policies = &policy.Store{}
+	c.Shaper = shaping.New(c.Policies)
+	c.Egress = egress.New(c.Policies)
+
+	// TLS interception, the pod's intermediate CA comes from its secret
+	envIntercept, exists := os.LookupEnv("INTERCEPT_TLS")
+	if exists {
+		interceptHosts = envIntercept
+	}
+	if interceptHosts != "" {
+		c.Intercept, err = intercept.New([]byte(os.Getenv("SMESH-INTERCEPT-CERT")), []byte(os.Getenv("SMESH-INTERCEPT-KEY")), strings.Split(interceptHosts, ","))
+		if err != nil {
+			return nil, err
+		}
+		c.Egress.Intercept = c.Intercept.Matches
+	}
+	envRoots, exists := os.LookupEnv("INTERCEPT_ROOTS")
+	if exists {
+		interceptRoots = envRoots
+	}
+	if interceptRoots != "" {
+		c.InterceptCAs, err = loadRoots(interceptRoots)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return &c, nil
 }
 
 // This is a blocking function
 func Start(c *connection.Config) error {
-	slog.Info("mode", "Endpoint", c.Endpoint, "Encryption", c.Encrypt, "kTLS", c.KTLS, "AI", c.AI)
+	slog.Info("mode", "Endpoint", c.Endpoint, "Encryption", c.Encrypt, "kTLS", c.KTLS, "AI", c.AI, "mTLS", c.MTLSMode, "TLS profile", c.TLSProfile)
 	slog.Info("features", "NETFLUSH", c.Flush, "TOKEN_OVERRIDE", len(os.Getenv("KUBE-GATEWAY-TOKEN")) != 0)
 
-	if c.AI { // If AI is enabled then watch the configmaps
-		go func() {
-			if len(c.Pids) != 0 {
-				w := watcher.NewWatcher(int(c.Pids[0]), os.Getenv("KUBE-GATEWAY-TOKEN"), c.AITransaction)
-				err := w.Watch()
-				slog.Error("Unable to create watcher", "err", err)
-			}
+	// Watch the configmap for AI and connection policies
+	go func() {
+		if len(c.Pids) != 0 {
+			w := watcher.NewWatcher(int(c.Pids[0]), os.Getenv("KUBE-GATEWAY-TOKEN"), c.AITransaction, c.Policies)
+			err := w.Watch()
+			slog.Error("Unable to create watcher", "err", err)
+		}
 
-		}()
-	}
+	}()
+
+	// Watch pods and nodes for the tunnel routes and mesh peers, unless they're from static files
+	go func() {
+		var routes *mesh.Routes
+		var peers *mesh.Peers
+		if c.Tunnel && !c.StaticRoutes {
+			routes = c.Routes
+		}
+		if c.Peers != nil && !c.StaticPeers {
+			peers = c.Peers
+		}
+		if (routes != nil || peers != nil) && len(c.Pids) != 0 {
+			w := watcher.NewWatcher(int(c.Pids[0]), os.Getenv("KUBE-GATEWAY-TOKEN"), c.AITransaction, c.Policies)
+			err := w.WatchMesh(routes, peers)
+			slog.Error("Unable to watch the mesh", "err", err)
+		}
+
+	}()
 
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
+
+	// Resolve the egress rules and read their credentials
+	go func() {
+		var secrets func(string) (map[string][]byte, error)
+		if len(c.Pids) != 0 {
+			w := watcher.NewWatcher(int(c.Pids[0]), os.Getenv("KUBE-GATEWAY-TOKEN"), c.AITransaction, c.Policies)
+			var err error
+			secrets, err = w.Secrets()
+			if err != nil {
+				slog.Error("Unable to read egress secrets", "err", err)
+			}
+		}
+		c.Egress.Run(ctx, secrets)
+	}()
+
+	if c.AdminPort != 0 {
+		go startAdmin(c)
+	}
 	// Start the proxy server on the localhost
 	// We only demonstrate IPv4 in this example, but the same approach can be used for IPv6
 
@@ -279,9 +522,11 @@ func Start(c *connection.Config) error {
 			defer externalTLSListener.Close()
 			if c.KTLS {
 				go c.StartkTLSListener(externalTLSListener)
+				go c.WatchKTLSStats()
 			} else {
 				go c.StartTLSListener(externalTLSListener)
 			}
+			go c.RotateSessionTickets()
 		}
 	}
 
@@ -321,3 +566,70 @@ func cat() {
 	defer file.Close()
 	readLines(file)
 }
+
+// loadLimits overwrites the connection limits from the environment
+func loadLimits(l *limits.Config) error {
+	var err error
+	if v, exists := os.LookupEnv("MAX_CONNECTIONS"); exists {
+		l.MaxConnections, err = strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("parsing MAX_CONNECTIONS: %v", err)
+		}
+	}
+	if v, exists := os.LookupEnv("MAX_PER_DESTINATION"); exists {
+		l.MaxPerDestination, err = strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("parsing MAX_PER_DESTINATION: %v", err)
+		}
+	}
+	if v, exists := os.LookupEnv("RATE_PER_DESTINATION"); exists {
+		l.RatePerDestination, err = strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("parsing RATE_PER_DESTINATION: %v", err)
+		}
+	}
+	if v, exists := os.LookupEnv("RATE_BURST"); exists {
+		l.Burst, err = strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("parsing RATE_BURST: %v", err)
+		}
+	}
+	if v, exists := os.LookupEnv("LIMIT_QUEUE"); exists {
+		l.Queue, err = time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("parsing LIMIT_QUEUE: %v", err)
+		}
+	}
+	return nil
+}
+
+// loadAccessLog overrides the access log flags from the environment
+func loadAccessLog(l *accesslog.Config) error {
+	if v, exists := os.LookupEnv("ACCESS_LOG"); exists {
+		l.Output = v
+	}
+	if v, exists := os.LookupEnv("ACCESS_LOG_FORMAT"); exists {
+		l.Format = v
+	}
+	if v, exists := os.LookupEnv("ACCESS_LOG_SAMPLE"); exists {
+		sample, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("parsing ACCESS_LOG_SAMPLE: %v", err)
+		}
+		l.Sample = sample
+	}
+	return nil
+}
+
+// loadRoots reads a PEM bundle of CA certificates
+func loadRoots(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading intercept roots: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates in intercept roots [%s]", path)
+	}
+	return pool, nil
+}
@@ -29,6 +29,13 @@ type mirrorsConfig struct {
 	_               [3]byte
 }
 
+type mirrorsEgress struct {
+	_       structs.HostLayout
+	DstAddr uint32
+	DstPort uint16
+	Pad     uint16
+}
+
 type mirrorsSocket struct {
 	_       structs.HostLayout
 	SrcAddr uint32
@@ -89,6 +96,7 @@ type mirrorsProgramSpecs struct {
 // It can be passed ebpf.CollectionSpec.Assign.
 type mirrorsMapSpecs struct {
 	MapConfig *ebpf.MapSpec `ebpf:"map_config"`
+	MapEgress *ebpf.MapSpec `ebpf:"map_egress"`
 	MapPids   *ebpf.MapSpec `ebpf:"map_pids"`
 	MapPorts  *ebpf.MapSpec `ebpf:"map_ports"`
 	MapSocks  *ebpf.MapSpec `ebpf:"map_socks"`
@@ -121,6 +129,7 @@ func (o *mirrorsObjects) Close() error {
 // It can be passed to loadMirrorsObjects or ebpf.CollectionSpec.LoadAndAssign.
 type mirrorsMaps struct {
 	MapConfig *ebpf.Map `ebpf:"map_config"`
+	MapEgress *ebpf.Map `ebpf:"map_egress"`
 	MapPids   *ebpf.Map `ebpf:"map_pids"`
 	MapPorts  *ebpf.Map `ebpf:"map_ports"`
 	MapSocks  *ebpf.Map `ebpf:"map_socks"`
@@ -129,6 +138,7 @@ type mirrorsMaps struct {
 func (m *mirrorsMaps) Close() error {
 	return _MirrorsClose(
 		m.MapConfig,
+		m.MapEgress,
 		m.MapPids,
 		m.MapPorts,
 		m.MapSocks,
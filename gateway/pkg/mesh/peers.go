@@ -0,0 +1,140 @@
+package mesh
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// Annotations set on pods by the watcher
+const (
+	annotationEnabled = "kube-gateway.io/enabled"
+	annotationEncrypt = "kube-gateway.io/encrypt"
+	annotationKTLS    = "kube-gateway.io/ktls"
+	annotationMTLS    = "kube-gateway.io/mtls"
+)
+
+// Peer is a pod running a kube-gateway and the capabilities of that gateway
+type Peer struct {
+	Address   string `json:"address"`
+	Name      string `json:"name,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	Encrypt   bool   `json:"encrypt"` // Has a TLS listener
+	KTLS      bool   `json:"ktls"`
+	MTLS      string `json:"mtls,omitempty"` // disabled, permissive or strict (empty is permissive)
+}
+
+// Peers is the set of gateway-enabled pods, keyed by pod IP
+type Peers struct {
+	mu    sync.RWMutex
+	peers map[string]Peer
+	ready atomic.Bool
+}
+
+func NewPeers() *Peers {
+	return &Peers{peers: map[string]Peer{}}
+}
+
+// Ready is true once the peers have been loaded, until then every destination is treated as unknown
+func (p *Peers) Ready() bool {
+	return p.ready.Load()
+}
+
+// Lookup returns the gateway in front of a pod, ok is false if the pod isn't meshed
+func (p *Peers) Lookup(podIP string) (Peer, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	peer, ok := p.peers[podIP]
+	return peer, ok
+}
+
+// List returns every peer sorted by address
+func (p *Peers) List() []Peer {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	list := make([]Peer, 0, len(p.peers))
+	for _, peer := range p.peers {
+		list = append(list, peer)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Address < list[j].Address })
+	return list
+}
+
+func (p *Peers) set(peer Peer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.peers[peer.Address] = peer
+}
+
+func (p *Peers) delete(podIP string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.peers, podIP)
+}
+
+// updatePod adds a pod once the watcher has enabled its gateway, and removes it otherwise
+func (p *Peers) updatePod(pod *v1.Pod) {
+	addresses := podAddresses(pod)
+	if pod.Annotations[annotationEnabled] == "" || pod.DeletionTimestamp != nil {
+		for _, address := range addresses {
+			p.delete(address)
+		}
+		return
+	}
+	for _, address := range addresses {
+		p.set(Peer{
+			Address:   address,
+			Name:      pod.Name,
+			Namespace: pod.Namespace,
+			Encrypt:   pod.Annotations[annotationEncrypt] != "",
+			KTLS:      pod.Annotations[annotationKTLS] != "",
+			MTLS:      pod.Annotations[annotationMTLS],
+		})
+	}
+}
+
+func (p *Peers) deletePod(pod *v1.Pod) {
+	for _, address := range podAddresses(pod) {
+		p.delete(address)
+	}
+}
+
+// LoadFile reads a static list of peers, this is mainly for testing outside of a cluster
+//
+//	[{"address": "10.244.1.5", "encrypt": true, "mtls": "strict"}]
+func (p *Peers) LoadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var peers []Peer
+	err = json.Unmarshal(data, &peers)
+	if err != nil {
+		return fmt.Errorf("parsing peers [%s]: %v", path, err)
+	}
+	for _, peer := range peers {
+		if net.ParseIP(peer.Address) == nil {
+			return fmt.Errorf("peers [%s]: invalid address [%s]", path, peer.Address)
+		}
+		p.set(peer)
+	}
+	p.ready.Store(true)
+	return nil
+}
+
+func podAddresses(pod *v1.Pod) []string {
+	var addresses []string
+	for _, ip := range pod.Status.PodIPs {
+		addresses = append(addresses, ip.IP)
+	}
+	if len(addresses) == 0 && pod.Status.PodIP != "" {
+		addresses = append(addresses, pod.Status.PodIP)
+	}
+	return addresses
+}
@@ -0,0 +1,102 @@
+package mesh
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func testPod(name string, annotations map[string]string, ips ...string) *v1.Pod {
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Annotations: annotations}}
+	for _, ip := range ips {
+		pod.Status.PodIPs = append(pod.Status.PodIPs, v1.PodIP{IP: ip})
+	}
+	return pod
+}
+
+func TestPeersUpdatePod(t *testing.T) {
+	p := NewPeers()
+	p.updatePod(testPod("tls", map[string]string{annotationEnabled: "true", annotationEncrypt: "true", annotationKTLS: "true", annotationMTLS: "strict"}, "10.244.1.5", "fd00::5"))
+	p.updatePod(testPod("plaintext", map[string]string{annotationEnabled: "true"}, "10.244.1.6"))
+	p.updatePod(testPod("unmeshed", nil, "10.244.1.7"))
+	p.updatePod(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "legacy", Annotations: map[string]string{annotationEnabled: "true"}}, Status: v1.PodStatus{PodIP: "10.244.1.8"}})
+
+	tests := []struct {
+		podIP    string
+		expected Peer
+		ok       bool
+	}{
+		{"10.244.1.5", Peer{Address: "10.244.1.5", Name: "tls", Namespace: "default", Encrypt: true, KTLS: true, MTLS: "strict"}, true},
+		{"fd00::5", Peer{Address: "fd00::5", Name: "tls", Namespace: "default", Encrypt: true, KTLS: true, MTLS: "strict"}, true},
+		{"10.244.1.6", Peer{Address: "10.244.1.6", Name: "plaintext", Namespace: "default"}, true},
+		{"10.244.1.7", Peer{}, false},
+		{"10.244.1.8", Peer{Address: "10.244.1.8", Name: "legacy"}, true}, // PodIP without PodIPs
+	}
+	for _, test := range tests {
+		peer, ok := p.Lookup(test.podIP)
+		if peer != test.expected || ok != test.ok {
+			t.Errorf("%s: expected %+v %v, got %+v %v", test.podIP, test.expected, test.ok, peer, ok)
+		}
+	}
+	if list := p.List(); len(list) != 4 || list[0].Address != "10.244.1.5" || list[3].Address != "fd00::5" {
+		t.Errorf("expected 4 peers sorted by address, got %+v", list)
+	}
+
+	// Removing the annotation, terminating and deleting the pod all remove its peers
+	p.updatePod(testPod("plaintext", nil, "10.244.1.6"))
+	terminating := testPod("tls", map[string]string{annotationEnabled: "true", annotationEncrypt: "true"}, "10.244.1.5", "fd00::5")
+	terminating.DeletionTimestamp = &metav1.Time{}
+	p.updatePod(terminating)
+	p.deletePod(&v1.Pod{Status: v1.PodStatus{PodIP: "10.244.1.8"}})
+	for _, podIP := range []string{"10.244.1.5", "fd00::5", "10.244.1.6", "10.244.1.8"} {
+		if _, ok := p.Lookup(podIP); ok {
+			t.Errorf("%s: expected the peer to be removed", podIP)
+		}
+	}
+	if p.Ready() {
+		t.Error("expected the peers not to be ready until they are synced")
+	}
+}
+
+func TestPeersLoadFile(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  string
+		err   bool
+		peers int
+	}{
+		{"Peers", `[{"address":"10.244.1.5","encrypt":true,"mtls":"strict"},{"address":"fd00::6"}]`, false, 2},
+		{"Empty", `[]`, false, 0},
+		{"Malformed JSON", `[{"address":`, true, 0},
+		{"Not a list", `{"address":"10.244.1.5"}`, true, 0},
+		{"Invalid address", `[{"address":"pod-01"}]`, true, 0},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "peers.json")
+		err := os.WriteFile(path, []byte(test.data), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := NewPeers()
+		err = p.LoadFile(path)
+		if (err != nil) != test.err {
+			t.Errorf("%s: expected error %v, got %v", test.name, test.err, err)
+			continue
+		}
+		if test.err {
+			if p.Ready() {
+				t.Errorf("%s: expected the peers not to be ready", test.name)
+			}
+			continue
+		}
+		if !p.Ready() || len(p.List()) != test.peers {
+			t.Errorf("%s: expected %d ready peers, got %d (ready %v)", test.name, test.peers, len(p.List()), p.Ready())
+		}
+	}
+	if NewPeers().LoadFile(filepath.Join(t.TempDir(), "missing.json")) == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
@@ -0,0 +1,126 @@
+package mesh
+
+import (
+	"encoding/json"
+	"fmt"
+	"gateway/pkg/metrics"
+	"net"
+	"os"
+	"sync"
+)
+
+var routeCount = metrics.NewGaugeVec("kube_gateway_tunnel_routes", "Destinations known to the tunnel routing table", "kind")
+
+// Routes maps destination pod addresses to the address of the node gateway that serves them. Pods are matched on
+// their own address first, then on the pod CIDRs of the nodes so that pods which haven't been seen yet still resolve
+type Routes struct {
+	mu    sync.RWMutex
+	pods  map[string]string    // Pod IP -> node address
+	nodes map[string]nodeRoute // Node name -> pod CIDRs and address
+}
+
+type nodeRoute struct {
+	cidrs   []*net.IPNet
+	address string
+}
+
+// routesFile is the format of a static routing table, nodes are keyed by pod CIDR
+//
+//	{"pods": {"10.244.1.5": "172.18.0.3"}, "nodes": {"10.244.2.0/24": "172.18.0.4"}}
+type routesFile struct {
+	Pods  map[string]string `json:"pods"`
+	Nodes map[string]string `json:"nodes"`
+}
+
+func NewRoutes() *Routes {
+	return &Routes{
+		pods:  map[string]string{},
+		nodes: map[string]nodeRoute{},
+	}
+}
+
+// Lookup returns the node gateway address for a destination pod
+func (r *Routes) Lookup(podIP string) (string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if address, ok := r.pods[podIP]; ok {
+		return address, true
+	}
+	ip := net.ParseIP(podIP)
+	if ip == nil {
+		return "", false
+	}
+	for _, node := range r.nodes {
+		for _, cidr := range node.cidrs {
+			if cidr.Contains(ip) {
+				return node.address, true
+			}
+		}
+	}
+	return "", false
+}
+
+// SetPod routes a pod address to the node it is running on
+func (r *Routes) SetPod(podIP, nodeAddress string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pods[podIP] = nodeAddress
+	routeCount.WithLabelValues("pod").Set(float64(len(r.pods)))
+}
+
+func (r *Routes) DeletePod(podIP string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.pods, podIP)
+	routeCount.WithLabelValues("pod").Set(float64(len(r.pods)))
+}
+
+// SetNode routes the pod CIDRs of a node to its address
+func (r *Routes) SetNode(name string, podCIDRs []string, address string) error {
+	route := nodeRoute{address: address}
+	for _, c := range podCIDRs {
+		_, cidr, err := net.ParseCIDR(c)
+		if err != nil {
+			return fmt.Errorf("node [%s] pod CIDR: %v", name, err)
+		}
+		route.cidrs = append(route.cidrs, cidr)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nodes[name] = route
+	routeCount.WithLabelValues("node").Set(float64(len(r.nodes)))
+	return nil
+}
+
+func (r *Routes) DeleteNode(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.nodes, name)
+	routeCount.WithLabelValues("node").Set(float64(len(r.nodes)))
+}
+
+// LoadFile reads a static routing table, this is mainly for testing tunnel mode outside of a cluster
+func (r *Routes) LoadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var f routesFile
+	err = json.Unmarshal(data, &f)
+	if err != nil {
+		return fmt.Errorf("parsing routes [%s]: %v", path, err)
+	}
+	for podIP, address := range f.Pods {
+		if net.ParseIP(podIP) == nil {
+			return fmt.Errorf("routes [%s]: invalid pod address [%s]", path, podIP)
+		}
+		r.SetPod(podIP, address)
+	}
+	for cidr, address := range f.Nodes {
+		err = r.SetNode(cidr, []string{cidr}, address)
+		if err != nil {
+			return fmt.Errorf("routes [%s]: %v", path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package mesh
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRoutesLookup(t *testing.T) {
+	r := NewRoutes()
+	r.SetPod("10.244.1.5", "172.18.0.3")
+	r.SetPod("10.244.2.9", "172.18.0.9") // Pod addresses are preferred to the node CIDRs
+	err := r.SetNode("node-2", []string{"10.244.2.0/24", "fd00:10:244:2::/64"}, "172.18.0.4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		podIP    string
+		expected string
+		ok       bool
+	}{
+		{"Pod", "10.244.1.5", "172.18.0.3", true},
+		{"Pod over its node CIDR", "10.244.2.9", "172.18.0.9", true},
+		{"Node CIDR", "10.244.2.7", "172.18.0.4", true},
+		{"Node IPv6 CIDR", "fd00:10:244:2::7", "172.18.0.4", true},
+		{"Unknown pod outside every CIDR", "10.244.1.6", "", false},
+		{"Outside the cluster", "192.168.1.1", "", false},
+		{"Not an address", "pod-01", "", false},
+	}
+	for _, test := range tests {
+		address, ok := r.Lookup(test.podIP)
+		if address != test.expected || ok != test.ok {
+			t.Errorf("%s: expected %q %v, got %q %v", test.name, test.expected, test.ok, address, ok)
+		}
+	}
+
+	// A deleted pod falls back to its node CIDR, and a deleted node's CIDRs are no longer routed
+	r.DeletePod("10.244.2.9")
+	if address, _ := r.Lookup("10.244.2.9"); address != "172.18.0.4" {
+		t.Errorf("expected the deleted pod to use its node CIDR, got %q", address)
+	}
+	r.DeleteNode("node-2")
+	if _, ok := r.Lookup("10.244.2.9"); ok {
+		t.Error("expected the deleted node's CIDRs not to be routed")
+	}
+
+	if r.SetNode("node-3", []string{"10.244.3.0"}, "172.18.0.5") == nil {
+		t.Error("expected an error for an invalid pod CIDR")
+	}
+}
+
+func TestRoutesLoadFile(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  string
+		err   bool
+		podIP string // Routed when the file loads
+	}{
+		{"Pods and nodes", `{"pods":{"10.244.1.5":"172.18.0.3"},"nodes":{"10.244.2.0/24":"172.18.0.4"}}`, false, "10.244.2.7"},
+		{"Empty", `{}`, false, ""},
+		{"Malformed JSON", `{"pods":`, true, ""},
+		{"Wrong type", `{"pods":["10.244.1.5"]}`, true, ""},
+		{"Invalid pod address", `{"pods":{"pod-01":"172.18.0.3"}}`, true, ""},
+		{"Invalid CIDR", `{"nodes":{"10.244.2.0":"172.18.0.4"}}`, true, ""},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "routes.json")
+		err := os.WriteFile(path, []byte(test.data), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := NewRoutes()
+		err = r.LoadFile(path)
+		if (err != nil) != test.err {
+			t.Errorf("%s: expected error %v, got %v", test.name, test.err, err)
+			continue
+		}
+		if test.podIP != "" {
+			if _, ok := r.Lookup(test.podIP); !ok {
+				t.Errorf("%s: expected %s to be routed", test.name, test.podIP)
+			}
+		}
+	}
+	if NewRoutes().LoadFile(filepath.Join(t.TempDir(), "missing.json")) == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+
+func TestRoutesWatch(t *testing.T) {
+	r := NewRoutes()
+	r.updatePod(&v1.Pod{Status: v1.PodStatus{HostIP: "172.18.0.3", PodIPs: []v1.PodIP{{IP: "10.244.1.5"}, {IP: "fd00::5"}}}})
+	r.updatePod(&v1.Pod{Status: v1.PodStatus{HostIP: "172.18.0.3", PodIP: "10.244.1.6"}})
+	r.updatePod(&v1.Pod{Spec: v1.PodSpec{HostNetwork: true}, Status: v1.PodStatus{HostIP: "172.18.0.3", PodIP: "172.18.0.3"}})
+	r.updatePod(&v1.Pod{Status: v1.PodStatus{PodIP: "10.244.1.7"}}) // Not scheduled yet
+	r.updateNode(&v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-2"},
+		Spec:       v1.NodeSpec{PodCIDR: "10.244.2.0/24"},
+		Status:     v1.NodeStatus{Addresses: []v1.NodeAddress{{Type: v1.NodeHostName, Address: "node-2"}, {Type: v1.NodeInternalIP, Address: "172.18.0.4"}}},
+	})
+	r.updateNode(&v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-3"},
+		Spec:       v1.NodeSpec{PodCIDRs: []string{"10.244.3.0/24"}},
+		Status:     v1.NodeStatus{Addresses: []v1.NodeAddress{{Type: v1.NodeExternalIP, Address: "203.0.113.1"}}},
+	})
+
+	tests := []struct {
+		podIP    string
+		expected string
+	}{
+		{"10.244.1.5", "172.18.0.3"},
+		{"fd00::5", "172.18.0.3"},
+		{"10.244.1.6", "172.18.0.3"},
+		{"172.18.0.3", ""}, // Host network pods aren't routed
+		{"10.244.1.7", ""}, // Nor are pods without a node
+		{"10.244.2.1", "172.18.0.4"},
+		{"10.244.3.1", ""}, // Nodes without an internal address aren't routed
+	}
+	for _, test := range tests {
+		if address, _ := r.Lookup(test.podIP); address != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.podIP, test.expected, address)
+		}
+	}
+}
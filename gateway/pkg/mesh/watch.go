@@ -0,0 +1,121 @@
+package mesh
+
+import (
+	"context"
+	"log/slog"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Watch keeps the tunnel routes and the peers in step with the Pods and Nodes in the cluster, either can be
+// nil if it isn't needed. This is a blocking function
+func Watch(ctx context.Context, client kubernetes.Interface, routes *Routes, peers *Peers) error {
+	factory := informers.NewSharedInformerFactory(client, 0)
+
+	_, err := factory.Core().V1().Pods().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { updatePod(obj, routes, peers) },
+		UpdateFunc: func(_, obj interface{}) { updatePod(obj, routes, peers) },
+		DeleteFunc: func(obj interface{}) {
+			pod, ok := deleted(obj).(*v1.Pod)
+			if !ok {
+				return
+			}
+			if routes != nil {
+				for _, address := range podAddresses(pod) {
+					routes.DeletePod(address)
+				}
+			}
+			if peers != nil {
+				peers.deletePod(pod)
+			}
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	if routes != nil {
+		_, err = factory.Core().V1().Nodes().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    func(obj interface{}) { routes.updateNode(obj) },
+			UpdateFunc: func(_, obj interface{}) { routes.updateNode(obj) },
+			DeleteFunc: func(obj interface{}) {
+				if node, ok := deleted(obj).(*v1.Node); ok {
+					routes.DeleteNode(node.Name)
+				}
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	slog.Info("watching the mesh", "routes", routes != nil, "peers", peers != nil)
+	factory.Start(ctx.Done())
+	factory.WaitForCacheSync(ctx.Done())
+	if peers != nil {
+		peers.ready.Store(true)
+		slog.Info("mesh peers discovered", "peers", len(peers.List()))
+	}
+	<-ctx.Done()
+	factory.Shutdown()
+	return ctx.Err()
+}
+
+func updatePod(obj interface{}, routes *Routes, peers *Peers) {
+	pod, ok := obj.(*v1.Pod)
+	if !ok {
+		return
+	}
+	if routes != nil {
+		routes.updatePod(pod)
+	}
+	if peers != nil {
+		peers.updatePod(pod)
+	}
+}
+
+func (r *Routes) updatePod(pod *v1.Pod) {
+	// Host network pods share the node address and don't need routing
+	if pod.Spec.HostNetwork || pod.Status.HostIP == "" {
+		return
+	}
+	for _, address := range podAddresses(pod) {
+		r.SetPod(address, pod.Status.HostIP)
+	}
+}
+
+func (r *Routes) updateNode(obj interface{}) {
+	node, ok := obj.(*v1.Node)
+	if !ok {
+		return
+	}
+	var address string
+	for _, a := range node.Status.Addresses {
+		if a.Type == v1.NodeInternalIP {
+			address = a.Address
+			break
+		}
+	}
+	if address == "" {
+		return
+	}
+	cidrs := node.Spec.PodCIDRs
+	if len(cidrs) == 0 && node.Spec.PodCIDR != "" {
+		cidrs = []string{node.Spec.PodCIDR}
+	}
+	err := r.SetNode(node.Name, cidrs, address)
+	if err != nil {
+		slog.Error("tunnel route", "node", node.Name, "err", err)
+	}
+}
+
+// deleted unwraps objects whose deletion the informer missed
+func deleted(obj interface{}) interface{} {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		return tombstone.Obj
+	}
+	return obj
+}
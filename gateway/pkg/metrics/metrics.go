@@ -0,0 +1,190 @@
+package metrics
+
+// A small registry of counters and gauges, written out in the Prometheus text format by the admin server.
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var registry struct {
+	sync.Mutex
+	families []*family
+}
+
+type family struct {
+	name   string
+	help   string
+	kind   string // counter or gauge
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]*value
+}
+
+type value struct {
+	labels string        // rendered label pairs e.g. {listener="tls"}
+	bits   atomic.Uint64 // float64 bits
+}
+
+func (v *value) add(delta float64) {
+	for {
+		old := v.bits.Load()
+		if v.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+delta)) {
+			return
+		}
+	}
+}
+
+func register(name, help, kind string, labels []string) *family {
+	f := &family{name: name, help: help, kind: kind, labels: labels, values: make(map[string]*value)}
+	registry.Lock()
+	registry.families = append(registry.families, f)
+	registry.Unlock()
+	return f
+}
+
+func (f *family) with(values ...string) *value {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s expects %d labels, got %d", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	v, ok := f.values[key]
+	if !ok {
+		v = &value{labels: renderLabels(f.labels, values)}
+		f.values[key] = v
+	}
+	return v
+}
+
+func renderLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for x := range names {
+		pairs[x] = fmt.Sprintf("%s=%q", names[x], values[x])
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Other is the label value of everything past the limit of a LabelSet
+const Other = "other"
+
+// LabelSet bounds the values of a label that a client controls (e.g. a path or host). Series are never removed
+// from the registry, so only the first max values are kept and anything after them is counted under Other
+type LabelSet struct {
+	max int
+
+	mu     sync.Mutex
+	values map[string]bool
+}
+
+func NewLabelSet(max int) *LabelSet {
+	return &LabelSet{max: max, values: make(map[string]bool)}
+}
+
+// Value returns v if it is already in the set or there is room for it, otherwise Other
+func (l *LabelSet) Value(v string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.values[v] {
+		return v
+	}
+	if len(l.values) >= l.max {
+		return Other
+	}
+	l.values[v] = true
+	return v
+}
+
+// CounterVec is a set of counters that share a name and label names
+type CounterVec struct{ f *family }
+
+// Counter only goes up
+type Counter struct{ v *value }
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{f: register(name, help, "counter", labels)}
+}
+
+func (c *CounterVec) WithLabelValues(values ...string) Counter {
+	return Counter{v: c.f.with(values...)}
+}
+
+func (c Counter) Inc() { c.v.add(1) }
+
+func (c Counter) Add(delta float64) {
+	if delta < 0 {
+		return // Counters can't go backwards
+	}
+	c.v.add(delta)
+}
+
+// GaugeVec is a set of gauges that share a name and label names
+type GaugeVec struct{ f *family }
+
+// Gauge can go up and down
+type Gauge struct{ v *value }
+
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{f: register(name, help, "gauge", labels)}
+}
+
+func (g *GaugeVec) WithLabelValues(values ...string) Gauge {
+	return Gauge{v: g.f.with(values...)}
+}
+
+func (g Gauge) Set(v float64)     { g.v.bits.Store(math.Float64bits(v)) }
+func (g Gauge) Add(delta float64) { g.v.add(delta) }
+func (g Gauge) Inc()              { g.v.add(1) }
+func (g Gauge) Dec()              { g.v.add(-1) }
+
+// Write writes every metric in the Prometheus text exposition format
+func Write(w io.Writer) error {
+	registry.Lock()
+	families := append([]*family(nil), registry.families...)
+	registry.Unlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	for _, f := range families {
+		f.mu.Lock()
+		values := make([]*value, 0, len(f.values))
+		for _, v := range f.values {
+			values = append(values, v)
+		}
+		f.mu.Unlock()
+		if len(values) == 0 {
+			continue
+		}
+		sort.Slice(values, func(i, j int) bool { return values[i].labels < values[j].labels })
+
+		_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+		if err != nil {
+			return err
+		}
+		for _, v := range values {
+			_, err = fmt.Fprintf(w, "%s%s %v\n", f.name, v.labels, math.Float64frombits(v.bits.Load()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Handler serves the metrics, it is mounted on /metrics by the admin server
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		Write(w)
+	})
+}
@@ -0,0 +1,35 @@
+package metrics
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLabelSet(t *testing.T) {
+	l := NewLabelSet(2)
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{"/a", "/a"},
+		{"/b", "/b"},
+		{"/c", Other}, // The set is full
+		{"/a", "/a"},  // Values already in the set are kept
+		{"/d", Other},
+	}
+	for _, test := range tests {
+		if got := l.Value(test.value); got != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.value, test.expected, got)
+		}
+	}
+
+	// However many values a client sends, the family only grows by the limit and Other
+	c := NewCounterVec("test_label_set_total", "LabelSet test", "path")
+	paths := NewLabelSet(10)
+	for x := range 1000 {
+		c.WithLabelValues(paths.Value(fmt.Sprintf("/%d", x))).Inc()
+	}
+	if len(c.f.values) != 11 {
+		t.Errorf("expected 11 series, got %d", len(c.f.values))
+	}
+}
@@ -0,0 +1,102 @@
+package policy
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Verdict is the outcome of evaluating an authorization policy
+type Verdict string
+
+const (
+	Allow Verdict = "allow"
+	Deny  Verdict = "deny"
+	Audit Verdict = "audit" // Allow the connection, but log that it matched
+)
+
+// Peer is the identity of the remote gateway, a nil peer didn't present a certificate
+type Peer struct {
+	Namespace      string
+	ServiceAccount string
+	Pod            string
+}
+
+// Authorization is evaluated by the receiving gateway once it knows who the peer is and which target it wants
+type Authorization struct {
+	Default Verdict `json:"default,omitempty"` // Verdict when no rule matches (allow if not set)
+	Rules   []Rule  `json:"rules,omitempty"`
+}
+
+// Rule matches a peer and target port, an empty selector matches anything and "*" can be used as a wildcard
+type Rule struct {
+	Name            string   `json:"name,omitempty"`
+	Namespaces      []string `json:"namespaces,omitempty"`
+	ServiceAccounts []string `json:"serviceAccounts,omitempty"`
+	Pods            []string `json:"pods,omitempty"`
+	Ports           []int    `json:"ports,omitempty"`
+	Unauthenticated bool     `json:"unauthenticated,omitempty"` // Only match peers without a certificate
+	Action          Verdict  `json:"action"`
+}
+
+// Evaluate returns the verdict of the first matching rule and its name
+func (a *Authorization) Evaluate(p *Peer, port int) (Verdict, string) {
+	if a == nil {
+		return Allow, ""
+	}
+	for x := range a.Rules {
+		if a.Rules[x].matches(p, port) {
+			return a.Rules[x].Action, a.Rules[x].Name
+		}
+	}
+	if a.Default == "" {
+		return Allow, "default"
+	}
+	return a.Default, "default"
+}
+
+func (r *Rule) matches(p *Peer, port int) bool {
+	if len(r.Ports) != 0 && !slices.Contains(r.Ports, port) {
+		return false
+	}
+	if r.Unauthenticated {
+		return p == nil
+	}
+	if len(r.Namespaces) == 0 && len(r.ServiceAccounts) == 0 && len(r.Pods) == 0 {
+		return true
+	}
+	if p == nil {
+		return false // Identity selectors never match a peer without an identity
+	}
+	return selected(r.Namespaces, p.Namespace) && selected(r.ServiceAccounts, p.ServiceAccount) && selected(r.Pods, p.Pod)
+}
+
+func selected(selector []string, value string) bool {
+	return len(selector) == 0 || slices.Contains(selector, "*") || slices.Contains(selector, value)
+}
+
+func (v Verdict) validate() error {
+	switch v {
+	case Allow, Deny, Audit:
+		return nil
+	}
+	return fmt.Errorf("unknown verdict [%s], expected allow, deny or audit", v)
+}
+
+func (a *Authorization) validate() error {
+	if a.Default != "" {
+		err := a.Default.validate()
+		if err != nil {
+			return fmt.Errorf("default: %v", err)
+		}
+	}
+	for x := range a.Rules {
+		err := a.Rules[x].Action.validate()
+		if err != nil {
+			return fmt.Errorf("rule %d [%s]: %v", x, a.Rules[x].Name, err)
+		}
+		if a.Rules[x].Unauthenticated && (len(a.Rules[x].Namespaces) != 0 || len(a.Rules[x].ServiceAccounts) != 0 || len(a.Rules[x].Pods) != 0) {
+			return fmt.Errorf("rule %d [%s]: unauthenticated rules can't select identities", x, a.Rules[x].Name)
+		}
+	}
+	return nil
+}
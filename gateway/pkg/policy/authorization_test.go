@@ -0,0 +1,69 @@
+package policy
+
+import "testing"
+
+func TestAuthorizationEvaluate(t *testing.T) {
+	frontend := &Peer{Namespace: "shop", ServiceAccount: "frontend", Pod: "frontend-1"}
+	batch := &Peer{Namespace: "jobs", ServiceAccount: "batch", Pod: "batch-1"}
+
+	rules := &Authorization{
+		Default: Deny,
+		Rules: []Rule{
+			{Name: "no-admin-port", Ports: []int{9000}, Action: Deny},
+			{Name: "frontend", Namespaces: []string{"shop"}, ServiceAccounts: []string{"frontend"}, Action: Allow},
+			{Name: "jobs", Namespaces: []string{"jobs"}, ServiceAccounts: []string{"*"}, Ports: []int{8080}, Action: Audit},
+			{Name: "health", Unauthenticated: true, Ports: []int{8081}, Action: Allow},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		policy  *Authorization
+		peer    *Peer
+		port    int
+		verdict Verdict
+		rule    string
+	}{
+		{"no policy", nil, frontend, 80, Allow, ""},
+		{"empty policy", &Authorization{}, frontend, 80, Allow, "default"},
+		{"default allow", &Authorization{Default: Allow, Rules: []Rule{{Namespaces: []string{"other"}, Action: Deny}}}, frontend, 80, Allow, "default"},
+		{"first match wins over a later allow", rules, frontend, 9000, Deny, "no-admin-port"},
+		{"namespace and service account", rules, frontend, 80, Allow, "frontend"},
+		{"service account wildcard", rules, batch, 8080, Audit, "jobs"},
+		{"port not selected", rules, batch, 80, Deny, "default"},
+		{"unauthenticated peer", rules, nil, 8081, Allow, "health"},
+		{"unauthenticated rule skips identities", rules, frontend, 8081, Allow, "frontend"},
+		{"identity selectors skip unauthenticated peers", rules, nil, 80, Deny, "default"},
+		{"pod selector", &Authorization{Default: Deny, Rules: []Rule{{Name: "pod", Pods: []string{"batch-1"}, Action: Allow}}}, batch, 80, Allow, "pod"},
+		{"pod selector mismatch", &Authorization{Default: Deny, Rules: []Rule{{Name: "pod", Pods: []string{"batch-2"}, Action: Allow}}}, batch, 80, Deny, "default"},
+		{"rule without selectors", &Authorization{Default: Deny, Rules: []Rule{{Name: "all", Action: Audit}}}, nil, 80, Audit, "all"},
+	}
+	for _, test := range tests {
+		verdict, rule := test.policy.Evaluate(test.peer, test.port)
+		if verdict != test.verdict || rule != test.rule {
+			t.Errorf("%s: expected %s (%s), got %s (%s)", test.name, test.verdict, test.rule, verdict, rule)
+		}
+	}
+}
+
+func TestAuthorizationValidate(t *testing.T) {
+	tests := []struct {
+		policy string
+		valid  bool
+	}{
+		{`{"authorization":{"default":"deny","rules":[{"namespaces":["shop"],"action":"allow"}]}}`, true},
+		{`{"authorization":{"default":"maybe"}}`, false},
+		{`{"authorization":{"rules":[{"namespaces":["shop"]}]}}`, false}, // No action
+		{`{"authorization":{"rules":[{"unauthenticated":true,"pods":["a"],"action":"allow"}]}}`, false},
+	}
+	for _, test := range tests {
+		var s Store
+		err := s.Update([]byte(test.policy))
+		if (err == nil) != test.valid {
+			t.Errorf("%s: expected valid %v, got %v", test.policy, test.valid, err)
+		}
+		if err != nil && s.Load().Authorization != nil {
+			t.Errorf("%s: an invalid policy shouldn't replace the active one", test.policy)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package policy
+
+import (
+	"fmt"
+	"net"
+	"slices"
+)
+
+// Bandwidth limits the traffic of a pod with token buckets, rates are in bytes per second and 0 is unlimited.
+// Egress is the traffic the pod sends and ingress is the traffic it receives. The pod-wide limits are shared by
+// every connection, rules add a further limit shared by the connections they match
+type Bandwidth struct {
+	Egress  int64           `json:"egress,omitempty"`
+	Ingress int64           `json:"ingress,omitempty"`
+	Burst   int64           `json:"burst,omitempty"` // Bytes that can be sent at once (the rate if not set)
+	Rules   []BandwidthRule `json:"rules,omitempty"`
+}
+
+// BandwidthRule matches the remote end of a connection by CIDR and port, an empty selector matches anything
+type BandwidthRule struct {
+	Name    string   `json:"name"`
+	CIDRs   []string `json:"cidrs,omitempty"`
+	Ports   []int    `json:"ports,omitempty"`
+	Egress  int64    `json:"egress,omitempty"`
+	Ingress int64    `json:"ingress,omitempty"`
+	Burst   int64    `json:"burst,omitempty"`
+
+	networks []*net.IPNet
+}
+
+// Match returns the first rule matching the remote end of a connection, or nil
+func (b *Bandwidth) Match(ip net.IP, port int) *BandwidthRule {
+	if b == nil {
+		return nil
+	}
+	for x := range b.Rules {
+		if b.Rules[x].matches(ip, port) {
+			return &b.Rules[x]
+		}
+	}
+	return nil
+}
+
+func (r *BandwidthRule) matches(ip net.IP, port int) bool {
+	if len(r.Ports) != 0 && !slices.Contains(r.Ports, port) {
+		return false
+	}
+	if len(r.networks) == 0 {
+		return true
+	}
+	for _, network := range r.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *Bandwidth) validate() error {
+	if b.Egress < 0 || b.Ingress < 0 || b.Burst < 0 {
+		return fmt.Errorf("rates and burst can't be negative")
+	}
+	names := map[string]bool{}
+	for x := range b.Rules {
+		r := &b.Rules[x]
+		if r.Name == "" {
+			return fmt.Errorf("rule %d has no name", x)
+		}
+		if names[r.Name] {
+			return fmt.Errorf("rule [%s] is defined more than once", r.Name)
+		}
+		names[r.Name] = true
+		if r.Egress < 0 || r.Ingress < 0 || r.Burst < 0 {
+			return fmt.Errorf("rule [%s]: rates and burst can't be negative", r.Name)
+		}
+		for _, c := range r.CIDRs {
+			_, network, err := net.ParseCIDR(c)
+			if err != nil {
+				return fmt.Errorf("rule [%s]: %v", r.Name, err)
+			}
+			r.networks = append(r.networks, network)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package policy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// EgressRule intercepts connections to an external host, the application speaks plain HTTP to the host's
+// addresses on Port and the gateway originates TLS to TLSPort, adding a credential read from a Secret in the
+// pod's namespace
+type EgressRule struct {
+	Host      string `json:"host"`
+	Port      int    `json:"port,omitempty"`      // Port the application connects to (80 if not set)
+	TLSPort   int    `json:"tlsPort,omitempty"`   // Port the gateway connects to (443 if not set)
+	Secret    string `json:"secret,omitempty"`    // Secret holding the credential, empty sends the requests unchanged
+	SecretKey string `json:"secretKey,omitempty"` // Key in the Secret ("token" if not set)
+	Header    string `json:"header,omitempty"`    // Header set to the credential ("Authorization" if not set)
+	Prefix    string `json:"prefix,omitempty"`    // Put before the credential ("Bearer " if not set)
+}
+
+func validateEgress(rules []EgressRule) error {
+	hosts := map[string]bool{}
+	for x := range rules {
+		r := &rules[x]
+		if r.Host == "" {
+			return fmt.Errorf("rule %d has no host", x)
+		}
+		r.Host = strings.ToLower(r.Host)
+		if hosts[r.Host] {
+			return fmt.Errorf("host [%s] is defined more than once", r.Host)
+		}
+		hosts[r.Host] = true
+		if r.Port == 0 {
+			r.Port = 80
+		}
+		if r.TLSPort == 0 {
+			r.TLSPort = 443
+		}
+		if r.Port < 0 || r.Port > 65535 || r.TLSPort < 0 || r.TLSPort > 65535 {
+			return fmt.Errorf("host [%s]: invalid port", r.Host)
+		}
+		if r.SecretKey == "" {
+			r.SecretKey = "token"
+		}
+		if r.Header == "" {
+			r.Header = "Authorization"
+			if r.Prefix == "" {
+				r.Prefix = "Bearer "
+			}
+		}
+		r.Header = http.CanonicalHeaderKey(r.Header)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package policy
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidateEgress(t *testing.T) {
+	tests := []struct {
+		name     string
+		rules    []EgressRule
+		expected []EgressRule
+		err      bool
+	}{
+		{
+			name:     "Defaults",
+			rules:    []EgressRule{{Host: "API.example.com", Secret: "openai"}},
+			expected: []EgressRule{{Host: "api.example.com", Port: 80, TLSPort: 443, Secret: "openai", SecretKey: "token", Header: "Authorization", Prefix: "Bearer "}},
+		},
+		{
+			name:     "Custom header has no prefix",
+			rules:    []EgressRule{{Host: "api.example.com", Port: 8080, TLSPort: 8443, Secret: "anthropic", SecretKey: "key", Header: "x-api-key"}},
+			expected: []EgressRule{{Host: "api.example.com", Port: 8080, TLSPort: 8443, Secret: "anthropic", SecretKey: "key", Header: "X-Api-Key"}},
+		},
+		{
+			name:     "Custom prefix",
+			rules:    []EgressRule{{Host: "api.example.com", Prefix: "Token "}},
+			expected: []EgressRule{{Host: "api.example.com", Port: 80, TLSPort: 443, SecretKey: "token", Header: "Authorization", Prefix: "Token "}},
+		},
+		{
+			name:  "No host",
+			rules: []EgressRule{{Secret: "openai"}},
+			err:   true,
+		},
+		{
+			name:  "Duplicate host",
+			rules: []EgressRule{{Host: "api.example.com"}, {Host: "API.example.com", Port: 8080}},
+			err:   true,
+		},
+		{
+			name:  "Invalid port",
+			rules: []EgressRule{{Host: "api.example.com", Port: 70000}},
+			err:   true,
+		},
+		{
+			name:  "Negative TLS port",
+			rules: []EgressRule{{Host: "api.example.com", TLSPort: -1}},
+			err:   true,
+		},
+	}
+	for _, test := range tests {
+		err := validateEgress(test.rules)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: expected no error, got %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(test.rules, test.expected) {
+			t.Errorf("%s: expected %+v, got %+v", test.name, test.expected, test.rules)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+)
+
+// Policy holds the connection level policies for a pod, it is read from the same configmap (<pod>-kube-gateway)
+// as the AI policies, with each section being a top-level key next to "request" and "response"
+type Policy struct {
+	Authorization *Authorization `json:"authorization,omitempty"`
+	Bandwidth     *Bandwidth     `json:"bandwidth,omitempty"`
+	Egress        []EgressRule   `json:"egress,omitempty"`
+}
+
+// Store holds the active policy, it is swapped in one go when the configmap changes so connections never see a
+// partially updated policy
+type Store struct {
+	current    atomic.Pointer[Policy]
+	generation atomic.Uint64
+}
+
+// Load returns the active policy, it is never nil
+func (s *Store) Load() *Policy {
+	p := s.current.Load()
+	if p == nil {
+		return &Policy{}
+	}
+	return p
+}
+
+// Update parses and validates a policy, replacing the active policy only if it is valid
+func (s *Store) Update(data []byte) error {
+	var p Policy
+	err := json.Unmarshal(data, &p)
+	if err != nil {
+		return err
+	}
+	err = p.validate()
+	if err != nil {
+		return err
+	}
+	s.current.Store(&p)
+	s.generation.Add(1)
+	return nil
+}
+
+// Reset removes the active policy (i.e. the configmap was deleted)
+func (s *Store) Reset() {
+	s.current.Store(nil)
+	s.generation.Add(1)
+}
+
+// Generation changes every time the policy is replaced, so long lived users can tell when to reload it
+func (s *Store) Generation() uint64 {
+	return s.generation.Load()
+}
+
+func (p *Policy) validate() error {
+	if p.Authorization != nil {
+		err := p.Authorization.validate()
+		if err != nil {
+			return fmt.Errorf("authorization: %v", err)
+		}
+	}
+	if p.Bandwidth != nil {
+		err := p.Bandwidth.validate()
+		if err != nil {
+			return fmt.Errorf("bandwidth: %v", err)
+		}
+	}
+	err := validateEgress(p.Egress)
+	if err != nil {
+		return fmt.Errorf("egress: %v", err)
+	}
+	return nil
+}
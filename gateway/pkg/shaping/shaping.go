@@ -0,0 +1,198 @@
+package shaping
+
+import (
+	"context"
+	"gateway/pkg/metrics"
+	"gateway/pkg/policy"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Directions are from the point of view of the pod
+const (
+	Egress  = "egress"  // Traffic the pod sends
+	Ingress = "ingress" // Traffic the pod receives
+)
+
+const podBucket = "pod"
+
+var waited = metrics.NewCounterVec("kube_gateway_shaping_wait_seconds_total", "Time connections spent waiting for bandwidth", "direction", "bucket")
+
+// Shaper holds the token buckets for a pod, one for the pod and one for each bandwidth rule. Buckets are
+// shared by every connection they apply to and are reconfigured in place when the policy changes, so
+// running connections pick up new limits without being restarted
+type Shaper struct {
+	policies *policy.Store
+
+	mu         sync.Mutex
+	generation uint64
+	buckets    map[string]*bucket
+}
+
+type bucket struct {
+	name    string
+	egress  *rate.Limiter
+	ingress *rate.Limiter
+}
+
+func New(policies *policy.Store) *Shaper {
+	return &Shaper{
+		policies:   policies,
+		generation: policies.Generation(),
+		buckets:    map[string]*bucket{},
+	}
+}
+
+// Conn limits the reads from a connection, direction is the direction of the data being read and remote is
+// the address of the other end of the connection (used to match bandwidth rules)
+func (s *Shaper) Conn(conn net.Conn, direction string, remote string) net.Conn {
+	if s == nil {
+		return conn
+	}
+	host, portStr, err := net.SplitHostPort(remote)
+	if err != nil {
+		return conn
+	}
+	port, _ := net.LookupPort("tcp", portStr)
+	return &shapedConn{
+		Conn:      conn,
+		shaper:    s,
+		direction: direction,
+		ip:        net.ParseIP(host),
+		port:      port,
+	}
+}
+
+// bucketsFor returns the buckets that apply to a connection and the generation of the policy they came from
+func (s *Shaper) bucketsFor(ip net.IP, port int) ([]*bucket, uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bw := s.policies.Load().Bandwidth
+	if g := s.policies.Generation(); g != s.generation {
+		s.generation = g
+		s.reconfigure(bw)
+	}
+	if bw == nil {
+		return nil, s.generation
+	}
+	buckets := []*bucket{s.bucket(podBucket, bw.Egress, bw.Ingress, bw.Burst)}
+	if rule := bw.Match(ip, port); rule != nil {
+		buckets = append(buckets, s.bucket("rule:"+rule.Name, rule.Egress, rule.Ingress, rule.Burst))
+	}
+	return buckets, s.generation
+}
+
+// bucket returns an existing bucket or creates it, the caller holds the lock
+func (s *Shaper) bucket(name string, egress, ingress, burst int64) *bucket {
+	b, ok := s.buckets[name]
+	if !ok {
+		b = &bucket{name: name, egress: rate.NewLimiter(rate.Inf, 0), ingress: rate.NewLimiter(rate.Inf, 0)}
+		configure(b.egress, egress, burst)
+		configure(b.ingress, ingress, burst)
+		s.buckets[name] = b
+	}
+	return b
+}
+
+// reconfigure applies a new policy to the existing buckets, buckets whose rule has gone become unlimited
+func (s *Shaper) reconfigure(bw *policy.Bandwidth) {
+	for name, b := range s.buckets {
+		var egress, ingress, burst int64
+		if bw != nil {
+			if name == podBucket {
+				egress, ingress, burst = bw.Egress, bw.Ingress, bw.Burst
+			}
+			for x := range bw.Rules {
+				if name == "rule:"+bw.Rules[x].Name {
+					egress, ingress, burst = bw.Rules[x].Egress, bw.Rules[x].Ingress, bw.Rules[x].Burst
+				}
+			}
+		}
+		configure(b.egress, egress, burst)
+		configure(b.ingress, ingress, burst)
+	}
+}
+
+// configure sets a rate in bytes per second, a burst of 0 allows a second's worth of traffic at once
+func configure(l *rate.Limiter, bytesPerSecond, burst int64) {
+	if bytesPerSecond == 0 {
+		l.SetLimit(rate.Inf)
+		return
+	}
+	if burst == 0 {
+		burst = bytesPerSecond
+	}
+	l.SetBurst(int(min(burst, math.MaxInt32)))
+	l.SetLimit(rate.Limit(bytesPerSecond))
+}
+
+func (b *bucket) limiter(direction string) *rate.Limiter {
+	if direction == Egress {
+		return b.egress
+	}
+	return b.ingress
+}
+
+type shapedConn struct {
+	net.Conn
+	shaper    *Shaper
+	direction string
+	ip        net.IP
+	port      int
+
+	generation uint64
+	buckets    []*bucket
+	loaded     bool
+}
+
+// Read waits for tokens after reading, reads are never larger than the smallest burst so a single read
+// can't take more than a bucket holds
+func (c *shapedConn) Read(p []byte) (int, error) {
+	if !c.loaded || c.shaper.policies.Generation() != c.generation {
+		c.buckets, c.generation = c.shaper.bucketsFor(c.ip, c.port)
+		c.loaded = true
+	}
+	for _, b := range c.buckets {
+		l := b.limiter(c.direction)
+		if l.Limit() != rate.Inf && len(p) > l.Burst() {
+			p = p[:l.Burst()]
+		}
+	}
+	n, err := c.Conn.Read(p)
+	for _, b := range c.buckets {
+		c.wait(b, n)
+	}
+	return n, err
+}
+
+// NetConn returns the connection that is being shaped
+func (c *shapedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *shapedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+func (c *shapedConn) wait(b *bucket, n int) {
+	l := b.limiter(c.direction)
+	if l.Limit() == rate.Inf {
+		return
+	}
+	start := time.Now()
+	for n > 0 {
+		chunk := min(n, max(l.Burst(), 1))
+		if l.WaitN(context.Background(), chunk) != nil {
+			break // The limits changed underneath us, don't hold up the connection
+		}
+		n -= chunk
+	}
+	waited.WithLabelValues(c.direction, b.name).Add(time.Since(start).Seconds())
+}
@@ -0,0 +1,166 @@
+package shaping
+
+import (
+	"gateway/pkg/policy"
+	"net"
+	"testing"
+	"time"
+)
+
+// endlessConn returns as many bytes as are asked for and records the largest read
+type endlessConn struct {
+	net.Conn
+	largest   int
+	closedOut bool
+}
+
+func (c *endlessConn) Read(p []byte) (int, error) {
+	c.largest = max(c.largest, len(p))
+	return len(p), nil
+}
+
+func (c *endlessConn) CloseWrite() error {
+	c.closedOut = true
+	return nil
+}
+
+// readFor reads a number of bytes from a connection and returns how long it took
+func readFor(t *testing.T, conn net.Conn, total int) time.Duration {
+	t.Helper()
+	start := time.Now()
+	buf := make([]byte, 64*1024)
+	for total > 0 {
+		n, err := conn.Read(buf[:min(total, len(buf))])
+		if err != nil {
+			t.Fatal(err)
+		}
+		total -= n
+	}
+	return time.Since(start)
+}
+
+func newStore(t *testing.T, config string) *policy.Store {
+	t.Helper()
+	store := &policy.Store{}
+	if config != "" {
+		err := store.Update([]byte(config))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return store
+}
+
+func TestShaperDisabled(t *testing.T) {
+	raw := &endlessConn{}
+	var s *Shaper
+	if conn := s.Conn(raw, Egress, "10.0.0.2:80"); conn != raw {
+		t.Fatal("expected a nil shaper to return the connection unchanged")
+	}
+
+	conn := New(newStore(t, "")).Conn(raw, Egress, "10.0.0.2:80")
+	if elapsed := readFor(t, conn, 10*1024*1024); elapsed > 100*time.Millisecond {
+		t.Errorf("expected no limit without a policy, took %v", elapsed)
+	}
+	if raw.largest != 64*1024 {
+		t.Errorf("expected reads not to be capped, got %d", raw.largest)
+	}
+}
+
+func TestShaperPod(t *testing.T) {
+	s := New(newStore(t, `{"bandwidth":{"egress":100000,"burst":10000}}`))
+	raw := &endlessConn{}
+	conn := s.Conn(raw, Egress, "10.0.0.2:80")
+
+	// The first 10000 bytes are the burst, the other 20000 take 0.2s
+	elapsed := readFor(t, conn, 30000)
+	if elapsed < 150*time.Millisecond || elapsed > time.Second {
+		t.Errorf("expected 30000 bytes to take about 0.2s, took %v", elapsed)
+	}
+	if raw.largest != 10000 {
+		t.Errorf("expected reads to be capped at the burst, got %d", raw.largest)
+	}
+
+	// Ingress isn't limited
+	ingress := s.Conn(&endlessConn{}, Ingress, "10.0.0.2:80")
+	if elapsed := readFor(t, ingress, 1024*1024); elapsed > 100*time.Millisecond {
+		t.Errorf("expected ingress not to be limited, took %v", elapsed)
+	}
+
+	// The bucket is shared, so another connection has to wait for the tokens the first one used
+	other := s.Conn(&endlessConn{}, Egress, "10.0.0.3:443")
+	if elapsed := readFor(t, other, 10000); elapsed < 50*time.Millisecond {
+		t.Errorf("expected the pod bucket to be shared, took %v", elapsed)
+	}
+}
+
+func TestShaperRule(t *testing.T) {
+	s := New(newStore(t, `{"bandwidth":{"rules":[{"name":"db","cidrs":["10.1.0.0/16"],"ports":[5432],"ingress":100000,"burst":5000}]}}`))
+
+	raw := &endlessConn{}
+	matched := s.Conn(raw, Ingress, "10.1.2.3:5432")
+	if elapsed := readFor(t, matched, 25000); elapsed < 150*time.Millisecond {
+		t.Errorf("expected the rule to limit the connection, took %v", elapsed)
+	}
+	if raw.largest != 5000 {
+		t.Errorf("expected reads to be capped at the rule's burst, got %d", raw.largest)
+	}
+
+	tests := []struct {
+		name   string
+		remote string
+	}{
+		{"Other port", "10.1.2.3:5433"},
+		{"Other CIDR", "10.2.2.3:5432"},
+	}
+	for _, test := range tests {
+		conn := s.Conn(&endlessConn{}, Ingress, test.remote)
+		if elapsed := readFor(t, conn, 1024*1024); elapsed > 100*time.Millisecond {
+			t.Errorf("%s: expected no limit, took %v", test.name, elapsed)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.buckets["rule:db"]; !ok {
+		t.Errorf("expected a bucket for the rule, got %v", s.buckets)
+	}
+}
+
+func TestShaperPolicyChange(t *testing.T) {
+	store := newStore(t, `{"bandwidth":{"egress":10000,"burst":1000}}`)
+	s := New(store)
+	raw := &endlessConn{}
+	conn := s.Conn(raw, Egress, "10.0.0.2:80")
+	readFor(t, conn, 1000)
+
+	// A running connection picks up a higher limit
+	err := store.Update([]byte(`{"bandwidth":{"egress":1000000,"burst":100000}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := readFor(t, conn, 200000); elapsed > 500*time.Millisecond {
+		t.Errorf("expected the new limit to apply, took %v", elapsed)
+	}
+	if raw.largest != 64*1024 {
+		t.Errorf("expected reads to no longer be capped at the old burst, got %d", raw.largest)
+	}
+
+	// And is no longer limited once the policy has gone
+	store.Reset()
+	if elapsed := readFor(t, conn, 10*1024*1024); elapsed > 100*time.Millisecond {
+		t.Errorf("expected no limit after the policy was removed, took %v", elapsed)
+	}
+}
+
+func TestShapedConnCloseWrite(t *testing.T) {
+	raw := &endlessConn{}
+	conn := New(newStore(t, "")).Conn(raw, Egress, "10.0.0.2:80")
+	err := conn.(interface{ CloseWrite() error }).CloseWrite()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !raw.closedOut {
+		t.Error("expected CloseWrite to be passed to the connection")
+	}
+}
@@ -1,12 +1,16 @@
 package watcher
 
 import (
+	"context"
 	"fmt"
 	"gateway/pkg/gateway"
+	"gateway/pkg/mesh"
+	"gateway/pkg/policy"
 	"log/slog"
 	"net"
 	"os"
 
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	certutil "k8s.io/client-go/util/cert"
@@ -18,6 +22,7 @@ type Watch struct {
 	rootCAFile    string
 	namespaceFile string
 	config        *gateway.AITransaction
+	policies      *policy.Store
 	podname       string
 	namespace     string
 	configMapName string
@@ -75,7 +80,7 @@ func (w *Watch) client() (*kubernetes.Clientset, error) {
 	return clientSet, nil
 }
 
-func NewWatcher(pid int, token string, config *gateway.AITransaction) *Watch {
+func NewWatcher(pid int, token string, config *gateway.AITransaction, policies *policy.Store) *Watch {
 	const (
 		nameSpaceFile = "namespace"
 		tokenFile     = "token"
@@ -88,7 +93,33 @@ func NewWatcher(pid int, token string, config *gateway.AITransaction) *Watch {
 		tokenFile:     fmt.Sprintf("/proc/%d/root/var/run/secrets/kubernetes.io/serviceaccount/%s", pid, tokenFile),
 		rootCAFile:    fmt.Sprintf("/proc/%d/root/var/run/secrets/kubernetes.io/serviceaccount/%s", pid, rootCAFile),
 		config:        config,
+		policies:      policies,
 		podname:       os.Getenv("POD_NAME"),
 		namespace:     os.Getenv("POD_NAMESPACE"),
 	}
 }
+
+// WatchMesh keeps the tunnel routes and the mesh peers up to date from the cluster, either can be nil.
+// This is a blocking function
+func (w *Watch) WatchMesh(routes *mesh.Routes, peers *mesh.Peers) error {
+	c, err := w.client()
+	if err != nil {
+		return err
+	}
+	return mesh.Watch(context.Background(), c, routes, peers)
+}
+
+// Secrets returns a function that reads a Secret from the pod's namespace, used for the egress credentials
+func (w *Watch) Secrets() (func(name string) (map[string][]byte, error), error) {
+	c, err := w.client()
+	if err != nil {
+		return nil, err
+	}
+	return func(name string) (map[string][]byte, error) {
+		secret, err := c.CoreV1().Secrets(w.namespace).Get(context.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return secret.Data, nil
+	}, nil
+}
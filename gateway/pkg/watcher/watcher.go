@@ -2,7 +2,6 @@ package watcher
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"log/slog"
 
@@ -50,10 +49,14 @@ func (w *Watch) Watch() error {
 			if updatedConfigMap.Name == w.configMapName && updatedConfigMap.Namespace == string(w.namespace) {
 				slog.Info("configmap change", "type", event.Type, "name", updatedConfigMap.Name)
 				data := updatedConfigMap.Data["config"]
-				err := json.Unmarshal([]byte(data), w.config)
+				err := w.config.Load([]byte(data))
 				if err != nil {
 					slog.Error("unable to read JSON from configMap", "err", err)
 				}
+				err = w.policies.Update([]byte(data))
+				if err != nil {
+					slog.Error("unable to load policies from configMap", "err", err)
+				}
 			}
 		case watch.Deleted:
 			updatedConfigMap, ok := event.Object.(*v1.ConfigMap)
@@ -62,6 +65,7 @@ func (w *Watch) Watch() error {
 			}
 			slog.Info("configmap change", "type", event.Type, "name", updatedConfigMap.Name)
 			w.config.Reset() // Force the struct to blank (TODO: is there a better way?)
+			w.policies.Reset()
 		}
 	}
 	return nil
@@ -2,6 +2,9 @@ package main
 
 import (
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
@@ -12,10 +15,13 @@ import (
 	"log/slog"
 	"math/big"
 	"net"
+	"net/url"
 	"os"
+	"strings"
 	"time"
 
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"k8s.io/client-go/kubernetes"
@@ -155,9 +161,51 @@ func (c *certs) generateCA() error {
 	return nil
 }
 
-func (c *certs) createCertificate(name, ip string) {
+// generateKey creates the private key for a workload certificate, returning it PEM encoded
+func (c *certs) generateKey() (crypto.Signer, []byte, error) {
+	switch c.keyType {
+	case "rsa2048", "rsa4096":
+		bits := 2048
+		if c.keyType == "rsa4096" {
+			bits = 4096
+		}
+		priv, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			return nil, nil, err
+		}
+		return priv, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)}), nil
+	case "ecdsa-p256", "ecdsa-p384":
+		curve := elliptic.P256()
+		if c.keyType == "ecdsa-p384" {
+			curve = elliptic.P384()
+		}
+		priv, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		b, err := x509.MarshalECPrivateKey(priv)
+		if err != nil {
+			return nil, nil, err
+		}
+		return priv, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b}), nil
+	}
+	return nil, nil, fmt.Errorf("unknown key type [%s], expected rsa2048, rsa4096, ecdsa-p256 or ecdsa-p384", c.keyType)
+}
+
+// spiffeID builds the workload identity for a pod, in the form spiffe://<trust-domain>/ns/<namespace>/sa/<serviceaccount>
+func (c *certs) spiffeID(namespace, serviceAccount string) *url.URL {
+	if serviceAccount == "" {
+		serviceAccount = "default"
+	}
+	return &url.URL{
+		Scheme: "spiffe",
+		Host:   c.trustDomain,
+		Path:   fmt.Sprintf("/ns/%s/sa/%s", namespace, serviceAccount),
+	}
+}
+
+func (c *certs) createCertificate(name, namespace, serviceAccount, ip string) {
 	// Load CA
-	tls.X509KeyPair(c.cacert, c.cakey)
 	catls, err := tls.X509KeyPair(c.cacert, c.cakey)
 	if err != nil {
 		panic(err)
@@ -166,18 +214,19 @@ func (c *certs) createCertificate(name, ip string) {
 	if err != nil {
 		panic(err)
 	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		panic(err)
+	}
 	ipAddress := net.ParseIP(ip)
+	id := c.spiffeID(namespace, serviceAccount)
 	// Prepare certificate
 	cert := &x509.Certificate{
-		SerialNumber: big.NewInt(1658),
+		SerialNumber: serial,
 		Subject: pkix.Name{
-			Organization:  []string{"ORGANIZATION_NAME"},
-			Country:       []string{"COUNTRY_CODE"},
-			Province:      []string{"PROVINCE"},
-			Locality:      []string{"CITY"},
-			StreetAddress: []string{"ADDRESS"},
-			PostalCode:    []string{"POSTAL_CODE"},
-			CommonName:    "TEST",
+			Organization:       []string{"kube-gateway"},
+			OrganizationalUnit: []string{namespace},
+			CommonName:         name,
 		},
 		NotBefore:    time.Now(),
 		NotAfter:     time.Now().AddDate(10, 0, 0),
@@ -186,12 +235,15 @@ func (c *certs) createCertificate(name, ip string) {
 		KeyUsage:     x509.KeyUsageDigitalSignature,
 		DNSNames:     []string{name},
 		IPAddresses:  []net.IP{ipAddress},
+		URIs:         []*url.URL{id},
+	}
+	priv, privPEM, err := c.generateKey()
+	if err != nil {
+		panic(err)
 	}
-	priv, _ := rsa.GenerateKey(rand.Reader, 2048)
-	pub := &priv.PublicKey
 
 	// Sign the certificate
-	cert_b, err := x509.CreateCertificate(rand.Reader, cert, ca, pub, catls.PrivateKey)
+	cert_b, err := x509.CreateCertificate(rand.Reader, cert, ca, priv.Public(), catls.PrivateKey)
 	if err != nil {
 		panic(err)
 	}
@@ -204,7 +256,8 @@ func (c *certs) createCertificate(name, ip string) {
 	// pem.Encode(certOut)
 	// certOut.Close()
 	// slog.Info(fmt.Sprintf("Written %s", certificate))
-	c.key = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})
+	c.key = privPEM
+	slog.Info("Created Certificate 🔏", "name", name, "identity", id.String(), "key", c.keyType)
 	// Private key
 	// keyOut, err := os.OpenFile(key, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	// if err != nil {
@@ -216,6 +269,197 @@ func (c *certs) createCertificate(name, ip string) {
 
 }
 
+// interceptConstraints are set on the intercept roots and every CA they sign. Intercepted hosts are always external,
+// so their certificates can't name an IP address, a SPIFFE identity or any other URI
+func interceptConstraints(cert *x509.Certificate) {
+	_, allIPv4, _ := net.ParseCIDR("0.0.0.0/0")
+	_, allIPv6, _ := net.ParseCIDR("::/0")
+	cert.ExcludedIPRanges = []*net.IPNet{allIPv4, allIPv6}
+	cert.ExcludedURIDomains = []string{""} // An empty constraint matches everything
+	cert.ExcludedEmailAddresses = []string{""}
+	cert.PermittedDNSDomainsCritical = true
+}
+
+// generateInterceptRoot creates a self-signed root for intercept CAs, it can sign pod CAs but they can't sign CAs
+func (c *certs) generateInterceptRoot(commonName string) (certPEM, keyPEM []byte, err error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	root := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"kube-gateway"},
+			CommonName:   commonName,
+		},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		IsCA:                  true,
+		MaxPathLen:            1,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	interceptConstraints(root)
+	priv, keyPEM, err := c.generateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	cert_b, err := x509.CreateCertificate(rand.Reader, root, root, priv.Public(), priv)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert_b}), keyPEM, nil
+}
+
+// loadInterceptRoots reads the intercept roots from their secret, creating them the first time the watcher starts
+func (c *certs) loadInterceptRoots(clientSet *kubernetes.Clientset) error {
+	secrets := clientSet.CoreV1().Secrets(watcherNamespace)
+	s, err := secrets.Get(context.TODO(), interceptRoots, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		secret := v1.Secret{
+			TypeMeta: metav1.TypeMeta{
+				Kind:       "Secret",
+				APIVersion: "v1",
+			},
+			ObjectMeta: metav1.ObjectMeta{
+				Name: interceptRoots,
+			},
+			Data: make(map[string][]byte),
+			Type: v1.SecretTypeOpaque,
+		}
+		for _, root := range []struct{ prefix, name string }{
+			{"root", "kube-gateway intercept root"},
+			{"wildcard", "kube-gateway wildcard intercept root"},
+		} {
+			certPEM, keyPEM, err := c.generateInterceptRoot(root.name)
+			if err != nil {
+				return err
+			}
+			secret.Data[root.prefix+"-cert"] = certPEM
+			secret.Data[root.prefix+"-key"] = keyPEM
+		}
+		s, err = secrets.Create(context.TODO(), &secret, metav1.CreateOptions{})
+		if errors.IsAlreadyExists(err) {
+			// Another watcher created them first
+			s, err = secrets.Get(context.TODO(), interceptRoots, metav1.GetOptions{})
+		}
+		if err == nil {
+			slog.Info("Created intercept roots 🔐", "name", interceptRoots, "namespace", watcherNamespace)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("unable to load intercept roots %v", err)
+	}
+	for _, key := range []string{"root-cert", "root-key", "wildcard-cert", "wildcard-key"} {
+		if len(s.Data[key]) == 0 {
+			return fmt.Errorf("intercept roots secret %s is missing %s", interceptRoots, key)
+		}
+	}
+	c.interceptRootCert, c.interceptRootKey = s.Data["root-cert"], s.Data["root-key"]
+	c.wildcardRootCert, c.wildcardRootKey = s.Data["wildcard-cert"], s.Data["wildcard-key"]
+	return nil
+}
+
+// createInterceptCA creates an intermediate CA for a pod, so its gateway can sign certificates for the hosts whose
+// TLS it intercepts. It is signed by an intercept root rather than the mesh CA, can't sign further CAs and is
+// constrained to the hosts, unless they are "*" in which case the wildcard root signs it
+func (c *certs) createInterceptCA(name, namespace string, hosts []string) error {
+	var domains []string
+	wildcard := isWildcard(hosts)
+	for _, host := range hosts {
+		// A constraint of example.com also permits its subdomains
+		if host = strings.TrimSpace(host); host != "" && !wildcard {
+			domains = append(domains, strings.TrimPrefix(host, "*."))
+		}
+	}
+	rootCert, rootKey := c.interceptRootCert, c.interceptRootKey
+	if wildcard {
+		rootCert, rootKey = c.wildcardRootCert, c.wildcardRootKey
+	}
+	if rootCert == nil {
+		return fmt.Errorf("the intercept roots haven't been loaded")
+	}
+	roottls, err := tls.X509KeyPair(rootCert, rootKey)
+	if err != nil {
+		return err
+	}
+	root, err := x509.ParseCertificate(roottls.Certificate[0])
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	notAfter := time.Now().AddDate(1, 0, 0)
+	if root.NotAfter.Before(notAfter) {
+		notAfter = root.NotAfter
+	}
+	cert := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization:       []string{"kube-gateway"},
+			OrganizationalUnit: []string{namespace},
+			CommonName:         "kube-gateway intercept " + name,
+		},
+		NotBefore:             time.Now(),
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	interceptConstraints(cert)
+	if !wildcard {
+		if len(domains) == 0 {
+			return fmt.Errorf("no hosts to intercept")
+		}
+		cert.PermittedDNSDomains = domains
+	}
+	priv, privPEM, err := c.generateKey()
+	if err != nil {
+		return err
+	}
+	cert_b, err := x509.CreateCertificate(rand.Reader, cert, root, priv.Public(), roottls.PrivateKey)
+	if err != nil {
+		return err
+	}
+	c.interceptCert = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert_b})
+	c.interceptKey = privPEM
+	slog.Info("Created intercept CA 🔏", "name", name, "hosts", hosts, "wildcard", wildcard, "key", c.keyType)
+	return nil
+}
+
+// loadTrustBundle publishes the intercept roots in a configmap in the namespace, so pods can mount them and trust
+// the certificates of their gateway. Each root is also published in a bundle with the system roots, for libraries
+// that replace their roots with the file they are given. Pods mounting it before it exists wait until it is created
+func (c *certs) loadTrustBundle(namespace string, clientSet *kubernetes.Clientset) error {
+	cm := v1.ConfigMap{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "ConfigMap",
+			APIVersion: "v1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name: trustBundle,
+		},
+		Data: map[string]string{
+			"ca.crt":              string(c.interceptRootCert),
+			"bundle.crt":          string(c.systemRoots) + string(c.interceptRootCert),
+			"wildcard-ca.crt":     string(c.wildcardRootCert),
+			"wildcard-bundle.crt": string(c.systemRoots) + string(c.wildcardRootCert),
+		},
+	}
+	_, err := clientSet.CoreV1().ConfigMaps(namespace).Create(context.TODO(), &cm, metav1.CreateOptions{})
+	if errors.IsAlreadyExists(err) {
+		_, err = clientSet.CoreV1().ConfigMaps(namespace).Update(context.TODO(), &cm, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return fmt.Errorf("unable to create trust bundle %v", err)
+	}
+	slog.Info("Created trust bundle 🔐", "name", trustBundle, "namespace", namespace)
+	return nil
+}
+
 func (c *certs) loadSecret(name, namespace string, clientSet *kubernetes.Clientset) error {
 
 	// certificate := fmt.Sprint(name + ".crt")
@@ -239,6 +483,10 @@ func (c *certs) loadSecret(name, namespace string, clientSet *kubernetes.Clients
 	secretMap["SMESH-CERT"] = c.cert
 	secretMap["SMESH-KEY"] = c.key
 	secretMap["KUBE-GATEWAY-TOKEN"] = c.token
+	if c.interceptCert != nil {
+		secretMap["SMESH-INTERCEPT-CERT"] = c.interceptCert
+		secretMap["SMESH-INTERCEPT-KEY"] = c.interceptKey
+	}
 
 	secret := v1.Secret{
 		TypeMeta: metav1.TypeMeta{
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Role and RoleBinding in each namespace with gateway policies, they let the namespace's kube-gateway service
+// account read the Secrets named by the egress rules and nothing else
+const egressRole = "kube-gateway-egress"
+
+// Suffix of the configmaps holding the policies of a pod (<pod>-kube-gateway)
+const policySuffix = "-kube-gateway"
+
+// egressHandler keeps the egress Role of a namespace in step with the policies in its configmaps
+type egressHandler struct {
+	clientset *kubernetes.Clientset
+	lister    corelisters.ConfigMapLister
+}
+
+func (e *egressHandler) OnAdd(obj interface{}, b bool) {
+	e.changed(obj)
+}
+
+func (e *egressHandler) OnUpdate(oldObj, newObj interface{}) {
+	e.changed(newObj)
+}
+
+func (e *egressHandler) OnDelete(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	e.changed(obj)
+}
+
+func (e *egressHandler) changed(obj interface{}) {
+	cm, ok := obj.(*v1.ConfigMap)
+	if !ok || !strings.HasSuffix(cm.Name, policySuffix) {
+		return
+	}
+	configMaps, err := e.lister.ConfigMaps(cm.Namespace).List(labels.Everything())
+	if err != nil {
+		slog.Error("listing policies", "namespace", cm.Namespace, "err", err)
+		return
+	}
+	err = syncEgressRole(e.clientset, cm.Namespace, egressSecrets(configMaps))
+	if err != nil {
+		slog.Error("egress role", "namespace", cm.Namespace, "err", err)
+	}
+}
+
+// egressSecrets returns the Secrets named by the egress rules in the policy configmaps, sorted and without duplicates
+func egressSecrets(configMaps []*v1.ConfigMap) []string {
+	var secrets []string
+	for _, cm := range configMaps {
+		if !strings.HasSuffix(cm.Name, policySuffix) {
+			continue
+		}
+		var policy struct {
+			Egress []struct {
+				Secret string `json:"secret"`
+			} `json:"egress"`
+		}
+		err := json.Unmarshal([]byte(cm.Data["config"]), &policy)
+		if err != nil {
+			// The gateway refuses the policy as well, so it doesn't need the secrets
+			continue
+		}
+		for _, rule := range policy.Egress {
+			if rule.Secret != "" {
+				secrets = append(secrets, rule.Secret)
+			}
+		}
+	}
+	slices.Sort(secrets)
+	return slices.Compact(secrets)
+}
+
+// egressRules grants get on the named Secrets, a rule without resourceNames would grant every Secret so no
+// rule is returned when there are none
+func egressRules(secrets []string) []rbacv1.PolicyRule {
+	if len(secrets) == 0 {
+		return []rbacv1.PolicyRule{}
+	}
+	return []rbacv1.PolicyRule{{
+		APIGroups:     []string{""},
+		Resources:     []string{"secrets"},
+		Verbs:         []string{"get"},
+		ResourceNames: secrets,
+	}}
+}
+
+// syncEgressRole creates (or updates) the egress Role of a namespace and binds it to the kube-gateway service account
+func syncEgressRole(clientSet *kubernetes.Clientset, namespace string, secrets []string) error {
+	role := &rbacv1.Role{
+		ObjectMeta: metav1.ObjectMeta{Name: egressRole, Namespace: namespace},
+		Rules:      egressRules(secrets),
+	}
+	roles := clientSet.RbacV1().Roles(namespace)
+	existing, err := roles.Get(context.TODO(), egressRole, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		_, err = roles.Create(context.TODO(), role, metav1.CreateOptions{})
+	} else if err == nil {
+		role.ResourceVersion = existing.ResourceVersion
+		_, err = roles.Update(context.TODO(), role, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return fmt.Errorf("unable to create role %v", err)
+	}
+
+	binding := &rbacv1.RoleBinding{
+		ObjectMeta: metav1.ObjectMeta{Name: egressRole, Namespace: namespace},
+		RoleRef: rbacv1.RoleRef{
+			APIGroup: rbacv1.GroupName,
+			Kind:     "Role",
+			Name:     egressRole,
+		},
+		Subjects: []rbacv1.Subject{{
+			Kind:      "ServiceAccount",
+			Name:      "kube-gateway",
+			Namespace: namespace,
+		}},
+	}
+	_, err = clientSet.RbacV1().RoleBindings(namespace).Create(context.TODO(), binding, metav1.CreateOptions{})
+	if err != nil && !errors.IsAlreadyExists(err) {
+		return fmt.Errorf("unable to create role binding %v", err)
+	}
+	slog.Info("Updated egress role 🔑", "namespace", namespace, "secrets", secrets)
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func policyConfigMap(name, config string) *v1.ConfigMap {
+	return &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Data:       map[string]string{"config": config},
+	}
+}
+
+func TestEgressSecrets(t *testing.T) {
+	tests := []struct {
+		name       string
+		configMaps []*v1.ConfigMap
+		expected   []string
+	}{
+		{
+			name: "Secrets of every pod",
+			configMaps: []*v1.ConfigMap{
+				policyConfigMap("app-kube-gateway", `{"egress":[{"host":"api.openai.com","secret":"openai"},{"host":"example.com"}]}`),
+				policyConfigMap("other-kube-gateway", `{"egress":[{"host":"api.anthropic.com","secret":"anthropic"},{"host":"api.openai.com","secret":"openai"}]}`),
+			},
+			expected: []string{"anthropic", "openai"},
+		},
+		{
+			name: "Other configmaps are ignored",
+			configMaps: []*v1.ConfigMap{
+				policyConfigMap("app-config", `{"egress":[{"host":"api.openai.com","secret":"database"}]}`),
+			},
+		},
+		{
+			name: "Invalid policies are ignored",
+			configMaps: []*v1.ConfigMap{
+				policyConfigMap("app-kube-gateway", `{"egress":`),
+				policyConfigMap("other-kube-gateway", `{"request":{}}`),
+			},
+		},
+	}
+	for _, test := range tests {
+		if got := egressSecrets(test.configMaps); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, got)
+		}
+	}
+}
+
+func TestEgressRules(t *testing.T) {
+	if rules := egressRules(nil); len(rules) != 0 {
+		t.Errorf("expected no rules without secrets (an empty resourceNames grants every secret), got %v", rules)
+	}
+	rules := egressRules([]string{"openai"})
+	if len(rules) != 1 || !reflect.DeepEqual(rules[0].ResourceNames, []string{"openai"}) || !reflect.DeepEqual(rules[0].Verbs, []string{"get"}) {
+		t.Errorf("expected get on the named secret, got %v", rules)
+	}
+}
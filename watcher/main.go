@@ -23,16 +23,25 @@ const (
 	debug   = "kube-gateway.io/debug"
 	podcidr = "kube-gateway.io/podcidr"
 
+	// Ports that other gateways may reach in this pod e.g. "80,8000-8100"
+	allowedPorts = "kube-gateway.io/allowed-ports"
+
 	// Be a simple endpoint to a gateway
 	endpoint = "kube-gateway.io/endpoint"
 
 	// Encryption annotations
 	encryptGateway = "kube-gateway.io/encrypt"
 	enableKTLS     = "kube-gateway.io/ktls"
+	mtlsMode       = "kube-gateway.io/mtls"        // disabled, permissive or strict
+	tlsProfile     = "kube-gateway.io/tls-profile" // modern, intermediate or fips
+	fallback       = "kube-gateway.io/fallback"    // fail, direct or retry
 
 	// AI annotations
-	aiGateway = "kube-gateway.io/ai"
-	aiModel   = "kube-gateway.io/ai-model"
+	aiGateway       = "kube-gateway.io/ai"
+	aiModel         = "kube-gateway.io/ai-model"
+	accessLog       = "kube-gateway.io/access-log"        // json or common, written to the gateway's stdout
+	accessLogSample = "kube-gateway.io/access-log-sample" // Fraction of allowed requests that are logged
+	interceptTLS    = "kube-gateway.io/intercept-tls"     // Hosts whose HTTPS traffic is decrypted e.g. "api.openai.com,*.example.com"
 
 	// Network flush annotation
 	netflush = "kube-gateway.io/netflush"
@@ -41,6 +50,15 @@ const (
 	enabled = "kube-gateway.io/enabled"
 )
 
+// Configmap in each namespace with intercepting pods, holding the CA that their applications should trust
+const trustBundle = "kube-gateway-ca"
+
+// Secret in the watcher's namespace holding the roots of the intercept CAs, they are separate from the mesh CA
+const (
+	interceptRoots   = "kube-gateway-intercept-ca"
+	watcherNamespace = "kube-gateway"
+)
+
 type certs struct {
 	cacert []byte
 	cakey  []byte
@@ -48,6 +66,24 @@ type certs struct {
 	cert   []byte
 	token  []byte
 	folder *string
+
+	// Intermediate CA of the pod being enabled, used by its gateway to intercept TLS
+	interceptCert []byte
+	interceptKey  []byte
+
+	// Roots of the intercept CAs, which the mesh never trusts. Pods that intercept every host ("*") are signed by
+	// their own root, so applications that intercept named hosts don't trust a CA that can sign for any name
+	interceptRootCert []byte
+	interceptRootKey  []byte
+	wildcardRootCert  []byte
+	wildcardRootKey   []byte
+	systemRoots       []byte // Added to the trust bundles
+
+	webhookAddr string // Address of the admission webhook that mounts the trust bundle, empty disables it
+
+	trustDomain string // SPIFFE trust domain used in workload identities
+	keyType     string // Key algorithm for workload certificates
+	tlsProfile  string // Default TLS profile for the gateways
 }
 
 func main() {
@@ -67,6 +103,12 @@ func main() {
 	podcidr := flag.String("podcidr", "10.0.0.0/16", "Set the PodCIDR for capturing traffic")
 
 	certIP := flag.String("ip", "192.168.0.1", "Create a certificate from the CA")
+	certNamespace := flag.String("namespace", "default", "The namespace used in the certificate identity")
+	certServiceAccount := flag.String("serviceAccount", "default", "The service account used in the certificate identity")
+	flag.StringVar(&certCollection.trustDomain, "trustDomain", "cluster.local", "The SPIFFE trust domain for workload identities")
+	flag.StringVar(&certCollection.keyType, "keyType", "ecdsa-p256", "Key algorithm for workload certificates (rsa2048, rsa4096, ecdsa-p256 or ecdsa-p384)")
+	flag.StringVar(&certCollection.webhookAddr, "webhook", ":8443", "Address of the admission webhook that mounts the TLS interception trust bundle, empty disables it")
+	flag.StringVar(&certCollection.tlsProfile, "tlsProfile", "", "Default TLS profile for the gateways (modern, intermediate or fips)")
 	certSecret := flag.Bool("load", false, "Create a secret in Kubernetes with the certificate")
 	loadCA := flag.Bool("loadca", false, "Create a secret in Kubernetes with the certificate")
 	watch := flag.Bool("watch", false, "Watch Kubernetes for pods being created and create certs")
@@ -109,7 +151,7 @@ func main() {
 		}
 	}
 	if *certName != "" {
-		certCollection.createCertificate(*certName, *certIP)
+		certCollection.createCertificate(*certName, *certNamespace, *certServiceAccount, *certIP)
 		err := certCollection.writeCert(*certName)
 		if err != nil {
 			panic(err)
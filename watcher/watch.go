@@ -7,6 +7,7 @@ import (
 	"log/slog"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
 	v1 "k8s.io/api/core/v1"
@@ -29,17 +30,39 @@ type informerHandler struct {
 
 func (c *certs) watcher(clientSet *kubernetes.Clientset, image *string, imagePull *bool, podCidr *string) error {
 
+	// Without the roots pods can still be enabled, but their TLS isn't intercepted
+	err := c.loadInterceptRoots(clientSet)
+	if err != nil {
+		slog.Error("intercept roots", "err", err)
+	} else if c.webhookAddr != "" {
+		c.systemRoots = readSystemRoots()
+		go func() {
+			err := c.serveWebhook(clientSet, c.webhookAddr)
+			if err != nil {
+				slog.Error("webhook", "err", err)
+			}
+		}()
+	}
+
 	factory := informers.NewSharedInformerFactory(clientSet, 0)
 
 	informer := factory.Core().V1().Pods().Informer()
 
-	_, err := informer.AddEventHandler(&informerHandler{clientset: clientSet, c: c, image: *image, imagePull: *imagePull, podCIDR: *podCidr})
+	_, err = informer.AddEventHandler(&informerHandler{clientset: clientSet, c: c, image: *image, imagePull: *imagePull, podCIDR: *podCidr})
+	if err != nil {
+		return err
+	}
+
+	// The gateways can only read the Secrets that their egress rules name
+	configMaps := factory.Core().V1().ConfigMaps()
+	_, err = configMaps.Informer().AddEventHandler(&egressHandler{clientset: clientSet, lister: configMaps.Lister()})
 	if err != nil {
 		return err
 	}
 	stop := make(chan struct{}, 2)
 
 	go informer.Run(stop)
+	go configMaps.Informer().Run(stop)
 	forever := make(chan os.Signal, 1)
 	signal.Notify(forever, syscall.SIGINT, syscall.SIGTERM)
 	<-forever
@@ -54,7 +77,7 @@ func (i *informerHandler) OnUpdate(oldObj, newObj interface{}) {
 	// oldPod := oldObj.(*v1.Pod)
 
 	// Inspect the changes, ensure we have an IP address and the annotation exists
-	if newPod.Status.PodIP != "" && newPod.Annotations[enabled] == "" && annotationLookup([]string{aiGateway, encryptGateway, endpoint}, newPod.Annotations) {
+	if newPod.Status.PodIP != "" && newPod.Annotations[enabled] == "" && annotationLookup([]string{aiGateway, encryptGateway, endpoint, interceptTLS}, newPod.Annotations) {
 
 		// 2. Add an ephemeral container to the pod spec.
 		podWithEphemeralContainer := i.withProxyContainer(newPod, &i.image, i.imagePull)
@@ -145,14 +168,53 @@ func (i *informerHandler) withProxyContainer(pod *v1.Pod, image *string, forcePu
 		ec.EphemeralContainerCommon.Env = append(ec.EphemeralContainerCommon.Env, v1.EnvVar{Name: "ENCRYPT", Value: "TRUE"})
 
 		// Create certificates and then a Kubernetes secret
-		i.c.createCertificate(pod.Name, pod.Status.PodIP)
+		i.c.createCertificate(pod.Name, pod.Namespace, pod.Spec.ServiceAccountName, pod.Status.PodIP)
 
 		// If we're wanting to offload TLS to the kernel
 		if pod.Annotations[enableKTLS] != "" {
 			ec.EphemeralContainerCommon.Env = append(ec.EphemeralContainerCommon.Env, v1.EnvVar{Name: "KTLS", Value: "TRUE"})
+			// A strict gateway refuses to start rather than silently encrypting in userspace
+			if pod.Annotations[enableKTLS] == "strict" {
+				ec.EphemeralContainerCommon.Env = append(ec.EphemeralContainerCommon.Env, v1.EnvVar{Name: "KTLS_STRICT", Value: "TRUE"})
+			}
+		}
+
+		// Set what happens when a destination doesn't have a gateway
+		if pod.Annotations[fallback] != "" {
+			ec.EphemeralContainerCommon.Env = append(ec.EphemeralContainerCommon.Env, v1.EnvVar{Name: "FALLBACK", Value: pod.Annotations[fallback]})
+		}
+
+		// Set the TLS profile, the annotation overrides the watcher's default
+		if pod.Annotations[tlsProfile] != "" {
+			ec.EphemeralContainerCommon.Env = append(ec.EphemeralContainerCommon.Env, v1.EnvVar{Name: "TLS_PROFILE", Value: pod.Annotations[tlsProfile]})
+		} else if i.c.tlsProfile != "" {
+			ec.EphemeralContainerCommon.Env = append(ec.EphemeralContainerCommon.Env, v1.EnvVar{Name: "TLS_PROFILE", Value: i.c.tlsProfile})
+		}
+
+		// Set how strictly client certificates are enforced
+		if pod.Annotations[mtlsMode] != "" {
+			ec.EphemeralContainerCommon.Env = append(ec.EphemeralContainerCommon.Env, v1.EnvVar{Name: "MTLS_MODE", Value: pod.Annotations[mtlsMode]})
 		}
 
 	}
+
+	// Mint an intermediate CA for the pod, its gateway signs certificates for the intercepted hosts with it
+	i.c.interceptCert, i.c.interceptKey = nil, nil
+	if pod.Annotations[interceptTLS] != "" {
+		hosts := strings.Split(pod.Annotations[interceptTLS], ",")
+		err := i.c.createInterceptCA(pod.Name, pod.Namespace, hosts)
+		if err != nil {
+			slog.Error("intercept ca", "err", err)
+		} else {
+			ec.EphemeralContainerCommon.Env = append(ec.EphemeralContainerCommon.Env, v1.EnvVar{Name: "INTERCEPT_TLS", Value: pod.Annotations[interceptTLS]})
+			// The application trusts the CA through a bundle mounted from this configmap
+			err = i.c.loadTrustBundle(pod.Namespace, i.clientset)
+			if err != nil {
+				slog.Error("trust bundle", "err", err)
+			}
+		}
+	}
+
 	// Create the secret for the pod
 	err := i.c.loadSecret(pod.Name, pod.Namespace, i.clientset)
 	if err != nil {
@@ -181,6 +243,15 @@ func (i *informerHandler) withProxyContainer(pod *v1.Pod, image *string, forcePu
 		}
 	}
 
+	// Log every HTTP request through the gateway
+	if pod.Annotations[accessLog] != "" {
+		ec.EphemeralContainerCommon.Env = append(ec.EphemeralContainerCommon.Env, v1.EnvVar{Name: "ACCESS_LOG", Value: "stdout"})
+		ec.EphemeralContainerCommon.Env = append(ec.EphemeralContainerCommon.Env, v1.EnvVar{Name: "ACCESS_LOG_FORMAT", Value: pod.Annotations[accessLog]})
+		if pod.Annotations[accessLogSample] != "" {
+			ec.EphemeralContainerCommon.Env = append(ec.EphemeralContainerCommon.Env, v1.EnvVar{Name: "ACCESS_LOG_SAMPLE", Value: pod.Annotations[accessLogSample]})
+		}
+	}
+
 	// Enable the debug mode
 	if pod.Annotations[podcidr] != "" {
 		ec.EphemeralContainerCommon.Env = append(ec.EphemeralContainerCommon.Env, v1.EnvVar{Name: "PODCIDR", Value: pod.Annotations[podcidr]})
@@ -188,6 +259,11 @@ func (i *informerHandler) withProxyContainer(pod *v1.Pod, image *string, forcePu
 		ec.EphemeralContainerCommon.Env = append(ec.EphemeralContainerCommon.Env, v1.EnvVar{Name: "PODCIDR", Value: i.podCIDR})
 	}
 
+	// Restrict the ports other gateways can reach
+	if pod.Annotations[allowedPorts] != "" {
+		ec.EphemeralContainerCommon.Env = append(ec.EphemeralContainerCommon.Env, v1.EnvVar{Name: "ALLOWED_PORTS", Value: pod.Annotations[allowedPorts]})
+	}
+
 	// Enable the debug mode
 	if pod.Annotations[debug] != "" {
 		ec.EphemeralContainerCommon.Env = append(ec.EphemeralContainerCommon.Env, v1.EnvVar{Name: "DEBUG", Value: "TRUE"})
@@ -198,6 +274,9 @@ func (i *informerHandler) withProxyContainer(pod *v1.Pod, image *string, forcePu
 		ec.EphemeralContainerCommon.Env = append(ec.EphemeralContainerCommon.Env, v1.EnvVar{Name: "NETFLUSH", Value: "TRUE"})
 	}
 
+	// Let the gateway know which trust domain the identities belong to
+	ec.EphemeralContainerCommon.Env = append(ec.EphemeralContainerCommon.Env, v1.EnvVar{Name: "TRUST_DOMAIN", Value: i.c.trustDomain})
+
 	// Set the pod to have an enabled annotation
 	pod.Annotations[enabled] = "true"
 
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+// The webhook mounts the trust bundle in pods that intercept TLS. Containers can't be given volumes or environment
+// variables once a pod is running, so this happens when the pod is created rather than when it is enabled
+const (
+	webhookName    = "kube-gateway-watcher"
+	webhookService = "kube-gateway-watcher" // Service in the watcher's namespace, in front of the webhook
+	webhookPath    = "/mutate"
+
+	trustBundleVolume = "kube-gateway-ca"
+	trustBundlePath   = "/etc/kube-gateway"
+)
+
+// Where the system roots are found, the first file that exists is used (as crypto/x509 does on Linux)
+var systemRootFiles = []string{
+	"/etc/ssl/certs/ca-certificates.crt",
+	"/etc/pki/tls/certs/ca-bundle.crt",
+	"/etc/ssl/ca-bundle.pem",
+	"/etc/pki/tls/cacert.pem",
+	"/etc/ssl/cert.pem",
+}
+
+// readSystemRoots returns the watcher's system roots, they are added to the trust bundles so that applications
+// pointed at a bundle still trust public CAs
+func readSystemRoots() []byte {
+	for _, file := range systemRootFiles {
+		b, err := os.ReadFile(file)
+		if err == nil {
+			return b
+		}
+	}
+	slog.Warn("no system roots found, the trust bundles only hold the intercept roots")
+	return nil
+}
+
+// Environment variables that point the common TLS libraries at the bundle, a variable the container already sets is
+// left alone
+var trustBundleEnv = []v1.EnvVar{
+	{Name: "SSL_CERT_FILE", Value: trustBundlePath + "/bundle.crt"},                    // Go, OpenSSL, Ruby
+	{Name: "REQUESTS_CA_BUNDLE", Value: trustBundlePath + "/bundle.crt"},               // Python requests
+	{Name: "CURL_CA_BUNDLE", Value: trustBundlePath + "/bundle.crt"},                   // curl
+	{Name: "NODE_EXTRA_CA_CERTS", Value: trustBundlePath + "/ca.crt"},                  // Node.js, added to its own roots
+	{Name: "AWS_CA_BUNDLE", Value: trustBundlePath + "/bundle.crt"},                    // AWS SDKs
+	{Name: "GRPC_DEFAULT_SSL_ROOTS_FILE_PATH", Value: trustBundlePath + "/bundle.crt"}, // gRPC core
+}
+
+type patchOperation struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	Value any    `json:"value,omitempty"`
+}
+
+// serveWebhook registers the webhook with the API server and serves it, the serving certificate is signed by the
+// mesh CA which is given to the API server as the webhook's CA bundle
+func (c *certs) serveWebhook(clientSet *kubernetes.Clientset, addr string) error {
+	cert, err := c.createServingCertificate(webhookService + "." + watcherNamespace + ".svc")
+	if err != nil {
+		return fmt.Errorf("webhook certificate %v", err)
+	}
+	err = c.registerWebhook(clientSet)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(webhookPath, func(w http.ResponseWriter, r *http.Request) {
+		c.mutate(w, r, clientSet)
+	})
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		TLSConfig:         &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12},
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	slog.Info("webhook", "addr", addr, "path", webhookPath)
+	return server.ListenAndServeTLS("", "")
+}
+
+// createServingCertificate signs a certificate for the webhook's service with the mesh CA
+func (c *certs) createServingCertificate(dnsName string) (tls.Certificate, error) {
+	catls, err := tls.X509KeyPair(c.cacert, c.cakey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	ca, err := x509.ParseCertificate(catls.Certificate[0])
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	cert := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"kube-gateway"},
+			CommonName:   dnsName,
+		},
+		NotBefore:   time.Now(),
+		NotAfter:    time.Now().AddDate(1, 0, 0),
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		DNSNames:    []string{dnsName},
+	}
+	priv, privPEM, err := c.generateKey()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	cert_b, err := x509.CreateCertificate(rand.Reader, cert, ca, priv.Public(), catls.PrivateKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert_b}), privPEM)
+}
+
+// registerWebhook creates (or updates) the webhook configuration. Only pods with the intercept annotation are sent to
+// the webhook, and pods are still created if the watcher is unavailable
+func (c *certs) registerWebhook(clientSet *kubernetes.Clientset) error {
+	failurePolicy := admissionregistrationv1.Ignore
+	sideEffects := admissionregistrationv1.SideEffectClassNoneOnDryRun
+	path := webhookPath
+	timeout := int32(5)
+	config := &admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: webhookName},
+		Webhooks: []admissionregistrationv1.MutatingWebhook{{
+			Name: "intercept-tls.kube-gateway.io",
+			ClientConfig: admissionregistrationv1.WebhookClientConfig{
+				Service: &admissionregistrationv1.ServiceReference{
+					Namespace: watcherNamespace,
+					Name:      webhookService,
+					Path:      &path,
+				},
+				CABundle: c.cacert,
+			},
+			Rules: []admissionregistrationv1.RuleWithOperations{{
+				Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create},
+				Rule: admissionregistrationv1.Rule{
+					APIGroups:   []string{""},
+					APIVersions: []string{"v1"},
+					Resources:   []string{"pods"},
+				},
+			}},
+			NamespaceSelector: &metav1.LabelSelector{
+				MatchExpressions: []metav1.LabelSelectorRequirement{{
+					Key:      "kubernetes.io/metadata.name",
+					Operator: metav1.LabelSelectorOpNotIn,
+					Values:   []string{watcherNamespace, metav1.NamespaceSystem},
+				}},
+			},
+			MatchConditions: []admissionregistrationv1.MatchCondition{{
+				Name:       "intercept-tls",
+				Expression: fmt.Sprintf("has(object.metadata.annotations) && '%s' in object.metadata.annotations", interceptTLS),
+			}},
+			FailurePolicy:           &failurePolicy,
+			SideEffects:             &sideEffects,
+			TimeoutSeconds:          &timeout,
+			AdmissionReviewVersions: []string{"v1"},
+		}},
+	}
+	configs := clientSet.AdmissionregistrationV1().MutatingWebhookConfigurations()
+	existing, err := configs.Get(context.TODO(), webhookName, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		_, err = configs.Create(context.TODO(), config, metav1.CreateOptions{})
+	} else if err == nil {
+		config.ResourceVersion = existing.ResourceVersion
+		_, err = configs.Update(context.TODO(), config, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return fmt.Errorf("unable to register webhook %v", err)
+	}
+	slog.Info("Registered webhook 🪝", "name", webhookName)
+	return nil
+}
+
+// mutate answers an admission review for a pod, mounting the trust bundle if the pod intercepts TLS
+func (c *certs) mutate(w http.ResponseWriter, r *http.Request, clientSet *kubernetes.Clientset) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 4<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var review admissionv1.AdmissionReview
+	err = json.Unmarshal(body, &review)
+	if err != nil || review.Request == nil {
+		http.Error(w, "expected an admission review", http.StatusBadRequest)
+		return
+	}
+	response := &admissionv1.AdmissionResponse{UID: review.Request.UID, Allowed: true}
+
+	var pod v1.Pod
+	err = json.Unmarshal(review.Request.Object.Raw, &pod)
+	if err != nil {
+		slog.Error("webhook pod", "err", err)
+	} else if hosts := pod.Annotations[interceptTLS]; hosts != "" {
+		// The configmap has to exist before the pod starts, as the pod can't start until its volumes are mounted
+		if review.Request.DryRun == nil || !*review.Request.DryRun {
+			err = c.loadTrustBundle(review.Request.Namespace, clientSet)
+			if err != nil {
+				slog.Error("trust bundle", "err", err)
+			}
+		}
+		operations := trustBundlePatch(&pod, isWildcard(strings.Split(hosts, ",")))
+		patch, err := json.Marshal(operations)
+		if err != nil {
+			slog.Error("webhook patch", "err", err)
+		} else if len(operations) != 0 {
+			patchType := admissionv1.PatchTypeJSONPatch
+			response.Patch = patch
+			response.PatchType = &patchType
+			slog.Info("Mounted trust bundle 🔐", "pod", pod.GenerateName+pod.Name, "namespace", review.Request.Namespace)
+		}
+	}
+
+	review.Response = response
+	review.Request = nil
+	b, err := json.Marshal(review)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// trustBundlePatch adds the bundle volume to the pod and mounts it in every container. Pods that intercept every
+// host are given the wildcard root instead, under the same file names
+func trustBundlePatch(pod *v1.Pod, wildcard bool) []patchOperation {
+	prefix := ""
+	if wildcard {
+		prefix = "wildcard-"
+	}
+	volume := v1.Volume{
+		Name: trustBundleVolume,
+		VolumeSource: v1.VolumeSource{
+			ConfigMap: &v1.ConfigMapVolumeSource{
+				LocalObjectReference: v1.LocalObjectReference{Name: trustBundle},
+				Items: []v1.KeyToPath{
+					{Key: prefix + "ca.crt", Path: "ca.crt"},
+					{Key: prefix + "bundle.crt", Path: "bundle.crt"},
+				},
+			},
+		},
+	}
+	var patch []patchOperation
+	for _, existing := range pod.Spec.Volumes {
+		if existing.Name == trustBundleVolume {
+			return nil // Already mounted, by an earlier review or by hand
+		}
+	}
+	patch = appendPatch(patch, "/spec/volumes", len(pod.Spec.Volumes), volume)
+
+	mount := v1.VolumeMount{Name: trustBundleVolume, MountPath: trustBundlePath, ReadOnly: true}
+	for kind, containers := range map[string][]v1.Container{"containers": pod.Spec.Containers, "initContainers": pod.Spec.InitContainers} {
+		for x, container := range containers {
+			base := fmt.Sprintf("/spec/%s/%d", kind, x)
+			patch = appendPatch(patch, base+"/volumeMounts", len(container.VolumeMounts), mount)
+			env := len(container.Env)
+			for _, variable := range trustBundleEnv {
+				if hasEnv(container.Env, variable.Name) {
+					continue
+				}
+				patch = appendPatch(patch, base+"/env", env, variable)
+				env++
+			}
+		}
+	}
+	return patch
+}
+
+// appendPatch adds value to the list at path, which is created if it is empty
+func appendPatch(patch []patchOperation, path string, length int, value any) []patchOperation {
+	if length == 0 {
+		return append(patch, patchOperation{Op: "add", Path: path, Value: []any{value}})
+	}
+	return append(patch, patchOperation{Op: "add", Path: path + "/-", Value: value})
+}
+
+func hasEnv(env []v1.EnvVar, name string) bool {
+	for _, variable := range env {
+		if variable.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// isWildcard is true when every host is intercepted
+func isWildcard(hosts []string) bool {
+	for _, host := range hosts {
+		if strings.TrimSpace(host) == "*" {
+			return true
+		}
+	}
+	return false
+}